@@ -0,0 +1,269 @@
+// Package apierror builds the error bodies returned to clients. The same
+// error is rendered as an Anthropic envelope on /v1/messages and as an
+// OpenAI envelope on /v1/chat/completions, both for plain JSON responses and
+// for errors that happen after a stream has started.
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"vertexai-anthropic-proxy/client"
+	"vertexai-anthropic-proxy/sse"
+	"vertexai-anthropic-proxy/translation"
+)
+
+// Anthropic error types, see https://docs.anthropic.com/en/api/errors
+const (
+	InvalidRequest  = "invalid_request_error"
+	Authentication  = "authentication_error"
+	Permission      = "permission_error"
+	NotFound        = "not_found_error"
+	RequestTooLarge = "request_too_large"
+	RateLimit       = "rate_limit_error"
+	APIError        = "api_error"
+	Overloaded      = "overloaded_error"
+	// BudgetExceeded is not an Anthropic type: the proxy rejects requests
+	// with it once a key's or team's budget is used up
+	BudgetExceeded = "budget_exceeded_error"
+)
+
+// StatusOverloaded is the non-standard status Anthropic uses for
+// overloaded_error.
+const StatusOverloaded = 529
+
+// Error is an error that can be sent to a client. Status is the HTTP status
+// code and Type is the Anthropic error type.
+type Error struct {
+	Status  int
+	Type    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Type, e.Status, e.Message)
+}
+
+// New returns an Error whose type is derived from status.
+func New(status int, format string, args ...interface{}) *Error {
+	return &Error{Status: status, Type: TypeForStatus(status), Message: fmt.Sprintf(format, args...)}
+}
+
+// TypeForStatus maps an HTTP status to the Anthropic error type that the
+// Anthropic API uses for it.
+func TypeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return InvalidRequest
+	case http.StatusUnauthorized:
+		return Authentication
+	case http.StatusForbidden:
+		return Permission
+	case http.StatusNotFound:
+		return NotFound
+	case http.StatusRequestEntityTooLarge:
+		return RequestTooLarge
+	case http.StatusTooManyRequests:
+		return RateLimit
+	case http.StatusPaymentRequired:
+		return BudgetExceeded
+	case StatusOverloaded, http.StatusServiceUnavailable:
+		return Overloaded
+	}
+	if status >= 400 && status < 500 {
+		return InvalidRequest
+	}
+	return APIError
+}
+
+// FromUpstream converts an error from the Vertex AI client. Upstream HTTP
+// errors keep their status code and message; anything else (network
+// failures, credential errors) becomes a 500 api_error, except that open
+// circuit breakers are reported as a 503 overloaded_error.
+func FromUpstream(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	if errors.Is(err, client.ErrCircuitOpen) {
+		return &Error{Status: http.StatusServiceUnavailable, Type: Overloaded, Message: "Vertex AI is temporarily unavailable for this model"}
+	}
+
+	var vertexErr *client.VertexError
+	if !errors.As(err, &vertexErr) {
+		return &Error{Status: http.StatusInternalServerError, Type: APIError, Message: "Error communicating with Vertex AI"}
+	}
+
+	e := &Error{Status: vertexErr.StatusCode, Type: TypeForStatus(vertexErr.StatusCode)}
+	errType, message := parseUpstreamBody(vertexErr.Body)
+	if errType != "" {
+		e.Type = errType
+	}
+	e.Message = message
+	if e.Message == "" {
+		e.Message = http.StatusText(vertexErr.StatusCode)
+	}
+	return e
+}
+
+// FromStreamError converts an "error" event received from Vertex AI
+// mid-stream.
+func FromStreamError(se *translation.StreamError) *Error {
+	return &Error{Status: StatusForType(se.Type), Type: se.Type, Message: se.Message}
+}
+
+// StatusForType is the inverse of TypeForStatus.
+func StatusForType(errType string) int {
+	switch errType {
+	case InvalidRequest:
+		return http.StatusBadRequest
+	case Authentication:
+		return http.StatusUnauthorized
+	case Permission:
+		return http.StatusForbidden
+	case NotFound:
+		return http.StatusNotFound
+	case RequestTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case RateLimit:
+		return http.StatusTooManyRequests
+	case BudgetExceeded:
+		return http.StatusPaymentRequired
+	case Overloaded:
+		return StatusOverloaded
+	}
+	return http.StatusInternalServerError
+}
+
+// parseUpstreamBody extracts the error type and message from a Vertex AI
+// error body. Vertex AI either passes through the Anthropic envelope or
+// returns a Google API error, sometimes wrapped in a one-element array.
+func parseUpstreamBody(body []byte) (string, string) {
+	var anthropic struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &anthropic) == nil && anthropic.Type == "error" {
+		return anthropic.Error.Type, anthropic.Error.Message
+	}
+
+	type googleError struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	var google googleError
+	if json.Unmarshal(body, &google) == nil && google.Error.Message != "" {
+		return "", google.Error.Message
+	}
+	var googleList []googleError
+	if json.Unmarshal(body, &googleList) == nil && len(googleList) > 0 {
+		return "", googleList[0].Error.Message
+	}
+
+	return "", ""
+}
+
+type anthropicBody struct {
+	Type  string         `json:"type"`
+	Error anthropicError `json:"error"`
+}
+
+type anthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// AnthropicJSON renders e as {"type":"error","error":{"type","message"}}.
+func (e *Error) AnthropicJSON() []byte {
+	data, _ := json.Marshal(anthropicBody{Type: "error", Error: anthropicError{Type: e.Type, Message: e.Message}})
+	return data
+}
+
+type openAIBody struct {
+	Error openAIError `json:"error"`
+}
+
+type openAIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// openAITypes maps Anthropic error types to the OpenAI type and code used
+// for the same condition.
+var openAITypes = map[string][2]string{
+	InvalidRequest:  {"invalid_request_error", ""},
+	Authentication:  {"invalid_request_error", "invalid_api_key"},
+	Permission:      {"invalid_request_error", "permission_denied"},
+	NotFound:        {"invalid_request_error", "not_found"},
+	RequestTooLarge: {"invalid_request_error", "request_too_large"},
+	RateLimit:       {"rate_limit_error", "rate_limit_exceeded"},
+	APIError:        {"server_error", ""},
+	Overloaded:      {"server_error", "overloaded"},
+	BudgetExceeded:  {"budget_exceeded_error", "budget_exceeded"},
+}
+
+// OpenAIJSON renders e as {"error":{"message","type","param","code"}}.
+func (e *Error) OpenAIJSON() []byte {
+	mapped, ok := openAITypes[e.Type]
+	if !ok {
+		mapped = [2]string{e.Type, ""}
+	}
+	body := openAIBody{Error: openAIError{Message: e.Message, Type: mapped[0]}}
+	if mapped[1] != "" {
+		body.Error.Code = &mapped[1]
+	}
+	data, _ := json.Marshal(body)
+	return data
+}
+
+// WriteAnthropic writes e as an Anthropic error response.
+func WriteAnthropic(w http.ResponseWriter, e *Error) {
+	write(w, e.Status, e.AnthropicJSON())
+}
+
+// WriteOpenAI writes e as an OpenAI error response.
+func WriteOpenAI(w http.ResponseWriter, e *Error) {
+	write(w, e.Status, e.OpenAIJSON())
+}
+
+// Write picks the envelope from the request path, for code such as
+// middleware that is shared by the Anthropic and OpenAI endpoints.
+func Write(w http.ResponseWriter, r *http.Request, e *Error) {
+	if IsOpenAIPath(r.URL.Path) {
+		WriteOpenAI(w, e)
+		return
+	}
+	WriteAnthropic(w, e)
+}
+
+// IsOpenAIPath reports whether path is served with OpenAI-shaped responses.
+func IsOpenAIPath(path string) bool {
+	return strings.HasPrefix(path, "/v1/chat/")
+}
+
+func write(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// WriteAnthropicEvent sends e as an "error" event on a stream that has
+// already started, as the Anthropic API does.
+func WriteAnthropicEvent(w *sse.Writer, e *Error) error {
+	return w.WriteEvent(sse.Event{Event: "error", Data: string(e.AnthropicJSON())})
+}
+
+// WriteOpenAIEvent sends e as a data-only event carrying the OpenAI error
+// envelope, which the OpenAI SDKs raise as an API error.
+func WriteOpenAIEvent(w *sse.Writer, e *Error) error {
+	return w.WriteData(string(e.OpenAIJSON()))
+}
@@ -0,0 +1,140 @@
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"vertexai-anthropic-proxy/client"
+	"vertexai-anthropic-proxy/sse"
+)
+
+func TestFromUpstream(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantStatus  int
+		wantType    string
+		wantMessage string
+	}{
+		{
+			name:        "Anthropic envelope",
+			err:         &client.VertexError{StatusCode: 529, Body: []byte(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)},
+			wantStatus:  529,
+			wantType:    Overloaded,
+			wantMessage: "Overloaded",
+		},
+		{
+			name:        "Google error",
+			err:         &client.VertexError{StatusCode: 429, Body: []byte(`{"error":{"code":429,"message":"Quota exceeded","status":"RESOURCE_EXHAUSTED"}}`)},
+			wantStatus:  429,
+			wantType:    RateLimit,
+			wantMessage: "Quota exceeded",
+		},
+		{
+			name:        "Google error list",
+			err:         &client.VertexError{StatusCode: 403, Body: []byte(`[{"error":{"code":403,"message":"Permission denied","status":"PERMISSION_DENIED"}}]`)},
+			wantStatus:  403,
+			wantType:    Permission,
+			wantMessage: "Permission denied",
+		},
+		{
+			name:        "Unparseable body",
+			err:         &client.VertexError{StatusCode: 502, Body: []byte(`<html>Bad Gateway</html>`)},
+			wantStatus:  502,
+			wantType:    APIError,
+			wantMessage: "Bad Gateway",
+		},
+		{
+			name:        "Circuit breaker open",
+			err:         fmt.Errorf("%w for claude-3-5-sonnet@20240620", client.ErrCircuitOpen),
+			wantStatus:  503,
+			wantType:    Overloaded,
+			wantMessage: "Vertex AI is temporarily unavailable for this model",
+		},
+		{
+			name:        "Network failure",
+			err:         errors.New("dial tcp: connection refused"),
+			wantStatus:  500,
+			wantType:    APIError,
+			wantMessage: "Error communicating with Vertex AI",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := FromUpstream(tt.err)
+			if got.Status != tt.wantStatus || got.Type != tt.wantType || got.Message != tt.wantMessage {
+				t.Errorf("FromUpstream() = %+v, want {%d %s %s}", got, tt.wantStatus, tt.wantType, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestTypeForStatus(t *testing.T) {
+	tests := map[int]string{
+		400: InvalidRequest,
+		401: Authentication,
+		402: BudgetExceeded,
+		403: Permission,
+		404: NotFound,
+		413: RequestTooLarge,
+		422: InvalidRequest,
+		429: RateLimit,
+		500: APIError,
+		503: Overloaded,
+		529: Overloaded,
+	}
+	for status, want := range tests {
+		if got := TypeForStatus(status); got != want {
+			t.Errorf("TypeForStatus(%d) = %s, want %s", status, got, want)
+		}
+	}
+}
+
+func TestEnvelopes(t *testing.T) {
+	e := New(http.StatusTooManyRequests, "Too many requests")
+
+	if got, want := string(e.AnthropicJSON()), `{"type":"error","error":{"type":"rate_limit_error","message":"Too many requests"}}`; got != want {
+		t.Errorf("AnthropicJSON() = %s, want %s", got, want)
+	}
+	if got, want := string(e.OpenAIJSON()), `{"error":{"message":"Too many requests","type":"rate_limit_error","param":null,"code":"rate_limit_exceeded"}}`; got != want {
+		t.Errorf("OpenAIJSON() = %s, want %s", got, want)
+	}
+
+	bad := New(http.StatusBadRequest, "messages: field required")
+	if got, want := string(bad.OpenAIJSON()), `{"error":{"message":"messages: field required","type":"invalid_request_error","param":null,"code":null}}`; got != want {
+		t.Errorf("OpenAIJSON() = %s, want %s", got, want)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	e := New(http.StatusUnauthorized, "invalid x-api-key")
+
+	rr := httptest.NewRecorder()
+	Write(rr, httptest.NewRequest("POST", "/v1/messages", nil), e)
+	if rr.Code != http.StatusUnauthorized || rr.Body.String() != string(e.AnthropicJSON()) {
+		t.Errorf("/v1/messages got %d %s", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	rr = httptest.NewRecorder()
+	Write(rr, httptest.NewRequest("POST", "/v1/chat/completions", nil), e)
+	if rr.Code != http.StatusUnauthorized || rr.Body.String() != string(e.OpenAIJSON()) {
+		t.Errorf("/v1/chat/completions got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestWriteAnthropicEvent(t *testing.T) {
+	rr := httptest.NewRecorder()
+	WriteAnthropicEvent(sse.NewWriter(rr), New(StatusOverloaded, "Overloaded"))
+
+	want := "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n"
+	if rr.Body.String() != want {
+		t.Errorf("body = %q, want %q", rr.Body.String(), want)
+	}
+}
@@ -0,0 +1,128 @@
+// Package budget enforces spend budgets per API key and per team. A budget
+// caps the dollars or tokens used in a day, week or month; requests past a
+// soft limit are warned about, and requests once the budget is used up are
+// rejected until it resets.
+package budget
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Period is how often a budget resets.
+type Period string
+
+const (
+	// Daily budgets reset at midnight UTC
+	Daily Period = "daily"
+	// Weekly budgets reset on Monday at midnight UTC
+	Weekly Period = "weekly"
+	// Monthly budgets reset at midnight UTC on their ResetDay
+	Monthly Period = "monthly"
+)
+
+// DefaultSoftLimit is the share of a budget after which requests are
+// warned about, if the budget does not set one.
+const DefaultSoftLimit = 0.8
+
+// Budget caps the spend of a key or team in each period. At least one of
+// USD and Tokens is set; a request is rejected once either is used up.
+type Budget struct {
+	Period Period  `json:"period"`
+	USD    float64 `json:"usd,omitempty"`
+	// Tokens counts input, cache and output tokens together
+	Tokens int64 `json:"tokens,omitempty"`
+	// SoftLimit is the share of the budget, between 0 and 1, after which
+	// responses carry a warning; 0 means DefaultSoftLimit
+	SoftLimit float64 `json:"soft_limit,omitempty"`
+	// ResetDay is the day of the month, 1 to 28, on which a monthly
+	// budget resets; 0 means the 1st
+	ResetDay int `json:"reset_day,omitempty"`
+}
+
+// Validate checks that b is complete and consistent.
+func (b Budget) Validate() error {
+	switch b.Period {
+	case Daily, Weekly, Monthly:
+	default:
+		return fmt.Errorf("unknown budget period %q (want daily, weekly or monthly)", b.Period)
+	}
+	if b.USD < 0 || b.Tokens < 0 {
+		return fmt.Errorf("%s budget is negative", b.Period)
+	}
+	if b.USD == 0 && b.Tokens == 0 {
+		return fmt.Errorf("%s budget sets neither usd nor tokens", b.Period)
+	}
+	if b.SoftLimit < 0 || b.SoftLimit > 1 {
+		return fmt.Errorf("%s budget soft_limit %v is not between 0 and 1", b.Period, b.SoftLimit)
+	}
+	if b.ResetDay < 0 || b.ResetDay > 28 {
+		return fmt.Errorf("%s budget reset_day %d is not between 1 and 28", b.Period, b.ResetDay)
+	}
+	if b.ResetDay != 0 && b.Period != Monthly {
+		return fmt.Errorf("reset_day only applies to monthly budgets")
+	}
+	return nil
+}
+
+func (b Budget) softLimit() float64 {
+	if b.SoftLimit == 0 {
+		return DefaultSoftLimit
+	}
+	return b.SoftLimit
+}
+
+// Window returns the start of the period containing now and when it ends.
+func (b Budget) Window(now time.Time) (start, reset time.Time) {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch b.Period {
+	case Weekly:
+		daysSinceMonday := (int(today.Weekday()) + 6) % 7
+		start = today.AddDate(0, 0, -daysSinceMonday)
+		return start, start.AddDate(0, 0, 7)
+	case Monthly:
+		day := b.ResetDay
+		if day == 0 {
+			day = 1
+		}
+		start = time.Date(today.Year(), today.Month(), day, 0, 0, 0, 0, time.UTC)
+		if today.Before(start) {
+			start = start.AddDate(0, -1, 0)
+		}
+		return start, start.AddDate(0, 1, 0)
+	}
+	return today, today.AddDate(0, 0, 1)
+}
+
+// Validate checks every budget in budgets.
+func Validate(budgets []Budget) error {
+	for _, b := range budgets {
+		if err := b.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadTeams reads team budgets from a JSON file of the form
+// {"build-team": [{"period": "monthly", "usd": 500, "soft_limit": 0.9}]}.
+func LoadTeams(path string) (map[string][]Budget, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var teams map[string][]Budget
+	if err := json.Unmarshal(data, &teams); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for team, budgets := range teams {
+		if err := Validate(budgets); err != nil {
+			return nil, fmt.Errorf("%s: team %s: %v", path, team, err)
+		}
+	}
+	return teams, nil
+}
@@ -0,0 +1,95 @@
+package budget
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []Budget{
+		{Period: Daily, USD: 10},
+		{Period: Weekly, Tokens: 1000000, SoftLimit: 0.5},
+		{Period: Monthly, USD: 500, Tokens: 1000000, ResetDay: 15},
+	}
+	for _, b := range valid {
+		if err := b.Validate(); err != nil {
+			t.Errorf("Validate(%+v) error = %v", b, err)
+		}
+	}
+
+	invalid := map[string]Budget{
+		"no period":        {USD: 10},
+		"unknown period":   {Period: "yearly", USD: 10},
+		"no limit":         {Period: Daily},
+		"negative":         {Period: Daily, USD: -1},
+		"soft limit":       {Period: Daily, USD: 10, SoftLimit: 1.5},
+		"reset day":        {Period: Monthly, USD: 10, ResetDay: 31},
+		"daily reset day":  {Period: Daily, USD: 10, ResetDay: 2},
+		"weekly reset day": {Period: Weekly, USD: 10, ResetDay: 2},
+	}
+	for name, b := range invalid {
+		if err := b.Validate(); err == nil {
+			t.Errorf("Validate(%s) should fail", name)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	day := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	// A Wednesday afternoon
+	now := time.Date(2024, 7, 10, 15, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		budget     Budget
+		now        time.Time
+		start, end string
+	}{
+		{"daily", Budget{Period: Daily}, now, "2024-07-10", "2024-07-11"},
+		{"weekly", Budget{Period: Weekly}, now, "2024-07-08", "2024-07-15"},
+		{"weekly on monday", Budget{Period: Weekly}, day("2024-07-08"), "2024-07-08", "2024-07-15"},
+		{"weekly on sunday", Budget{Period: Weekly}, day("2024-07-14"), "2024-07-08", "2024-07-15"},
+		{"monthly", Budget{Period: Monthly}, now, "2024-07-01", "2024-08-01"},
+		{"monthly after reset day", Budget{Period: Monthly, ResetDay: 5}, now, "2024-07-05", "2024-08-05"},
+		{"monthly before reset day", Budget{Period: Monthly, ResetDay: 15}, now, "2024-06-15", "2024-07-15"},
+		{"monthly across the year", Budget{Period: Monthly, ResetDay: 20}, day("2025-01-03"), "2024-12-20", "2025-01-20"},
+		{"other time zone", Budget{Period: Daily}, time.Date(2024, 7, 10, 23, 0, 0, 0, time.FixedZone("", -5*3600)), "2024-07-11", "2024-07-12"},
+	}
+	for _, tt := range tests {
+		start, end := tt.budget.Window(tt.now)
+		if !start.Equal(day(tt.start)) || !end.Equal(day(tt.end)) {
+			t.Errorf("%s: Window() = %s, %s, want %s, %s", tt.name, start.Format("2006-01-02"), end.Format("2006-01-02"), tt.start, tt.end)
+		}
+	}
+}
+
+func TestLoadTeams(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "teams.json")
+	if err := os.WriteFile(path, []byte(`{"build": [{"period": "monthly", "usd": 500, "soft_limit": 0.9}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	teams, err := LoadTeams(path)
+	if err != nil {
+		t.Fatalf("LoadTeams() error = %v", err)
+	}
+	if got := teams["build"]; len(got) != 1 || got[0].USD != 500 || got[0].SoftLimit != 0.9 {
+		t.Errorf("teams[build] = %+v", got)
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte(`{"build": [{"period": "monthly"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTeams(bad); err == nil {
+		t.Error("LoadTeams() should reject a budget without limits")
+	}
+}
@@ -0,0 +1,305 @@
+package budget
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"vertexai-anthropic-proxy/config"
+	"vertexai-anthropic-proxy/translation"
+	"vertexai-anthropic-proxy/usage"
+)
+
+// Scopes a budget applies to
+const (
+	ScopeKey  = "key"
+	ScopeTeam = "team"
+)
+
+// retention is how many days of spend are kept: enough for any monthly
+// window.
+const retention = 32
+
+const dayFormat = "2006-01-02"
+
+// Status is how much of one budget has been used.
+type Status struct {
+	Scope       string
+	ID          string
+	Budget      Budget
+	UsedUSD     float64
+	UsedTokens  int64
+	ResetAt     time.Time
+	windowStart time.Time
+}
+
+// Used is the share of the budget used, the larger of the dollar and
+// token shares.
+func (s Status) Used() float64 {
+	var used float64
+	if s.Budget.USD > 0 {
+		used = s.UsedUSD / s.Budget.USD
+	}
+	if s.Budget.Tokens > 0 {
+		if tokens := float64(s.UsedTokens) / float64(s.Budget.Tokens); tokens > used {
+			used = tokens
+		}
+	}
+	return used
+}
+
+func (s Status) String() string {
+	var limits string
+	if s.Budget.USD > 0 {
+		limits = fmt.Sprintf("$%.2f of $%.2f", s.UsedUSD, s.Budget.USD)
+	}
+	if s.Budget.Tokens > 0 {
+		if limits != "" {
+			limits += ", "
+		}
+		limits += fmt.Sprintf("%d of %d tokens", s.UsedTokens, s.Budget.Tokens)
+	}
+	return fmt.Sprintf("%s %s: %.0f%% of %s budget used (%s), resets %s",
+		s.Scope, s.ID, 100*s.Used(), s.Budget.Period, limits, s.ResetAt.Format(time.RFC3339))
+}
+
+// Result is the outcome of checking a request against its budgets.
+type Result struct {
+	// Exceeded is the first budget used up, if any; the request must be
+	// rejected
+	Exceeded *Status
+	// Warnings are the budgets past their soft limit
+	Warnings []Status
+	// NewWarnings are the Warnings not reported before in the current
+	// period, so they are logged once
+	NewWarnings []Status
+}
+
+type account struct {
+	scope, id string
+}
+
+type spend struct {
+	usd    float64
+	tokens int64
+}
+
+// Tracker adds up spend per key and team in daily buckets and checks it
+// against their budgets. It is safe for concurrent use.
+type Tracker struct {
+	prices usage.Prices
+	now    func() time.Time
+	// path is the team budgets file, if any
+	path string
+
+	mu    sync.Mutex
+	teams map[string][]Budget
+	spend map[account]map[string]*spend
+	// warned holds the reset time of each budget window that has been
+	// warned about; windows are dropped once they have reset
+	warned map[string]time.Time
+}
+
+// NewTracker returns a tracker that prices usage with prices and applies
+// teams' budgets to keys of those teams.
+func NewTracker(prices usage.Prices, teams map[string][]Budget) *Tracker {
+	return &Tracker{
+		prices: prices,
+		now:    time.Now,
+		teams:  teams,
+		spend:  make(map[account]map[string]*spend),
+		warned: make(map[string]time.Time),
+	}
+}
+
+// FromConfig returns a tracker with the team budgets in TEAM_BUDGETS_FILE,
+// if it is set.
+func FromConfig(cfg *config.Config, prices usage.Prices) (*Tracker, error) {
+	t := NewTracker(prices, nil)
+	t.path = cfg.TeamBudgetsFile
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload rereads the team budgets file, e.g. after budgets were changed.
+// On error the current budgets are kept. Spend so far is not affected.
+func (t *Tracker) Reload() error {
+	if t.path == "" {
+		return nil
+	}
+	teams, err := LoadTeams(t.path)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.teams = teams
+	return nil
+}
+
+// Seed adds the spend recorded in ledger, so budgets survive a restart.
+func (t *Tracker) Seed(ledger *usage.Ledger) error {
+	since := t.now().UTC().AddDate(0, 0, -retention)
+	return ledger.Records(func(rec usage.Record) {
+		if rec.Time.Before(since) {
+			return
+		}
+		tokens := rec.InputTokens + rec.CacheCreationInputTokens + rec.CacheReadInputTokens + rec.OutputTokens
+		t.add(rec.Key, rec.Team, rec.Time, rec.CostUSD, int64(tokens))
+	})
+}
+
+// Check returns the status of the budgets of key keyID, which has
+// keyBudgets and belongs to team.
+func (t *Tracker) Check(keyID, team string, keyBudgets []Budget) Result {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var result Result
+	check := func(a account, budgets []Budget) {
+		for _, b := range budgets {
+			s := t.status(a, b, now)
+			used := s.Used()
+			switch {
+			case used >= 1:
+				if result.Exceeded == nil {
+					result.Exceeded = &s
+				}
+			case used >= b.softLimit():
+				result.Warnings = append(result.Warnings, s)
+				warning := fmt.Sprintf("%s/%s/%s/%s", a.scope, a.id, b.Period, s.windowStart.Format(dayFormat))
+				if _, ok := t.warned[warning]; !ok {
+					t.pruneWarned(now)
+					t.warned[warning] = s.ResetAt
+					result.NewWarnings = append(result.NewWarnings, s)
+				}
+			}
+		}
+	}
+	check(account{ScopeKey, keyID}, keyBudgets)
+	if team != "" {
+		check(account{ScopeTeam, team}, t.teams[team])
+	}
+	return result
+}
+
+// status adds up a's spend in the window of b containing now.
+func (t *Tracker) status(a account, b Budget, now time.Time) Status {
+	start, reset := b.Window(now)
+	s := Status{Scope: a.scope, ID: a.id, Budget: b, ResetAt: reset, windowStart: start}
+	days := t.spend[a]
+	for day := start; day.Before(reset) && !day.After(now); day = day.AddDate(0, 0, 1) {
+		if sp, ok := days[day.Format(dayFormat)]; ok {
+			s.UsedUSD += sp.usd
+			s.UsedTokens += sp.tokens
+		}
+	}
+	return s
+}
+
+func (t *Tracker) add(keyID, team string, at time.Time, usd float64, tokens int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	day := at.UTC().Format(dayFormat)
+	accounts := []account{{ScopeKey, keyID}}
+	if team != "" {
+		accounts = append(accounts, account{ScopeTeam, team})
+	}
+	for _, a := range accounts {
+		days, ok := t.spend[a]
+		if !ok {
+			days = make(map[string]*spend)
+			t.spend[a] = days
+		}
+		sp, ok := days[day]
+		if !ok {
+			sp = &spend{}
+			days[day] = sp
+			t.prune(days)
+		}
+		sp.usd += usd
+		sp.tokens += tokens
+	}
+}
+
+// prune drops the buckets older than retention. Days are formatted so
+// that they sort as strings.
+func (t *Tracker) prune(days map[string]*spend) {
+	oldest := t.now().UTC().AddDate(0, 0, -retention).Format(dayFormat)
+	for day := range days {
+		if day < oldest {
+			delete(days, day)
+		}
+	}
+}
+
+// pruneWarned forgets the warnings of windows that have reset by now.
+func (t *Tracker) pruneWarned(now time.Time) {
+	for warning, reset := range t.warned {
+		if !now.Before(reset) {
+			delete(t.warned, warning)
+		}
+	}
+}
+
+// Charge adds the usage of one request to its key's and team's spend.
+// Requests that BudgetMiddleware let through without a key carry no
+// Charge, and settling the nil Charge does not count anything.
+type Charge struct {
+	t           *Tracker
+	keyID, team string
+
+	mu          sync.Mutex
+	vertexModel string
+	settled     bool
+}
+
+// NewCharge returns a Charge for a request by key keyID of team.
+func (t *Tracker) NewCharge(keyID, team string) *Charge {
+	return &Charge{t: t, keyID: keyID, team: team}
+}
+
+// SetModel sets the Vertex AI model ID the request is priced at.
+func (c *Charge) SetModel(vertexModel string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vertexModel = vertexModel
+}
+
+// Settle charges the usage Vertex AI reported. Only the first call counts.
+func (c *Charge) Settle(u translation.Usage) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.settled {
+		return
+	}
+	c.settled = true
+
+	cost, _ := c.t.prices.Cost(c.vertexModel, u)
+	tokens := u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens + u.OutputTokens
+	c.t.add(c.keyID, c.team, c.t.now(), cost, int64(tokens))
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying c.
+func NewContext(ctx context.Context, c *Charge) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+// FromContext returns the Charge in ctx, or nil if there is none.
+func FromContext(ctx context.Context) *Charge {
+	c, _ := ctx.Value(contextKey{}).(*Charge)
+	return c
+}
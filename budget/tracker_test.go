@@ -0,0 +1,146 @@
+package budget
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vertexai-anthropic-proxy/translation"
+	"vertexai-anthropic-proxy/usage"
+)
+
+// newTestTracker returns a tracker whose clock is *now, starting on
+// Wednesday 2024-07-10 at noon UTC.
+func newTestTracker(teams map[string][]Budget) (*Tracker, *time.Time) {
+	now := time.Date(2024, 7, 10, 12, 0, 0, 0, time.UTC)
+	t := NewTracker(usage.DefaultPrices(), teams)
+	t.now = func() time.Time { return now }
+	return t, &now
+}
+
+// spendUSD charges key keyID of team usd dollars of Claude 3.5 Sonnet
+// output.
+func spendUSD(t *Tracker, keyID, team string, usd float64) {
+	c := t.NewCharge(keyID, team)
+	c.SetModel("claude-3-5-sonnet@20240620")
+	c.Settle(translation.Usage{OutputTokens: int(usd / 15 * 1e6)})
+}
+
+func TestCheck(t *testing.T) {
+	tracker, now := newTestTracker(map[string][]Budget{
+		"build": {{Period: Monthly, USD: 10}},
+	})
+	keyBudgets := []Budget{{Period: Daily, USD: 1}}
+
+	if r := tracker.Check("ci", "build", keyBudgets); r.Exceeded != nil || len(r.Warnings) != 0 {
+		t.Fatalf("Check() before spending = %+v", r)
+	}
+
+	// Past the soft limit the key is warned, and only reported once
+	spendUSD(tracker, "ci", "build", 0.9)
+	r := tracker.Check("ci", "build", keyBudgets)
+	if r.Exceeded != nil || len(r.Warnings) != 1 || len(r.NewWarnings) != 1 {
+		t.Fatalf("Check() past the soft limit = %+v", r)
+	}
+	if s := r.Warnings[0]; s.Scope != ScopeKey || s.ID != "ci" || math.Abs(s.UsedUSD-0.9) > 1e-6 {
+		t.Errorf("warning = %+v", s)
+	}
+	if r := tracker.Check("ci", "build", keyBudgets); len(r.Warnings) != 1 || len(r.NewWarnings) != 0 {
+		t.Errorf("second Check() = %+v, want the warning but not as new", r)
+	}
+
+	// Once used up the key is rejected until the next day
+	spendUSD(tracker, "ci", "build", 0.2)
+	r = tracker.Check("ci", "build", keyBudgets)
+	if r.Exceeded == nil || r.Exceeded.Scope != ScopeKey {
+		t.Fatalf("Check() past the budget = %+v", r)
+	}
+	if want := time.Date(2024, 7, 11, 0, 0, 0, 0, time.UTC); !r.Exceeded.ResetAt.Equal(want) {
+		t.Errorf("ResetAt = %s, want %s", r.Exceeded.ResetAt, want)
+	}
+	*now = now.Add(24 * time.Hour)
+	if r := tracker.Check("ci", "build", keyBudgets); r.Exceeded != nil || len(r.Warnings) != 0 {
+		t.Errorf("Check() the next day = %+v", r)
+	}
+
+	// A new day warns again, and the warning of the day before is forgotten
+	spendUSD(tracker, "ci", "build", 0.9)
+	if r := tracker.Check("ci", "build", keyBudgets); len(r.NewWarnings) != 1 {
+		t.Errorf("Check() past the soft limit the next day = %+v", r)
+	}
+	if len(tracker.warned) != 1 {
+		t.Errorf("warned = %v, want only the current day", tracker.warned)
+	}
+
+	// The team's budget adds up all its keys and outlasts the day
+	spendUSD(tracker, "web", "build", 9)
+	r = tracker.Check("ci", "build", keyBudgets)
+	if r.Exceeded == nil || r.Exceeded.Scope != ScopeTeam || r.Exceeded.ID != "build" {
+		t.Errorf("Check() past the team budget = %+v", r)
+	}
+	if r := tracker.Check("other", "", keyBudgets); r.Exceeded != nil {
+		t.Errorf("Check() of a key without spend = %+v", r)
+	}
+}
+
+func TestCheckTokens(t *testing.T) {
+	tracker, _ := newTestTracker(nil)
+	budgets := []Budget{{Period: Weekly, Tokens: 1000, SoftLimit: 0.5}}
+
+	c := tracker.NewCharge("ci", "")
+	c.SetModel("unpriced-model")
+	c.Settle(translation.Usage{InputTokens: 400, CacheReadInputTokens: 100, OutputTokens: 100})
+	c.Settle(translation.Usage{InputTokens: 1000}) // only the first Settle counts
+
+	r := tracker.Check("ci", "", budgets)
+	if len(r.Warnings) != 1 || r.Warnings[0].UsedTokens != 600 || r.Exceeded != nil {
+		t.Errorf("Check() = %+v", r)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	ledger, err := usage.Open(filepath.Join(t.TempDir(), "usage.jsonl"), usage.DefaultPrices())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+	for i := 0; i < 2; i++ {
+		e := ledger.Start("/v1/messages", usage.Account{Key: "ci", Team: "build"})
+		e.SetModel("claude-3-5-sonnet", "claude-3-5-sonnet@20240620")
+		e.SetUsage(translation.Usage{OutputTokens: 100000})
+		if err := ledger.Finish(e, 200); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracker := NewTracker(usage.DefaultPrices(), map[string][]Budget{"build": {{Period: Daily, USD: 3.5}}})
+	if err := tracker.Seed(ledger); err != nil {
+		t.Fatal(err)
+	}
+	r := tracker.Check("ci", "build", []Budget{{Period: Daily, USD: 5}})
+	if r.Exceeded != nil || len(r.Warnings) != 1 || r.Warnings[0].Scope != ScopeTeam || math.Abs(r.Warnings[0].UsedUSD-3) > 1e-9 {
+		t.Errorf("Check() after Seed = %+v", r)
+	}
+
+	if err := tracker.Seed(nil); err != usage.ErrNoLedger {
+		t.Errorf("Seed(nil) error = %v, want ErrNoLedger", err)
+	}
+}
+
+func TestChargeContext(t *testing.T) {
+	if c := FromContext(context.Background()); c != nil {
+		t.Errorf("FromContext() = %v, want nil", c)
+	}
+	// A nil Charge is safe to use
+	var c *Charge
+	c.SetModel("claude-3-5-sonnet@20240620")
+	c.Settle(translation.Usage{OutputTokens: 1})
+
+	tracker, _ := newTestTracker(nil)
+	c = tracker.NewCharge("ci", "")
+	if got := FromContext(NewContext(context.Background(), c)); got != c {
+		t.Errorf("FromContext() = %v, want %v", got, c)
+	}
+}
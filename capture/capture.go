@@ -0,0 +1,321 @@
+// Package capture records whole exchanges with the proxy as JSON lines: the
+// inbound request, the VertexAIRequest it was translated to, each attempt
+// against Vertex AI with its response body or stream events, and when each
+// of them happened. Captures are for debugging translations and building
+// regression fixtures; they hold prompts and completions unless redaction
+// rules remove them.
+package capture
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"vertexai-anthropic-proxy/sse"
+)
+
+// Record is one line of a capture file.
+type Record struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Key is the ID of the API key the request was authenticated with
+	Key     string  `json:"key,omitempty"`
+	Request Request `json:"request"`
+	// Vertex is the request sent to Vertex AI, if it got that far
+	Vertex *VertexRequest `json:"vertex_request,omitempty"`
+	// Attempts are the requests to Vertex AI backends, in order
+	Attempts []Attempt `json:"attempts,omitempty"`
+	// Status is the status the proxy answered with
+	Status     int   `json:"status"`
+	DurationMS int64 `json:"duration_ms"`
+}
+
+// Request is the request the client sent. Secret headers are replaced by
+// their fingerprint.
+type Request struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is the JSON body, or a string if it is not JSON
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// VertexRequest is the translated request as sent to Vertex AI.
+type VertexRequest struct {
+	Model  string `json:"model"`
+	Stream bool   `json:"stream"`
+	// Hash is the RequestHash of the request before redaction, which
+	// replay looks recordings up by
+	Hash     string          `json:"hash"`
+	OffsetMS int64           `json:"offset_ms"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// Attempt is one request to a Vertex AI backend. Offsets are in
+// milliseconds since the proxy received the request.
+type Attempt struct {
+	Backend  string `json:"backend"`
+	URL      string `json:"url"`
+	OffsetMS int64  `json:"offset_ms"`
+	// HeadersMS is when the response headers arrived
+	HeadersMS int64 `json:"headers_ms,omitempty"`
+	Status    int   `json:"status,omitempty"`
+	// Error is set if no response arrived, e.g. on a network error
+	Error string `json:"error,omitempty"`
+	// Body is the response of a non-streaming or failed request; Events
+	// are the events of a stream
+	Body   json.RawMessage `json:"body,omitempty"`
+	Events []Event         `json:"events,omitempty"`
+	// DoneMS is when the response body was closed
+	DoneMS int64 `json:"done_ms,omitempty"`
+}
+
+// Event is a server-sent event of a streamed response.
+type Event struct {
+	OffsetMS int64  `json:"offset_ms"`
+	Event    string `json:"event,omitempty"`
+	// Data is the JSON data of the event, or a string if it is not JSON
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Exchange collects the record of one request while it is handled.
+// Requests left out by sampling have a nil Exchange, which records nothing
+// and hands out nil AttemptRecorders.
+type Exchange struct {
+	redact Redaction
+	start  time.Time
+	now    func() time.Time
+
+	mu  sync.Mutex
+	rec Record
+}
+
+func (x *Exchange) offset() int64 {
+	return x.now().Sub(x.start).Milliseconds()
+}
+
+// SetKey records the ID of the API key the request was authenticated
+// with.
+func (x *Exchange) SetKey(id string) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.rec.Key = id
+}
+
+// VertexRequest records the request sent to Vertex AI for vertexModel,
+// with body as marshaled by the client.
+func (x *Exchange) VertexRequest(vertexModel string, stream bool, body []byte) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.rec.Vertex = &VertexRequest{
+		Model:    vertexModel,
+		Stream:   stream,
+		Hash:     RequestHash(vertexModel, stream, body),
+		OffsetMS: x.offset(),
+		Body:     x.redact.JSON(body),
+	}
+}
+
+// RequestHash identifies a request to Vertex AI regardless of the backend
+// it was sent to and of how its JSON is laid out: it is the SHA-256 of the
+// model ID, whether it streams, and the body with its object keys sorted
+// and without spaces.
+func RequestHash(vertexModel string, stream bool, body []byte) string {
+	normalized := body
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if decoder.Decode(&value) == nil {
+		if sorted, err := json.Marshal(value); err == nil {
+			normalized = sorted
+		}
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%t\n", vertexModel, stream)
+	h.Write(normalized)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Attempt records the start of a request to backend at url, and returns
+// the handle to record how it went.
+func (x *Exchange) Attempt(backend, url string) *AttemptRecorder {
+	if x == nil {
+		return nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.rec.Attempts = append(x.rec.Attempts, Attempt{Backend: backend, URL: url, OffsetMS: x.offset()})
+	return &AttemptRecorder{x: x, i: len(x.rec.Attempts) - 1}
+}
+
+// record returns the record so far.
+func (x *Exchange) record() Record {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	rec := x.rec
+	rec.Attempts = append([]Attempt(nil), x.rec.Attempts...)
+	return rec
+}
+
+// AttemptRecorder records the outcome of one attempt. Its methods do
+// nothing on a nil AttemptRecorder.
+type AttemptRecorder struct {
+	x *Exchange
+	i int
+}
+
+func (a *AttemptRecorder) update(fn func(*Attempt)) {
+	a.x.mu.Lock()
+	defer a.x.mu.Unlock()
+	fn(&a.x.rec.Attempts[a.i])
+}
+
+// Fail records an attempt that got no response.
+func (a *AttemptRecorder) Fail(err error) {
+	if a == nil {
+		return
+	}
+	a.update(func(at *Attempt) {
+		at.DoneMS = a.x.offset()
+		at.Error = err.Error()
+	})
+}
+
+// Rejected records an attempt that Vertex AI answered with an error status
+// and body.
+func (a *AttemptRecorder) Rejected(status int, body []byte) {
+	if a == nil {
+		return
+	}
+	a.update(func(at *Attempt) {
+		at.HeadersMS = a.x.offset()
+		at.DoneMS = at.HeadersMS
+		at.Status = status
+		at.Body = a.x.redact.JSON(body)
+	})
+}
+
+// Response records a successful attempt and returns body wrapped so that
+// the response is recorded as it is read: as events if it is a stream,
+// otherwise whole.
+func (a *AttemptRecorder) Response(body io.ReadCloser, stream bool) io.ReadCloser {
+	if a == nil {
+		return body
+	}
+	a.update(func(at *Attempt) {
+		at.HeadersMS = a.x.offset()
+		at.Status = http.StatusOK
+	})
+	return &recordingBody{ReadCloser: body, a: a, stream: stream}
+}
+
+// recordingBody records a response body as the caller reads it. Stream
+// events are recorded when the blank line ending them arrives, so their
+// offsets keep the timing of the original stream.
+type recordingBody struct {
+	io.ReadCloser
+	a      *AttemptRecorder
+	stream bool
+
+	buf    []byte
+	closed bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.buf = append(b.buf, p[:n]...)
+		if b.stream {
+			b.flushEvents(false)
+		}
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.closed {
+		return err
+	}
+	b.closed = true
+	if b.stream {
+		b.flushEvents(true)
+	}
+	b.a.update(func(at *Attempt) {
+		at.DoneMS = b.a.x.offset()
+		if !b.stream && len(b.buf) > 0 {
+			at.Body = b.a.x.redact.JSON(b.buf)
+		}
+	})
+	return err
+}
+
+// flushEvents records the complete events in buf, and with all set
+// whatever is left as well.
+func (b *recordingBody) flushEvents(all bool) {
+	for len(b.buf) > 0 {
+		end := frameEnd(b.buf)
+		if end < 0 {
+			if !all {
+				return
+			}
+			end = len(b.buf)
+		}
+		frame := string(b.buf[:end])
+		b.buf = b.buf[end:]
+
+		ev, err := sse.NewReader(strings.NewReader(frame)).Next()
+		if err != nil || ev.IsComment() {
+			continue
+		}
+		b.a.update(func(at *Attempt) {
+			at.Events = append(at.Events, Event{OffsetMS: b.a.x.offset(), Event: ev.Event, Data: b.a.x.redact.JSON([]byte(ev.Data))})
+		})
+	}
+}
+
+// frameEnd returns the length of the first event in buf including the
+// blank line that ends it, or -1 if it is not complete.
+func frameEnd(buf []byte) int {
+	for i := 0; i < len(buf)-1; i++ {
+		if buf[i] != '\n' {
+			continue
+		}
+		if buf[i+1] == '\n' {
+			return i + 2
+		}
+		if buf[i+1] == '\r' && i+2 < len(buf) && buf[i+2] == '\n' {
+			return i + 3
+		}
+	}
+	return -1
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying x.
+func NewContext(ctx context.Context, x *Exchange) context.Context {
+	return context.WithValue(ctx, contextKey{}, x)
+}
+
+// FromContext returns the Exchange in ctx, or nil if the request is not
+// captured.
+func FromContext(ctx context.Context) *Exchange {
+	x, _ := ctx.Value(contextKey{}).(*Exchange)
+	return x
+}
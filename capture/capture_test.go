@@ -0,0 +1,263 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSink returns a sink capturing every request to a file in a
+// temporary directory, whose clock is *now.
+func newTestSink(t *testing.T, opts Options) (*Sink, *time.Time) {
+	t.Helper()
+	if opts.SampleRate == 0 {
+		opts.SampleRate = 1
+	}
+	s, err := Open(filepath.Join(t.TempDir(), "requests.jsonl"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	s.opened = now
+	return s, &now
+}
+
+func readRecords(t *testing.T, path string) []Record {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// chunkedReader returns one chunk per Read, advancing the clock before
+// each.
+type chunkedReader struct {
+	chunks []string
+	now    *time.Time
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	*r.now = r.now.Add(10 * time.Millisecond)
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func (r *chunkedReader) Close() error { return nil }
+
+func TestExchange(t *testing.T) {
+	s, now := newTestSink(t, Options{})
+
+	req := httptest.NewRequest("POST", "/v1/messages", nil)
+	req.Header.Set("x-api-key", "sk-secret")
+	req.Header.Set("Content-Type", "application/json")
+	x := s.Start(req, []byte(`{"model": "claude-3-5-sonnet", "stream": true}`))
+	x.SetKey("ci")
+
+	*now = now.Add(5 * time.Millisecond)
+	x.VertexRequest("claude-3-5-sonnet@20240620", true, []byte(`{"anthropic_version":"vertex-2023-10-16","stream":true}`))
+
+	x.Attempt("proj/us-east5", "https://us-east5/streamRawPredict").Rejected(429, []byte(`{"error":{"code":429}}`))
+	x.Attempt("proj/europe-west1", "https://europe-west1/streamRawPredict").Fail(errors.New("connection refused"))
+
+	// Events split across reads are recorded when they are complete
+	body := x.Attempt("proj/us-central1", "https://us-central1/streamRawPredict").Response(&chunkedReader{now: now, chunks: []string{
+		"event: message_start\ndata: {\"type\":\"message_start\"}\n\nevent: content_block_delta\n",
+		"data: {\"type\":\"content_block_delta\",\"delta\":{\"text\":\"Hi\"}}\n\n",
+		"event: message_stop\ndata: {\"type\":\"message_stop\"}",
+	}}, true)
+	if _, err := io.ReadAll(body); err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+
+	if err := s.Finish(x, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readRecords(t, s.path)
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	rec := records[0]
+	if rec.Key != "ci" || rec.Status != 200 || rec.DurationMS != 35 || rec.Request.Path != "/v1/messages" {
+		t.Errorf("record = %+v", rec)
+	}
+	if got := rec.Request.Headers["X-Api-Key"]; !strings.HasPrefix(got, "sha256:") {
+		t.Errorf("x-api-key header = %q, want a fingerprint", got)
+	}
+	if got, want := string(rec.Request.Body), `{"model":"claude-3-5-sonnet","stream":true}`; got != want {
+		t.Errorf("request body = %s, want %s", got, want)
+	}
+	if rec.Vertex == nil || rec.Vertex.Model != "claude-3-5-sonnet@20240620" || !rec.Vertex.Stream || rec.Vertex.OffsetMS != 5 {
+		t.Errorf("vertex request = %+v", rec.Vertex)
+	}
+
+	if len(rec.Attempts) != 3 {
+		t.Fatalf("attempts = %+v", rec.Attempts)
+	}
+	if a := rec.Attempts[0]; a.Status != 429 || string(a.Body) != `{"error":{"code":429}}` {
+		t.Errorf("rejected attempt = %+v", a)
+	}
+	if a := rec.Attempts[1]; a.Error != "connection refused" || a.Status != 0 {
+		t.Errorf("failed attempt = %+v", a)
+	}
+	a := rec.Attempts[2]
+	if a.Status != 200 || a.HeadersMS != 5 || a.DoneMS != 35 {
+		t.Errorf("streamed attempt = %+v", a)
+	}
+	wantEvents := []Event{
+		{OffsetMS: 15, Event: "message_start", Data: json.RawMessage(`{"type":"message_start"}`)},
+		{OffsetMS: 25, Event: "content_block_delta", Data: json.RawMessage(`{"type":"content_block_delta","delta":{"text":"Hi"}}`)},
+		{OffsetMS: 35, Event: "message_stop", Data: json.RawMessage(`{"type":"message_stop"}`)},
+	}
+	if len(a.Events) != len(wantEvents) {
+		t.Fatalf("events = %+v", a.Events)
+	}
+	for i, ev := range a.Events {
+		want := wantEvents[i]
+		if ev.OffsetMS != want.OffsetMS || ev.Event != want.Event || string(ev.Data) != string(want.Data) {
+			t.Errorf("event %d = %+v, want %+v", i, ev, want)
+		}
+	}
+}
+
+func TestExchangeBody(t *testing.T) {
+	s, now := newTestSink(t, Options{})
+	x := s.Start(httptest.NewRequest("POST", "/v1/chat/completions", nil), []byte("not json"))
+	body := x.Attempt("proj/us-east5", "https://us-east5/rawPredict").Response(&chunkedReader{now: now, chunks: []string{
+		`{"id":"msg_01",`, `"content":[]}`,
+	}}, false)
+	io.ReadAll(body)
+	body.Close()
+	if err := s.Finish(x, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := readRecords(t, s.path)[0]
+	if got := string(rec.Request.Body); got != `"not json"` {
+		t.Errorf("request body = %s, want a string", got)
+	}
+	if got := string(rec.Attempts[0].Body); got != `{"id":"msg_01","content":[]}` {
+		t.Errorf("response body = %s", got)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	r := ParseRedaction(" text, data ,")
+	if len(r.Fields) != 2 {
+		t.Fatalf("fields = %v", r.Fields)
+	}
+
+	body := `{"model":"claude","max_tokens":1024,"messages":[{"role":"user","content":[{"type":"text","text":"secret"},{"type":"image","source":{"data":"aGVsbG8="}}]}]}`
+	want := `{"max_tokens":1024,"messages":[{"content":[{"text":"[REDACTED]","type":"text"},{"source":{"data":"[REDACTED]"},"type":"image"}],"role":"user"}],"model":"claude"}`
+	if got := string(r.JSON([]byte(body))); got != want {
+		t.Errorf("JSON() = %s, want %s", got, want)
+	}
+	if got := string(r.JSON([]byte("plain text"))); got != `"[REDACTED]"` {
+		t.Errorf("JSON(non-JSON) = %s", got)
+	}
+	if got := r.JSON(nil); got != nil {
+		t.Errorf("JSON(nil) = %s, want nil", got)
+	}
+}
+
+func TestSample(t *testing.T) {
+	s, _ := newTestSink(t, Options{SampleRate: 0.25})
+	next := 0.0
+	s.sample = func() float64 { return next }
+
+	for value, want := range map[float64]bool{0: true, 0.2: true, 0.25: false, 0.9: false} {
+		next = value
+		if got := s.Sample(); got != want {
+			t.Errorf("Sample() with %v = %v, want %v", value, got, want)
+		}
+	}
+
+	var nilSink *Sink
+	if nilSink.Sample() || nilSink.Start(httptest.NewRequest("GET", "/", nil), nil) != nil {
+		t.Error("a nil Sink captured a request")
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "requests.jsonl"), Options{SampleRate: 2}); err == nil {
+		t.Error("Open() accepted a sample rate of 2")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	s, now := newTestSink(t, Options{MaxBytes: 400, RotateEvery: time.Hour, MaxFiles: 2})
+	finish := func() {
+		t.Helper()
+		x := s.Start(httptest.NewRequest("POST", "/v1/messages", nil), []byte(`{"model":"claude-3-5-sonnet"}`))
+		if err := s.Finish(x, 200); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := filepath.Dir(s.path)
+	files := func() []string {
+		t.Helper()
+		matches, err := filepath.Glob(filepath.Join(dir, "requests*.jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return matches
+	}
+
+	// Records are about 200 bytes, so the third goes to a new file
+	finish()
+	finish()
+	if got := files(); len(got) != 1 {
+		t.Fatalf("files = %v, want only the current one", got)
+	}
+	finish()
+	rotated := filepath.Join(dir, "requests-20240701T120000Z.jsonl")
+	if got := files(); len(got) != 2 || len(readRecords(t, rotated)) != 2 || len(readRecords(t, s.path)) != 1 {
+		t.Fatalf("after the size limit: files = %v", got)
+	}
+
+	// After an hour the next record starts a new file too
+	*now = now.Add(time.Hour)
+	finish()
+	if got := files(); len(got) != 3 || len(readRecords(t, s.path)) != 1 {
+		t.Errorf("after an hour: files = %v", got)
+	}
+
+	// Beyond MaxFiles the oldest rotated file is deleted, and files the
+	// sink did not write are left alone
+	notes := filepath.Join(dir, "requests-notes.jsonl")
+	if err := os.WriteFile(notes, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	*now = now.Add(time.Hour)
+	finish()
+	if _, err := os.Stat(rotated); !os.IsNotExist(err) {
+		t.Errorf("oldest rotated file was kept: %v", err)
+	}
+	if got := files(); len(got) != 4 {
+		t.Errorf("after pruning: files = %v, want 2 rotated, the current one and the notes", got)
+	}
+}
@@ -0,0 +1,115 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"vertexai-anthropic-proxy/redact"
+)
+
+// Redacted replaces the values of redacted fields.
+const Redacted = "[REDACTED]"
+
+// secretHeaders are always replaced by their fingerprint.
+var secretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"X-Api-Key":           true,
+	"X-Goog-Api-Key":      true,
+	"Cookie":              true,
+}
+
+// Redaction lists the JSON fields whose values are left out of captures,
+// wherever they appear in request and response bodies and stream events.
+// For example "text" removes prompts and completions, and "data" base64
+// images.
+type Redaction struct {
+	Fields map[string]bool
+}
+
+// ParseRedaction reads a comma-separated list of field names such as
+// "system,text".
+func ParseRedaction(s string) Redaction {
+	r := Redaction{Fields: make(map[string]bool)}
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			r.Fields[field] = true
+		}
+	}
+	return r
+}
+
+// Headers returns the first value of each header, with secrets replaced by
+// their fingerprint.
+func (r Redaction) Headers(h http.Header) map[string]string {
+	if len(h) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(h))
+	for name, values := range h {
+		if len(values) == 0 {
+			continue
+		}
+		value := values[0]
+		if secretHeaders[http.CanonicalHeaderKey(name)] {
+			value = redact.Fingerprint(strings.TrimPrefix(value, "Bearer "))
+		}
+		headers[name] = value
+	}
+	return headers
+}
+
+// JSON returns body, compacted and with the redacted fields replaced. A
+// body that is not JSON is returned as a JSON string, redacted entirely if
+// any fields are redacted, since they cannot be found in it.
+func (r Redaction) JSON(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if !json.Valid(body) {
+		if len(r.Fields) > 0 {
+			body = []byte(Redacted)
+		}
+		s, _ := json.Marshal(string(body))
+		return s
+	}
+	if len(r.Fields) == 0 {
+		var b bytes.Buffer
+		json.Compact(&b, body)
+		return b.Bytes()
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		s, _ := json.Marshal(Redacted)
+		return s
+	}
+	redacted, err := json.Marshal(r.value(value))
+	if err != nil {
+		s, _ := json.Marshal(Redacted)
+		return s
+	}
+	return redacted
+}
+
+func (r Redaction) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			if r.Fields[name] {
+				v[name] = Redacted
+			} else {
+				v[name] = r.value(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = r.value(item)
+		}
+	}
+	return v
+}
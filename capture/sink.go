@@ -0,0 +1,261 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"vertexai-anthropic-proxy/config"
+	"vertexai-anthropic-proxy/utils"
+)
+
+// Options control what a Sink captures and when it starts a new file.
+type Options struct {
+	// SampleRate is the share of requests captured, between 0 and 1
+	SampleRate float64
+	// MaxBytes starts a new file once the current one would grow past
+	// it; 0 never does
+	MaxBytes int64
+	// RotateEvery starts a new file once the current one has been open
+	// that long; 0 never does
+	RotateEvery time.Duration
+	// MaxFiles is how many rotated files are kept; older ones are deleted
+	// on rotation. 0 keeps them all
+	MaxFiles  int
+	Redaction Redaction
+}
+
+// Sink appends captured exchanges to a JSONL file. A nil *Sink captures
+// nothing.
+type Sink struct {
+	path   string
+	opts   Options
+	now    func() time.Time
+	sample func() float64
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// Open opens or creates the capture file at path. Files rotated out are
+// renamed with the time they were rotated, e.g. requests.jsonl becomes
+// requests-20240701T120000Z.jsonl, and the newest MaxFiles of them kept.
+func Open(path string, opts Options) (*Sink, error) {
+	if opts.SampleRate < 0 || opts.SampleRate > 1 {
+		return nil, fmt.Errorf("capture sample rate %v is not between 0 and 1", opts.SampleRate)
+	}
+	if opts.MaxBytes < 0 || opts.RotateEvery < 0 || opts.MaxFiles < 0 {
+		return nil, fmt.Errorf("capture rotation limits must not be negative")
+	}
+	s := &Sink{path: path, opts: opts, now: time.Now, sample: rand.Float64}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// FromConfig opens the capture file named by CAPTURE_FILE. Without
+// CAPTURE_FILE it returns nil, and nothing is captured.
+func FromConfig(cfg *config.Config) (*Sink, error) {
+	if cfg.CaptureFile == "" {
+		return nil, nil
+	}
+	return Open(cfg.CaptureFile, Options{
+		SampleRate:  cfg.CaptureSampleRate,
+		MaxBytes:    cfg.CaptureMaxBytes,
+		RotateEvery: cfg.CaptureRotateEvery,
+		MaxFiles:    cfg.CaptureMaxFiles,
+		Redaction:   ParseRedaction(cfg.CaptureRedactFields),
+	})
+}
+
+func (s *Sink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.size, s.opened = f, info.Size(), s.now()
+	return nil
+}
+
+// Close closes the capture file.
+func (s *Sink) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// Sample decides whether to capture the next request.
+func (s *Sink) Sample() bool {
+	return s != nil && s.sample() < s.opts.SampleRate
+}
+
+// Start begins the capture of r, whose body has been read into body.
+func (s *Sink) Start(r *http.Request, body []byte) *Exchange {
+	if s == nil {
+		return nil
+	}
+	start := s.now()
+	return &Exchange{
+		redact: s.opts.Redaction,
+		start:  start,
+		now:    s.now,
+		rec: Record{
+			ID:   uuid.New().String(),
+			Time: start.UTC(),
+			Request: Request{
+				Method:  r.Method,
+				Path:    r.URL.Path,
+				Headers: s.opts.Redaction.Headers(r.Header),
+				Body:    s.opts.Redaction.JSON(body),
+			},
+		},
+	}
+}
+
+// Finish completes x with the status the proxy answered with and appends
+// it to the capture file.
+func (s *Sink) Finish(x *Exchange, status int) error {
+	if s == nil || x == nil {
+		return nil
+	}
+	rec := x.record()
+	rec.Status = status
+	rec.DurationMS = x.offset()
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.due(int64(len(line))) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// due reports whether the file must be rotated before writing n more
+// bytes. An empty file is never rotated.
+func (s *Sink) due(n int64) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.opts.MaxBytes > 0 && s.size+n > s.opts.MaxBytes {
+		return true
+	}
+	return s.opts.RotateEvery > 0 && s.now().Sub(s.opened) >= s.opts.RotateEvery
+}
+
+// rotatedLayout is the time format of rotated file names.
+const rotatedLayout = "20060102T150405Z"
+
+// rotate renames the current file out of the way and starts a new one.
+func (s *Sink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(s.path)
+	base := strings.TrimSuffix(s.path, ext)
+	stamp := s.now().UTC().Format(rotatedLayout)
+	rotated := fmt.Sprintf("%s-%s%s", base, stamp, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s-%s-%d%s", base, stamp, i, ext)
+	}
+	if err := os.Rename(s.path, rotated); err != nil {
+		// Keep appending to the current file rather than losing captures
+		if reopenErr := s.open(); reopenErr != nil {
+			return reopenErr
+		}
+		return err
+	}
+	if err := s.prune(); err != nil {
+		// Old captures are only left behind; the new file is fine
+		utils.GetLogger().Errorf("Error deleting old capture files: %v", err)
+	}
+	return s.open()
+}
+
+// prune deletes the oldest rotated files beyond MaxFiles.
+func (s *Sink) prune() error {
+	if s.opts.MaxFiles == 0 {
+		return nil
+	}
+	dir := filepath.Dir(s.path)
+	ext := filepath.Ext(s.path)
+	prefix := strings.TrimSuffix(filepath.Base(s.path), ext) + "-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	type rotatedFile struct {
+		name  string
+		stamp string
+		n     int
+	}
+	var files []rotatedFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		// Only files named by rotate: base-STAMP.ext or base-STAMP-N.ext
+		stamp, n, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext), "-")
+		if _, err := time.Parse(rotatedLayout, stamp); err != nil {
+			continue
+		}
+		f := rotatedFile{name: name, stamp: stamp}
+		if n != "" {
+			if f.n, err = strconv.Atoi(n); err != nil {
+				continue
+			}
+		}
+		files = append(files, f)
+	}
+	if len(files) <= s.opts.MaxFiles {
+		return nil
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].stamp != files[j].stamp {
+			return files[i].stamp < files[j].stamp
+		}
+		return files[i].n < files[j].n
+	})
+	for _, f := range files[:len(files)-s.opts.MaxFiles] {
+		if err := os.Remove(filepath.Join(dir, f.name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package client
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"vertexai-anthropic-proxy/config"
+	"vertexai-anthropic-proxy/utils"
+)
+
+// ErrCircuitOpen is returned without contacting Vertex AI when the circuit
+// breaker of every backend for the model is open.
+var ErrCircuitOpen = errors.New("circuit breaker open for every backend")
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// BreakerPolicy controls the circuit breaker kept for each backend and
+// model. A closed breaker counts requests in a window of Window; once at
+// least MinRequests have been made and FailureRate of them failed, it opens
+// and requests skip the backend for OpenDuration. It then lets Probes
+// requests through (half-open): if they all succeed it closes again, and
+// if any fails it opens for another OpenDuration.
+type BreakerPolicy struct {
+	FailureRate  float64
+	MinRequests  int
+	Window       time.Duration
+	OpenDuration time.Duration
+	Probes       int
+}
+
+// DefaultBreakerPolicy is used for any setting left at zero.
+var DefaultBreakerPolicy = BreakerPolicy{
+	FailureRate:  0.5,
+	MinRequests:  10,
+	Window:       time.Minute,
+	OpenDuration: 30 * time.Second,
+	Probes:       1,
+}
+
+// BreakerPolicyFromConfig returns the policy configured in cfg.
+func BreakerPolicyFromConfig(cfg *config.Config) BreakerPolicy {
+	return BreakerPolicy{
+		FailureRate:  cfg.BreakerFailureRate,
+		MinRequests:  cfg.BreakerMinRequests,
+		Window:       cfg.BreakerWindow,
+		OpenDuration: cfg.BreakerOpenDuration,
+		Probes:       cfg.BreakerProbes,
+	}.withDefaults()
+}
+
+func (p BreakerPolicy) withDefaults() BreakerPolicy {
+	if p.FailureRate <= 0 {
+		p.FailureRate = DefaultBreakerPolicy.FailureRate
+	}
+	if p.MinRequests <= 0 {
+		p.MinRequests = DefaultBreakerPolicy.MinRequests
+	}
+	if p.Window <= 0 {
+		p.Window = DefaultBreakerPolicy.Window
+	}
+	if p.OpenDuration <= 0 {
+		p.OpenDuration = DefaultBreakerPolicy.OpenDuration
+	}
+	if p.Probes <= 0 {
+		p.Probes = DefaultBreakerPolicy.Probes
+	}
+	return p
+}
+
+// BreakerState describes one circuit breaker, for the admin endpoint.
+type BreakerState struct {
+	Backend string `json:"backend"`
+	Project string `json:"project"`
+	Region  string `json:"region"`
+	Model   string `json:"model"`
+	State   string `json:"state"`
+	// Requests and Failures are counted in the current window while the
+	// breaker is closed
+	Requests int `json:"requests"`
+	Failures int `json:"failures"`
+	// OpenedAt and RetryAt are set while the breaker is open or half-open
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+	RetryAt  *time.Time `json:"retry_at,omitempty"`
+}
+
+// breakers holds a circuit breaker for every backend and model that has
+// been used.
+type breakers struct {
+	mu     sync.Mutex
+	policy BreakerPolicy
+	m      map[backendModel]*circuitBreaker
+	now    func() time.Time
+}
+
+func newBreakers(policy BreakerPolicy) *breakers {
+	return &breakers{policy: policy, m: make(map[backendModel]*circuitBreaker), now: time.Now}
+}
+
+func (bs *breakers) get(b *backend, model string) *circuitBreaker {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	key := backendModel{b.id, model}
+	cb, ok := bs.m[key]
+	if !ok {
+		cb = &circuitBreaker{
+			policy:  bs.policy,
+			now:     bs.now,
+			state:   BreakerClosed,
+			backend: b,
+			model:   model,
+		}
+		bs.m[key] = cb
+	}
+	return cb
+}
+
+// states returns a snapshot of every breaker, sorted by backend and model.
+func (bs *breakers) states() []BreakerState {
+	bs.mu.Lock()
+	all := make([]*circuitBreaker, 0, len(bs.m))
+	for _, cb := range bs.m {
+		all = append(all, cb)
+	}
+	bs.mu.Unlock()
+
+	states := make([]BreakerState, 0, len(all))
+	for _, cb := range all {
+		states = append(states, cb.snapshot())
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Backend != states[j].Backend {
+			return states[i].Backend < states[j].Backend
+		}
+		return states[i].Model < states[j].Model
+	})
+	return states
+}
+
+type circuitBreaker struct {
+	mu      sync.Mutex
+	policy  BreakerPolicy
+	now     func() time.Time
+	backend *backend
+	model   string
+
+	state       string
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	// probes are half-open requests still in progress; successes are the
+	// probes that succeeded
+	probes    int
+	successes int
+}
+
+// allow reports whether a request may be sent. An open breaker turns
+// half-open once OpenDuration has passed; a half-open breaker admits up to
+// Probes requests at a time. Every allowed request must be followed by
+// record or release.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		if cb.now().Before(cb.openedAt.Add(cb.policy.OpenDuration)) {
+			return false
+		}
+		cb.state = BreakerHalfOpen
+		cb.probes = 0
+		cb.successes = 0
+		utils.GetLogger().Infof("Circuit breaker for %s %s is half-open", cb.backend.id, cb.model)
+	}
+	if cb.probes >= cb.policy.Probes {
+		return false
+	}
+	cb.probes++
+	return true
+}
+
+// record counts the outcome of an allowed request.
+func (cb *circuitBreaker) record(failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := cb.now()
+	switch cb.state {
+	case BreakerClosed:
+		if now.Sub(cb.windowStart) >= cb.policy.Window {
+			cb.windowStart = now
+			cb.requests = 0
+			cb.failures = 0
+		}
+		cb.requests++
+		if failed {
+			cb.failures++
+		}
+		if cb.requests >= cb.policy.MinRequests && float64(cb.failures) >= cb.policy.FailureRate*float64(cb.requests) {
+			cb.open(now)
+		}
+	case BreakerHalfOpen:
+		if cb.probes > 0 {
+			cb.probes--
+		}
+		if failed {
+			cb.open(now)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.policy.Probes {
+			cb.state = BreakerClosed
+			cb.windowStart = now
+			cb.requests = 0
+			cb.failures = 0
+			utils.GetLogger().Infof("Circuit breaker for %s %s closed", cb.backend.id, cb.model)
+		}
+	}
+}
+
+// release gives back an allowed request that ended without telling
+// whether the backend is healthy, e.g. because the caller went away.
+func (cb *circuitBreaker) release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == BreakerHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+func (cb *circuitBreaker) open(now time.Time) {
+	cb.state = BreakerOpen
+	cb.openedAt = now
+	utils.GetLogger().Warnf("Circuit breaker for %s %s opened after %d failures in %d requests", cb.backend.id, cb.model, cb.failures, cb.requests)
+}
+
+func (cb *circuitBreaker) snapshot() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	s := BreakerState{
+		Backend:  cb.backend.id,
+		Project:  cb.backend.project,
+		Region:   cb.backend.region,
+		Model:    cb.model,
+		State:    cb.state,
+		Requests: cb.requests,
+		Failures: cb.failures,
+	}
+	if cb.state != BreakerClosed {
+		openedAt := cb.openedAt
+		retryAt := openedAt.Add(cb.policy.OpenDuration)
+		s.OpenedAt = &openedAt
+		s.RetryAt = &retryAt
+	}
+	return s
+}
+
+// CircuitBreakers returns the state of the circuit breaker of every backend
+// and model that has been used.
+func (c *VertexClient) CircuitBreakers() []BreakerState {
+	return c.breakers.states()
+}
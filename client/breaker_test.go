@@ -0,0 +1,170 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vertexai-anthropic-proxy/translation"
+)
+
+func newTestBreaker(policy BreakerPolicy) (*circuitBreaker, *time.Time) {
+	now := time.Now()
+	bs := newBreakers(policy.withDefaults())
+	bs.now = func() time.Time { return now }
+	return bs.get(&backend{id: "p/us-east5", project: "p", region: "us-east5"}, "m"), &now
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	cb, now := newTestBreaker(BreakerPolicy{FailureRate: 0.5, MinRequests: 4, OpenDuration: 10 * time.Second, Probes: 1})
+
+	// Too few requests to judge
+	for i := 0; i < 3; i++ {
+		cb.allow()
+		cb.record(true)
+	}
+	if cb.state != BreakerClosed {
+		t.Fatalf("state after 3 failures = %s, want closed below MinRequests", cb.state)
+	}
+	cb.allow()
+	cb.record(false)
+	if cb.state != BreakerOpen {
+		t.Fatalf("state at 3 of 4 failed = %s, want open", cb.state)
+	}
+	if cb.allow() {
+		t.Error("open breaker allowed a request")
+	}
+
+	// Half-open admits one probe at a time
+	*now = now.Add(10 * time.Second)
+	if !cb.allow() {
+		t.Fatal("breaker did not admit a probe after OpenDuration")
+	}
+	if cb.allow() {
+		t.Error("half-open breaker admitted a second probe")
+	}
+	cb.record(true)
+	if cb.state != BreakerOpen {
+		t.Fatalf("state after failed probe = %s, want open", cb.state)
+	}
+
+	*now = now.Add(10 * time.Second)
+	cb.allow()
+	cb.release()
+	if !cb.allow() {
+		t.Fatal("released probe was not given back")
+	}
+	cb.record(false)
+	if cb.state != BreakerClosed || cb.requests != 0 {
+		t.Errorf("state after successful probe = %s with %d requests, want closed and reset", cb.state, cb.requests)
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	cb, now := newTestBreaker(BreakerPolicy{FailureRate: 0.5, MinRequests: 2, Window: time.Minute})
+
+	cb.allow()
+	cb.record(true)
+	*now = now.Add(time.Minute)
+	cb.allow()
+	cb.record(true)
+	if cb.state != BreakerClosed {
+		t.Errorf("failures in different windows opened the breaker")
+	}
+}
+
+func TestCircuitBreakerFailover(t *testing.T) {
+	server := newRegionServer(t)
+	c := newRegionClient(t, server, "us-east5", "europe-west1")
+	c.breakers.policy = BreakerPolicy{FailureRate: 0.5, MinRequests: 1, OpenDuration: time.Minute, Probes: 1}.withDefaults()
+	// Without the cooldown a failed region would be tried first again
+	c.health.cooldown = time.Nanosecond
+
+	server.statuses["us-east5"] = 503
+	if err := sendOnce(c); err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	server.takeCalls()
+
+	// us-east5's breaker is open, so it is not tried at all
+	time.Sleep(time.Millisecond)
+	if err := sendOnce(c); err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	if calls := server.takeCalls(); calls != "europe-west1" {
+		t.Errorf("calls = %s, want open backend skipped", calls)
+	}
+
+	states := c.CircuitBreakers()
+	if len(states) != 2 || states[0].Region != "europe-west1" || states[1].State != BreakerOpen || states[1].RetryAt == nil {
+		t.Errorf("CircuitBreakers() = %+v", states)
+	}
+}
+
+func TestCircuitBreakerFastFail(t *testing.T) {
+	server := newRegionServer(t)
+	c := newRegionClient(t, server, "us-east5")
+	c.retry.MaxAttempts = 3
+	c.breakers.policy = BreakerPolicy{FailureRate: 0.5, MinRequests: 1, OpenDuration: time.Minute, Probes: 1}.withDefaults()
+
+	server.statuses["us-east5"] = http.StatusServiceUnavailable
+	if err := sendOnce(c); err == nil {
+		t.Fatal("SendToVertexAI() error = nil, want 503")
+	}
+	if calls := server.takeCalls(); calls != "us-east5" {
+		t.Errorf("calls = %s, want the breaker to stop the retries", calls)
+	}
+
+	start := time.Now()
+	if err := sendOnce(c); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("SendToVertexAI() error = %v, want ErrCircuitOpen", err)
+	}
+	if calls := server.takeCalls(); calls != "" || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("calls = %q in %v, want an immediate failure", calls, time.Since(start))
+	}
+}
+
+func TestCircuitBreakerStreamError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n")
+	}))
+	defer server.Close()
+	c := newTestClient(t, server, &countingTokenSource{})
+	c.retry.MaxAttempts = 1
+	stream := func() {
+		t.Helper()
+		events := make(chan translation.StreamEvent)
+		go func() {
+			for range events {
+			}
+		}()
+		if err := c.SendToVertexAIStream(context.Background(), testRoute, &translation.VertexAIRequest{Stream: true}, events); err != nil {
+			t.Fatalf("SendToVertexAIStream() error = %v", err)
+		}
+	}
+
+	// A 200 whose stream starts with an error is one failed request
+	stream()
+	if len(c.breakers.m) != 1 {
+		t.Fatalf("got %d breakers, want 1", len(c.breakers.m))
+	}
+	var cb *circuitBreaker
+	for _, cb = range c.breakers.m {
+	}
+	if cb.requests != 1 || cb.failures != 1 {
+		t.Errorf("breaker counted %d failures in %d requests, want 1 in 1", cb.failures, cb.requests)
+	}
+
+	// and a failed probe, which opens the breaker again
+	cb.state = BreakerOpen
+	cb.openedAt = time.Now().Add(-time.Hour)
+	stream()
+	if cb.state != BreakerOpen || time.Since(cb.openedAt) > time.Minute {
+		t.Errorf("state after a probe failing with an error event = %s, want open", cb.state)
+	}
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// TokenSourceFunc creates the token source used to authenticate with Vertex
+// AI from a credentials file, or from Application Default Credentials if
+// credentialsFile is empty. It is called once per credentials file when the
+// file is first used and again whenever credentials are refreshed.
+type TokenSourceFunc func(ctx context.Context, credentialsFile string) (oauth2.TokenSource, error)
+
+// DefaultTokenSource reads a service account key or other Google
+// credentials file, or uses Application Default Credentials.
+func DefaultTokenSource(ctx context.Context, credentialsFile string) (oauth2.TokenSource, error) {
+	if credentialsFile == "" {
+		credentials, err := google.FindDefaultCredentials(ctx, cloudPlatformScope)
+		if err != nil {
+			return nil, err
+		}
+		return credentials.TokenSource, nil
+	}
+
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := google.CredentialsFromJSON(ctx, data, cloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.TokenSource, nil
+}
+
+// replayTokenSource stands in for credentials when replaying recordings,
+// which are not sent anywhere.
+func replayTokenSource(ctx context.Context, credentialsFile string) (oauth2.TokenSource, error) {
+	return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "replay", TokenType: "Bearer"}), nil
+}
+
+// refreshableTokenSource caches the current token until it expires and lets
+// the underlying source be replaced, so a refresh picks up rotated
+// credentials without rebuilding the HTTP client.
+type refreshableTokenSource struct {
+	mu    sync.Mutex
+	src   oauth2.TokenSource
+	token *oauth2.Token
+}
+
+func (s *refreshableTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token.Valid() {
+		return s.token, nil
+	}
+	token, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	return token, nil
+}
+
+// reset swaps in src and fetches a token from it straight away, so a broken
+// credential is reported to the caller rather than to the next request.
+func (s *refreshableTokenSource) reset(src oauth2.TokenSource) error {
+	token, err := src.Token()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src = src
+	s.token = token
+	return nil
+}
@@ -0,0 +1,19 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+// VertexError is returned when Vertex AI answers with a non-200 status. Body
+// holds the raw error payload so callers can surface the upstream message.
+type VertexError struct {
+	StatusCode int
+	Body       []byte
+	// RetryAfter is the delay requested by a Retry-After header, if any
+	RetryAfter time.Duration
+}
+
+func (e *VertexError) Error() string {
+	return fmt.Sprintf("Vertex AI returned non-OK status: %d, body: %s", e.StatusCode, string(e.Body))
+}
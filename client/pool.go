@@ -0,0 +1,264 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"vertexai-anthropic-proxy/config"
+)
+
+// credentials is an authenticated HTTP client for one credentials file,
+// shared by every backend that uses that file.
+type credentials struct {
+	tokens     *refreshableTokenSource
+	httpClient *http.Client
+}
+
+// backend is a Vertex AI project in a region, with the load it is carrying.
+type backend struct {
+	id       string
+	project  string
+	region   string
+	endpoint string
+	creds    *credentials
+	// inFlight counts requests sent and not yet finished, including open
+	// response bodies
+	inFlight atomic.Int64
+	quota    quotaWindow
+}
+
+// release marks one of the backend's requests as finished.
+func (b *backend) release() {
+	b.inFlight.Add(-1)
+}
+
+// pool holds every backend the client has sent to and picks the order in
+// which to try them for each request.
+type pool struct {
+	cfg            *config.Config
+	strategy       string
+	newTokenSource TokenSourceFunc
+	transport      http.RoundTripper
+	now            func() time.Time
+	// next is the round-robin position
+	next atomic.Uint64
+
+	mu       sync.Mutex
+	backends map[string]*backend
+	// creds is keyed by credentials file; "" is Application Default
+	// Credentials
+	creds map[string]*credentials
+}
+
+func newPool(ctx context.Context, cfg *config.Config, newTokenSource TokenSourceFunc, transport http.RoundTripper) (*pool, error) {
+	p := &pool{
+		cfg:            cfg,
+		strategy:       cfg.BackendStrategy,
+		newTokenSource: newTokenSource,
+		transport:      transport,
+		now:            time.Now,
+		backends:       make(map[string]*backend),
+		creds:          make(map[string]*credentials),
+	}
+	// Look up the credentials of the default backends now, so that missing
+	// credentials are reported at startup
+	for _, b := range cfg.BackendsFor(config.ModelRoute{}) {
+		if _, err := p.backend(ctx, b); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// backend returns the state kept for b, creating it on first use.
+func (p *pool) backend(ctx context.Context, b config.Backend) (*backend, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if existing, ok := p.backends[b.ID()]; ok {
+		return existing, nil
+	}
+
+	creds, ok := p.creds[b.CredentialsFile]
+	if !ok {
+		src, err := p.newTokenSource(ctx, b.CredentialsFile)
+		if err != nil {
+			return nil, credentialsError(b.CredentialsFile, err)
+		}
+		tokens := &refreshableTokenSource{src: src}
+		creds = &credentials{
+			tokens:     tokens,
+			httpClient: &http.Client{Transport: &oauth2.Transport{Source: tokens, Base: p.transport}},
+		}
+		p.creds[b.CredentialsFile] = creds
+	}
+
+	created := &backend{
+		id:       b.ID(),
+		project:  b.Project,
+		region:   b.Region,
+		endpoint: strings.TrimSuffix(p.cfg.BackendEndpoint(b), "/"),
+		creds:    creds,
+		quota:    quotaWindow{limit: b.QuotaRPM},
+	}
+	p.backends[created.id] = created
+	return created, nil
+}
+
+func credentialsError(file string, err error) error {
+	if file == "" {
+		return fmt.Errorf("finding credentials: %w", err)
+	}
+	return fmt.Errorf("loading credentials from %s: %w", file, err)
+}
+
+// order returns the backends to try for route, in the order chosen by the
+// load-balancing strategy.
+func (p *pool) order(ctx context.Context, route config.ModelRoute) ([]*backend, error) {
+	candidates := p.cfg.BackendsFor(route)
+	backends := make([]*backend, 0, len(candidates))
+	weights := make([]int, 0, len(candidates))
+	for _, c := range candidates {
+		b, err := p.backend(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, b)
+		weights = append(weights, c.Weight)
+	}
+	if len(backends) == 0 {
+		return nil, nil
+	}
+
+	switch p.strategy {
+	case config.StrategyRoundRobin:
+		start := int(p.next.Add(1)-1) % len(backends)
+		rotated := make([]*backend, 0, len(backends))
+		rotated = append(rotated, backends[start:]...)
+		backends = append(rotated, backends[:start]...)
+	case config.StrategyLeastInFlight:
+		sort.SliceStable(backends, func(i, j int) bool {
+			return backends[i].inFlight.Load() < backends[j].inFlight.Load()
+		})
+	case config.StrategyQuotaAware:
+		now := p.now()
+		remaining := make(map[*backend]float64, len(backends))
+		for _, b := range backends {
+			remaining[b] = b.quota.remaining(now)
+		}
+		sort.SliceStable(backends, func(i, j int) bool {
+			bi, bj := backends[i], backends[j]
+			if remaining[bi] != remaining[bj] {
+				return remaining[bi] > remaining[bj]
+			}
+			return bi.inFlight.Load() < bj.inFlight.Load()
+		})
+	default:
+		ordered := make([]*backend, 0, len(backends))
+		for _, i := range weightedOrder(weights) {
+			ordered = append(ordered, backends[i])
+		}
+		backends = ordered
+	}
+	return backends, nil
+}
+
+// refresh reloads every credentials file in use.
+func (p *pool) refresh(ctx context.Context) error {
+	p.mu.Lock()
+	creds := make(map[string]*credentials, len(p.creds))
+	for file, c := range p.creds {
+		creds[file] = c
+	}
+	p.mu.Unlock()
+
+	for file, creds := range creds {
+		src, err := p.newTokenSource(ctx, file)
+		if err != nil {
+			return credentialsError(file, err)
+		}
+		if err := creds.tokens.reset(src); err != nil {
+			if file == "" {
+				return fmt.Errorf("fetching token: %w", err)
+			}
+			return fmt.Errorf("fetching token for %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// quotaWindow counts the requests sent to a backend in the current minute,
+// to estimate how much of its requests-per-minute quota is left.
+type quotaWindow struct {
+	mu    sync.Mutex
+	limit int
+	start time.Time
+	used  int
+	// throttled is set when Vertex AI answered 429 this minute
+	throttled bool
+}
+
+func (q *quotaWindow) roll(now time.Time) {
+	if now.Sub(q.start) >= time.Minute {
+		q.start = now
+		q.used = 0
+		q.throttled = false
+	}
+}
+
+// take records a request.
+func (q *quotaWindow) take(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll(now)
+	q.used++
+}
+
+// exhaust records that Vertex AI throttled the backend, whatever the count
+// says, for the rest of the minute.
+func (q *quotaWindow) exhaust(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll(now)
+	q.throttled = true
+}
+
+// remaining returns the fraction of the quota left this minute. A backend
+// with no configured quota counts as having all of it left unless it was
+// throttled.
+func (q *quotaWindow) remaining(now time.Time) float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll(now)
+	switch {
+	case q.throttled:
+		return 0
+	case q.limit == 0:
+		return 1
+	case q.used >= q.limit:
+		return 0
+	}
+	return float64(q.limit-q.used) / float64(q.limit)
+}
+
+// onClose runs fn once when the body is closed.
+type onClose struct {
+	io.ReadCloser
+	once sync.Once
+	fn   func()
+}
+
+func (b *onClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.fn)
+	return err
+}
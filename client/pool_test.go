@@ -0,0 +1,190 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"vertexai-anthropic-proxy/config"
+	"vertexai-anthropic-proxy/translation"
+)
+
+// projectServer records the project of every request and the token it was
+// sent with.
+type projectServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	projects []string
+	tokens   map[string]string
+}
+
+func newProjectServer(t *testing.T) *projectServer {
+	s := &projectServer{tokens: map[string]string{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// /v1/projects/<project>/locations/<region>/...
+		parts := strings.Split(r.URL.Path, "/")
+		project := parts[3] + "/" + parts[5]
+
+		s.mu.Lock()
+		s.projects = append(s.projects, project)
+		s.tokens[project] = r.Header.Get("Authorization")
+		s.mu.Unlock()
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *projectServer) takeProjects() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	projects := strings.Join(s.projects, ",")
+	s.projects = nil
+	return projects
+}
+
+func newPoolClient(t *testing.T, server *projectServer, strategy string, backends ...config.Backend) (*VertexClient, *countingTokenSource) {
+	t.Helper()
+	for i := range backends {
+		backends[i].Endpoint = server.URL
+	}
+	cfg := &config.Config{
+		VertexAIProjectID: "default-project",
+		VertexAIRegion:    "us-east5",
+		Backends:          backends,
+		BackendStrategy:   strategy,
+		RetryMaxAttempts:  1,
+	}
+	tokens := &countingTokenSource{}
+	c, err := NewVertexClient(context.Background(), cfg, tokens.newTokenSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, tokens
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	server := newProjectServer(t)
+	c, _ := newPoolClient(t, server, config.StrategyRoundRobin,
+		config.Backend{Project: "a", Region: "us-east5"},
+		config.Backend{Project: "b", Region: "us-east5"},
+		config.Backend{Project: "c", Region: "europe-west1"},
+	)
+
+	for i := 0; i < 4; i++ {
+		if err := sendOnce(c); err != nil {
+			t.Fatalf("SendToVertexAI() error = %v", err)
+		}
+	}
+	if got, want := server.takeProjects(), "a/us-east5,b/us-east5,c/europe-west1,a/us-east5"; got != want {
+		t.Errorf("projects = %s, want %s", got, want)
+	}
+}
+
+func TestPoolLeastInFlight(t *testing.T) {
+	server := newProjectServer(t)
+	c, _ := newPoolClient(t, server, config.StrategyLeastInFlight,
+		config.Backend{Project: "a", Region: "us-east5"},
+		config.Backend{Project: "b", Region: "us-east5"},
+	)
+
+	// Holding the first response open keeps a busy
+	open, err := c.SendToVertexAI(context.Background(), testRoute, &translation.VertexAIRequest{})
+	if err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	if err := sendOnce(c); err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	if got := server.takeProjects(); got != "a/us-east5,b/us-east5" {
+		t.Errorf("projects while a is busy = %s", got)
+	}
+
+	io.Copy(io.Discard, open)
+	open.Close()
+	open.Close()
+	if err := sendOnce(c); err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	if got := server.takeProjects(); got != "a/us-east5" {
+		t.Errorf("projects once a is done = %s", got)
+	}
+}
+
+func TestPoolQuotaAware(t *testing.T) {
+	server := newProjectServer(t)
+	c, _ := newPoolClient(t, server, config.StrategyQuotaAware,
+		config.Backend{Project: "a", Region: "us-east5", QuotaRPM: 2},
+		config.Backend{Project: "b", Region: "us-east5", QuotaRPM: 4},
+	)
+	now := time.Now()
+	c.pool.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		if err := sendOnce(c); err != nil {
+			t.Fatalf("SendToVertexAI() error = %v", err)
+		}
+	}
+	// Each request goes to the backend with the largest share of its
+	// quota left; ties go to the first
+	if got, want := server.takeProjects(), "a/us-east5,b/us-east5,b/us-east5,a/us-east5,b/us-east5"; got != want {
+		t.Errorf("projects = %s, want %s", got, want)
+	}
+
+	// The window resets after a minute
+	now = now.Add(time.Minute)
+	if err := sendOnce(c); err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	if got := server.takeProjects(); got != "a/us-east5" {
+		t.Errorf("projects after a minute = %s", got)
+	}
+}
+
+func TestQuotaWindowThrottled(t *testing.T) {
+	now := time.Now()
+	q := quotaWindow{}
+	if got := q.remaining(now); got != 1 {
+		t.Errorf("remaining without quota = %v, want 1", got)
+	}
+	q.exhaust(now)
+	if got := q.remaining(now.Add(time.Second)); got != 0 {
+		t.Errorf("remaining after 429 = %v, want 0", got)
+	}
+	if got := q.remaining(now.Add(time.Minute)); got != 1 {
+		t.Errorf("remaining a minute after 429 = %v, want 1", got)
+	}
+}
+
+func TestPoolCredentials(t *testing.T) {
+	server := newProjectServer(t)
+	c, tokens := newPoolClient(t, server, config.StrategyRoundRobin,
+		config.Backend{Project: "a", Region: "us-east5", CredentialsFile: "a.json"},
+		config.Backend{Project: "b", Region: "us-east5", CredentialsFile: "b.json"},
+		config.Backend{Project: "a", Region: "europe-west1", CredentialsFile: "a.json"},
+	)
+	if tokens.sources != 2 {
+		t.Errorf("token sources = %d, want one per credentials file", tokens.sources)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := sendOnce(c); err != nil {
+			t.Fatalf("SendToVertexAI() error = %v", err)
+		}
+	}
+	if server.tokens["a/us-east5"] != server.tokens["a/europe-west1"] || server.tokens["a/us-east5"] == server.tokens["b/us-east5"] {
+		t.Errorf("tokens = %v, want one per credentials file", server.tokens)
+	}
+
+	if err := c.RefreshCredentials(context.Background()); err != nil {
+		t.Fatalf("RefreshCredentials() error = %v", err)
+	}
+	if tokens.sources != 4 {
+		t.Errorf("token sources after refresh = %d, want 4", tokens.sources)
+	}
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultRegionCooldown is how long a failing region is skipped when
+// VERTEX_REGION_COOLDOWN is not set.
+const DefaultRegionCooldown = 30 * time.Second
+
+// regionHealth remembers which backends (a project in a region) recently
+// failed for which model, so that later requests try them last until their
+// cooldown has passed.
+type regionHealth struct {
+	mu       sync.Mutex
+	cooldown time.Duration
+	// Keyed by backend ID and Vertex model ID; the value is when the
+	// backend may be tried first again
+	until map[backendModel]time.Time
+	now   func() time.Time
+}
+
+type backendModel struct {
+	backend string
+	model   string
+}
+
+func newRegionHealth(cooldown time.Duration) *regionHealth {
+	if cooldown <= 0 {
+		cooldown = DefaultRegionCooldown
+	}
+	return &regionHealth{cooldown: cooldown, until: make(map[backendModel]time.Time), now: time.Now}
+}
+
+func (h *regionHealth) markFailed(backend, model string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.until[backendModel{backend, model}] = h.now().Add(h.cooldown)
+}
+
+func (h *regionHealth) markHealthy(backend, model string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.until, backendModel{backend, model})
+}
+
+// sortHealthy moves backends that are cooling down for model to the end,
+// sorted by how soon they recover. Healthy backends keep the order the
+// load-balancing strategy chose, and a request is never refused just
+// because every backend failed recently.
+func (h *regionHealth) sortHealthy(model string, backends []*backend) {
+	h.mu.Lock()
+	now := h.now()
+	until := make(map[*backend]time.Time, len(backends))
+	for _, b := range backends {
+		if t, ok := h.until[backendModel{b.id, model}]; ok && t.After(now) {
+			until[b] = t
+		}
+	}
+	h.mu.Unlock()
+
+	sort.SliceStable(backends, func(i, j int) bool {
+		return until[backends[i]].Before(until[backends[j]])
+	})
+}
+
+// weightedOrder returns the indexes of weights in order, or, if any weight
+// is set, in a random order where each position is drawn with probability
+// proportional to weight. Entries with weight 0 in a weighted list are only
+// used as a last resort.
+func weightedOrder(weights []int) []int {
+	weighted := false
+	for _, w := range weights {
+		if w > 0 {
+			weighted = true
+			break
+		}
+	}
+
+	order := make([]int, 0, len(weights))
+	remaining := make([]int, 0, len(weights))
+	for i := range weights {
+		remaining = append(remaining, i)
+	}
+	if !weighted {
+		return remaining
+	}
+
+	for len(remaining) > 0 {
+		total := 0
+		for _, i := range remaining {
+			total += weights[i]
+		}
+		if total == 0 {
+			order = append(order, remaining...)
+			break
+		}
+		pick := rand.Intn(total)
+		for n, i := range remaining {
+			if pick < weights[i] {
+				order = append(order, i)
+				remaining = append(remaining[:n], remaining[n+1:]...)
+				break
+			}
+			pick -= weights[i]
+		}
+	}
+	return order
+}
+
+// errRegionTimeout is returned when a region does not send response headers
+// within VERTEX_REGION_TIMEOUT.
+var errRegionTimeout = errors.New("timed out waiting for Vertex AI response headers")
+
+// shouldFailover reports whether err means the backend is unhealthy and the
+// next backend should be tried: throttling, server errors, timeouts and
+// network failures. Client errors such as 400 would fail everywhere.
+func shouldFailover(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var vertexErr *VertexError
+	if errors.As(err, &vertexErr) {
+		return retryableStatus(vertexErr.StatusCode)
+	}
+	// Anything else is a transport failure, including errRegionTimeout
+	return true
+}
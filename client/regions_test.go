@@ -0,0 +1,212 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"vertexai-anthropic-proxy/config"
+	"vertexai-anthropic-proxy/translation"
+)
+
+// regionServer serves every region under /<region>/v1/... and answers with
+// the status configured for that region.
+type regionServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses map[string]int
+	hang     map[string]bool
+	calls    []string
+}
+
+func newRegionServer(t *testing.T) *regionServer {
+	s := &regionServer{statuses: map[string]int{}, hang: map[string]bool{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		region := strings.Split(r.URL.Path, "/")[1]
+		if !strings.Contains(r.URL.Path, "/locations/"+region+"/") {
+			t.Errorf("path %s does not use location %s", r.URL.Path, region)
+		}
+
+		s.mu.Lock()
+		s.calls = append(s.calls, region)
+		status, hang := s.statuses[region], s.hang[region]
+		s.mu.Unlock()
+
+		if hang {
+			// The request context is only cancelled on disconnect once
+			// the body has been read
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+			return
+		}
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *regionServer) takeCalls() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calls := strings.Join(s.calls, ",")
+	s.calls = nil
+	return calls
+}
+
+func newRegionClient(t *testing.T, server *regionServer, regions ...string) *VertexClient {
+	t.Helper()
+	list, err := config.ParseRegions(strings.Join(regions, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		VertexAIProjectID:   "test-project",
+		VertexAIRegion:      regions[0],
+		VertexAIRegions:     list,
+		VertexAIEndpoint:    server.URL + "/{region}",
+		RetryMaxAttempts:    1,
+		RegionCooldown:      time.Minute,
+		RegionTimeout:       100 * time.Millisecond,
+		RetryInitialBackoff: time.Millisecond,
+	}
+	c, err := NewVertexClient(context.Background(), cfg, (&countingTokenSource{}).newTokenSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func sendOnce(c *VertexClient) error {
+	body, err := c.SendToVertexAI(context.Background(), testRoute, &translation.VertexAIRequest{})
+	if err == nil {
+		body.Close()
+	}
+	return err
+}
+
+func TestRegionFailover(t *testing.T) {
+	server := newRegionServer(t)
+	c := newRegionClient(t, server, "us-east5", "europe-west1")
+	now := time.Now()
+	c.health.now = func() time.Time { return now }
+
+	server.statuses["us-east5"] = 529
+	if err := sendOnce(c); err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	if calls := server.takeCalls(); calls != "us-east5,europe-west1" {
+		t.Errorf("calls = %s, want failover to europe-west1", calls)
+	}
+
+	// us-east5 is cooling down, so it is skipped even though it recovered
+	server.statuses["us-east5"] = 0
+	if err := sendOnce(c); err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	if calls := server.takeCalls(); calls != "europe-west1" {
+		t.Errorf("calls during cooldown = %s, want europe-west1", calls)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if err := sendOnce(c); err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	if calls := server.takeCalls(); calls != "us-east5" {
+		t.Errorf("calls after cooldown = %s, want us-east5", calls)
+	}
+}
+
+func TestRegionFailoverAllUnhealthy(t *testing.T) {
+	server := newRegionServer(t)
+	c := newRegionClient(t, server, "us-east5", "europe-west1")
+
+	server.statuses["us-east5"] = 429
+	server.statuses["europe-west1"] = 503
+	if err := sendOnce(c); err == nil {
+		t.Fatal("SendToVertexAI() error = nil, want error")
+	}
+	server.takeCalls()
+
+	// Every region is cooling down; they are still tried rather than
+	// refusing the request
+	server.statuses["europe-west1"] = 0
+	if err := sendOnce(c); err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	if calls := server.takeCalls(); calls != "us-east5,europe-west1" {
+		t.Errorf("calls = %s", calls)
+	}
+}
+
+func TestRegionNoFailoverOnClientError(t *testing.T) {
+	server := newRegionServer(t)
+	c := newRegionClient(t, server, "us-east5", "europe-west1")
+
+	server.statuses["us-east5"] = http.StatusBadRequest
+	if err := sendOnce(c); err == nil {
+		t.Fatal("SendToVertexAI() error = nil, want 400")
+	}
+	if calls := server.takeCalls(); calls != "us-east5" {
+		t.Errorf("calls = %s, want no failover", calls)
+	}
+}
+
+func TestRegionTimeout(t *testing.T) {
+	server := newRegionServer(t)
+	c := newRegionClient(t, server, "us-east5", "europe-west1")
+
+	server.hang["us-east5"] = true
+	if err := sendOnce(c); err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	if calls := server.takeCalls(); calls != "us-east5,europe-west1" {
+		t.Errorf("calls = %s, want failover after timeout", calls)
+	}
+}
+
+func TestRouteRegions(t *testing.T) {
+	server := newRegionServer(t)
+	c := newRegionClient(t, server, "us-east5")
+
+	route := testRoute
+	route.Regions = []config.Region{{Name: "asia-southeast1"}}
+	body, err := c.SendToVertexAI(context.Background(), route, &translation.VertexAIRequest{})
+	if err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	body.Close()
+	if calls := server.takeCalls(); calls != "asia-southeast1" {
+		t.Errorf("calls = %s, want the route's region", calls)
+	}
+}
+
+func TestWeightedOrder(t *testing.T) {
+	weights := []int{3, 1, 0}
+
+	first := map[int]int{}
+	for i := 0; i < 2000; i++ {
+		order := weightedOrder(weights)
+		if len(order) != 3 || order[2] != 2 {
+			t.Fatalf("order = %v, want zero-weight entry last", order)
+		}
+		first[order[0]]++
+	}
+	// 0 should be first about three times as often as 1
+	if ratio := float64(first[0]) / float64(first[1]); ratio < 2 || ratio > 4.5 {
+		t.Errorf("first picks = %v", first)
+	}
+
+	if got := fmt.Sprint(weightedOrder([]int{0, 0, 0})); got != "[0 1 2]" {
+		t.Errorf("unweighted order = %s", got)
+	}
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"vertexai-anthropic-proxy/config"
+)
+
+// RetryPolicy controls how failed Vertex AI requests are retried. Requests
+// are only retried before anything has been forwarded to the caller: on
+// network errors, on retryable HTTP statuses, and on a stream whose first
+// event is a retryable error.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts int
+	// InitialBackoff is the upper bound of the first delay; it doubles on
+	// each retry up to MaxBackoff. The actual delay is chosen uniformly
+	// between zero and the bound ("full jitter").
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Budget caps the total time a single request may spend waiting
+	// between attempts. A Retry-After that does not fit is not waited for.
+	Budget time.Duration
+}
+
+// DefaultRetryPolicy is used for any setting left at zero.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     8 * time.Second,
+	Budget:         30 * time.Second,
+}
+
+// RetryPolicyFromConfig returns the policy configured in cfg.
+func RetryPolicyFromConfig(cfg *config.Config) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    cfg.RetryMaxAttempts,
+		InitialBackoff: cfg.RetryInitialBackoff,
+		MaxBackoff:     cfg.RetryMaxBackoff,
+		Budget:         cfg.RetryBudget,
+	}.withDefaults()
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultRetryPolicy.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+	if p.Budget <= 0 {
+		p.Budget = DefaultRetryPolicy.Budget
+	}
+	return p
+}
+
+// retryableStatus reports whether Vertex AI may succeed if the request is
+// sent again: quota (429), overload (529) and transient server errors.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout, 529:
+		return true
+	}
+	return false
+}
+
+// retryableStreamError reports whether an error event that arrives before
+// any other event may be retried.
+func retryableStreamError(errType string) bool {
+	switch errType {
+	case "overloaded_error", "rate_limit_error", "api_error":
+		return true
+	}
+	return false
+}
+
+// retrier tracks the attempts of a single request.
+type retrier struct {
+	policy   RetryPolicy
+	attempt  int
+	deadline time.Time
+}
+
+func (p RetryPolicy) newRetrier() *retrier {
+	return &retrier{policy: p, attempt: 1, deadline: time.Now().Add(p.Budget)}
+}
+
+// wait decides whether the request that failed with err should be retried.
+// If so it sleeps for the backoff delay and returns true. It returns false
+// without sleeping when err is not retryable, the attempts or budget are
+// used up, or ctx is done.
+func (r *retrier) wait(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || r.attempt >= r.policy.MaxAttempts {
+		return false
+	}
+	// Fail fast rather than wait for a breaker to close
+	if errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+
+	delay := r.backoff()
+	var vertexErr *VertexError
+	if errors.As(err, &vertexErr) {
+		if !retryableStatus(vertexErr.StatusCode) {
+			return false
+		}
+		if vertexErr.RetryAfter > delay {
+			delay = vertexErr.RetryAfter
+		}
+	}
+	if time.Now().Add(delay).After(r.deadline) {
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return false
+	}
+
+	r.attempt++
+	return true
+}
+
+// backoff returns a random delay up to InitialBackoff * 2^(attempt-1),
+// capped at MaxBackoff.
+func (r *retrier) backoff() time.Duration {
+	bound := r.policy.InitialBackoff
+	for i := 1; i < r.attempt && bound < r.policy.MaxBackoff; i++ {
+		bound *= 2
+	}
+	if bound > r.policy.MaxBackoff {
+		bound = r.policy.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(bound) + 1))
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as
+// an HTTP date. It returns 0 if the header is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
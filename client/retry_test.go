@@ -0,0 +1,215 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"vertexai-anthropic-proxy/config"
+	"vertexai-anthropic-proxy/translation"
+)
+
+var testRoute = config.ModelRoute{Model: "claude-3-5-sonnet", Version: "20240620"}
+
+func TestSendToVertexAIRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int32
+		wantStatus   int
+	}{
+		{name: "Overloaded then OK", statuses: []int{529, 200}, wantAttempts: 2, wantStatus: 200},
+		{name: "Quota then server error then OK", statuses: []int{429, 503, 200}, wantAttempts: 3, wantStatus: 200},
+		{name: "Attempts exhausted", statuses: []int{529, 529, 529, 200}, wantAttempts: 3, wantStatus: 529},
+		{name: "Bad request is not retried", statuses: []int{400, 200}, wantAttempts: 1, wantStatus: 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&attempts, 1)
+				w.WriteHeader(tt.statuses[n-1])
+				w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			c := newTestClient(t, server, &countingTokenSource{})
+			body, err := c.SendToVertexAI(context.Background(), testRoute, &translation.VertexAIRequest{})
+
+			status := 200
+			var vertexErr *VertexError
+			if errors.As(err, &vertexErr) {
+				status = vertexErr.StatusCode
+			} else if err != nil {
+				t.Fatalf("SendToVertexAI() error = %v", err)
+			} else {
+				body.Close()
+			}
+
+			if status != tt.wantStatus || attempts != tt.wantAttempts {
+				t.Errorf("got status %d after %d attempts, want %d after %d", status, attempts, tt.wantStatus, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestSendToVertexAIRetryAfter(t *testing.T) {
+	var attempts int32
+	var first time.Time
+	var waited time.Duration
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			first = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		waited = time.Since(first)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server, &countingTokenSource{})
+	body, err := c.SendToVertexAI(context.Background(), testRoute, &translation.VertexAIRequest{})
+	if err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	body.Close()
+
+	if waited < time.Second {
+		t.Errorf("retried after %v, want at least the 1s Retry-After", waited)
+	}
+}
+
+func TestSendToVertexAIRetryBudget(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		// Asks for a longer wait than the budget allows
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server, &countingTokenSource{})
+	c.retry.Budget = time.Second
+
+	start := time.Now()
+	_, err := c.SendToVertexAI(context.Background(), testRoute, &translation.VertexAIRequest{})
+	var vertexErr *VertexError
+	if !errors.As(err, &vertexErr) || vertexErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("SendToVertexAI() error = %v, want 429", err)
+	}
+	if attempts != 1 || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("made %d attempts in %v, want 1 without waiting", attempts, time.Since(start))
+	}
+}
+
+func TestSendToVertexAIRetryCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(529)
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server, &countingTokenSource{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := c.SendToVertexAI(ctx, testRoute, &translation.VertexAIRequest{}); err == nil {
+		t.Fatal("SendToVertexAI() error = nil")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("backoff was not interrupted by cancellation")
+	}
+}
+
+func TestSendToVertexAIStreamRetry(t *testing.T) {
+	const overloaded = "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n"
+	const ok = "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_01\"}}\n\n" +
+		"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"
+
+	tests := []struct {
+		name      string
+		bodies    []string
+		wantTypes string
+	}{
+		{name: "Error before first event is retried", bodies: []string{overloaded, ok}, wantTypes: "[message_start message_stop]"},
+		{name: "Retries exhausted", bodies: []string{overloaded, overloaded, overloaded}, wantTypes: "[error]"},
+		{
+			name: "Error after first event is not retried",
+			bodies: []string{
+				"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_01\"}}\n\n" + overloaded,
+				ok,
+			},
+			wantTypes: "[message_start error]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&attempts, 1)
+				w.Header().Set("Content-Type", "text/event-stream")
+				io.WriteString(w, tt.bodies[n-1])
+			}))
+			defer server.Close()
+
+			c := newTestClient(t, server, &countingTokenSource{})
+			events := make(chan translation.StreamEvent)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- c.SendToVertexAIStream(context.Background(), testRoute, &translation.VertexAIRequest{Stream: true}, events)
+			}()
+
+			var types []string
+			for ev := range events {
+				types = append(types, ev.Type)
+			}
+			if err := <-errc; err != nil {
+				t.Fatalf("SendToVertexAIStream() error = %v", err)
+			}
+			if got := fmt.Sprint(types); got != tt.wantTypes {
+				t.Errorf("events = %s, want %s", got, tt.wantTypes)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]time.Duration{
+		"":                              0,
+		"3":                             3 * time.Second,
+		"-1":                            0,
+		"soon":                          0,
+		"Mon, 01 Jul 2024 12:00:10 GMT": 10 * time.Second,
+		"Mon, 01 Jul 2024 11:00:00 GMT": 0,
+	}
+	for value, want := range tests {
+		if got := parseRetryAfter(value, now); got != want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+func TestBackoffBounds(t *testing.T) {
+	r := RetryPolicy{MaxAttempts: 10, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Budget: time.Minute}.newRetrier()
+	for attempt, bound := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		r.attempt = attempt + 1
+		for i := 0; i < 20; i++ {
+			if d := r.backoff(); d < 0 || d > bound*time.Millisecond {
+				t.Fatalf("attempt %d: backoff %v outside [0, %v]", r.attempt, d, bound*time.Millisecond)
+			}
+		}
+	}
+}
@@ -1,181 +1,468 @@
 package client
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"strconv"
 	"time"
 
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
+	"vertexai-anthropic-proxy/capture"
 	"vertexai-anthropic-proxy/config"
+	"vertexai-anthropic-proxy/metrics"
+	"vertexai-anthropic-proxy/replay"
+	"vertexai-anthropic-proxy/sse"
+	"vertexai-anthropic-proxy/tracing"
 	"vertexai-anthropic-proxy/translation"
-	"github.com/google/uuid"
+	"vertexai-anthropic-proxy/usage"
+	"vertexai-anthropic-proxy/utils"
 )
 
-func SendToVertexAI(cfg *config.Config, req *translation.VertexAIRequest) (io.ReadCloser, error) {
-	ctx := context.Background()
+// VertexClient sends requests to Vertex AI. It is safe for concurrent use
+// and is meant to be created once and shared, so that tokens and
+// connections are reused across requests.
+type VertexClient struct {
+	cfg           *config.Config
+	pool          *pool
+	retry         RetryPolicy
+	health        *regionHealth
+	breakers      *breakers
+	regionTimeout time.Duration
+}
+
+// NewVertexClient looks up credentials with newTokenSource and returns a
+// client for the backends (projects, regions and endpoints) in cfg.
+//
+// With VERTEX_MODE=replay no request leaves the process: responses come
+// from the recordings in VERTEX_FIXTURES_FILE, and newTokenSource is not
+// called, so no credentials are needed. With VERTEX_MODE=record every
+// request is also recorded there.
+func NewVertexClient(ctx context.Context, cfg *config.Config, newTokenSource TokenSourceFunc) (*VertexClient, error) {
+	var transport http.RoundTripper
+	switch cfg.VertexMode {
+	case config.VertexReplay:
+		player, err := replay.Open(cfg.VertexFixturesFile, cfg.VertexReplaySpeed)
+		if err != nil {
+			return nil, fmt.Errorf("loading recordings: %w", err)
+		}
+		utils.GetLogger().Infof("Replaying %d recorded requests from %s", player.Len(), cfg.VertexFixturesFile)
+		transport = player
+		newTokenSource = replayTokenSource
+	case config.VertexRecord:
+		recorder, err := replay.NewRecorder(cfg.VertexFixturesFile, newTransport())
+		if err != nil {
+			return nil, fmt.Errorf("opening recordings: %w", err)
+		}
+		utils.GetLogger().Infof("Recording requests to Vertex AI in %s", cfg.VertexFixturesFile)
+		transport = recorder
+	default:
+		transport = newTransport()
+	}
 
-	credentials, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	pool, err := newPool(ctx, cfg, newTokenSource, transport)
 	if err != nil {
-		log.Printf("Error finding default credentials: %v", err)
 		return nil, err
 	}
+	return &VertexClient{
+		cfg:           cfg,
+		pool:          pool,
+		retry:         RetryPolicyFromConfig(cfg),
+		health:        newRegionHealth(cfg.RegionCooldown),
+		breakers:      newBreakers(BreakerPolicyFromConfig(cfg)),
+		regionTimeout: cfg.RegionTimeout,
+	}, nil
+}
+
+// newTransport returns a transport tuned for many concurrent requests to a
+// single host. It is shared by all backends. There is deliberately no
+// overall timeout: streamed responses can stay open for minutes.
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 100
+	transport.IdleConnTimeout = 90 * time.Second
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	transport.ForceAttemptHTTP2 = true
+	return transport
+}
 
-	client := oauth2.NewClient(ctx, credentials.TokenSource)
+// RefreshCredentials reloads every credentials file in use and fetches new
+// tokens, which are used by all following requests.
+func (c *VertexClient) RefreshCredentials(ctx context.Context) error {
+	return c.pool.refresh(ctx)
+}
 
-	url := fmt.Sprintf("%s/v1/projects/%s/locations/%s/publishers/anthropic/models/%s:streamRawPredict",
-		cfg.VertexAIEndpoint, cfg.VertexAIProjectID, cfg.VertexAIRegion, cfg.AnthropicModel)
+// vertexURL builds the prediction URL for a model on a backend. Streaming
+// requests must use streamRawPredict; rawPredict returns a single JSON
+// Message.
+func (c *VertexClient) vertexURL(b *backend, route config.ModelRoute, stream bool) string {
+	method := "rawPredict"
+	if stream {
+		method = "streamRawPredict"
+	}
+	return fmt.Sprintf("%s/v1/projects/%s/locations/%s/publishers/anthropic/models/%s:%s",
+		b.endpoint, b.project, b.region, route.VertexModelID(), method)
+}
 
+// post sends req and returns the response once Vertex AI answers 200 OK,
+// together with the backend that answered. Each attempt tries the model's
+// backends in turn; failed attempts are retried as allowed by retry.
+// Cancelling ctx aborts the upstream request, including reads from the
+// returned body.
+func (c *VertexClient) post(ctx context.Context, retry *retrier, route config.ModelRoute, req *translation.VertexAIRequest, stream bool) (*http.Response, *backend, error) {
 	jsonData, err := json.Marshal(req)
 	if err != nil {
-		log.Printf("Error marshaling request: %v", err)
-		return nil, err
+		utils.GetLogger().Errorf("Error marshaling request: %v", err)
+		return nil, nil, err
 	}
 
-	log.Printf("Sending request to Vertex AI: %s", url)
-	log.Printf("Request body: %s", string(jsonData))
+	if body, ok := c.cfg.Bodies().Render(jsonData); ok {
+		utils.GetLogger().Infof("Request body: %s", body)
+	}
+	capture.FromContext(ctx).VertexRequest(route.VertexModelID(), stream, jsonData)
 
-	resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	for {
+		resp, b, err := c.sendToBackends(ctx, route, stream, jsonData)
+		if err == nil {
+			return resp, b, nil
+		}
+		if !retry.wait(ctx, err) {
+			return nil, nil, err
+		}
+		metrics.VertexRetry(route.VertexModelID())
+		utils.GetLogger().Warnf("Retrying request to Vertex AI (attempt %d of %d)", retry.attempt, retry.policy.MaxAttempts)
+	}
+}
+
+// sendToBackends tries each backend that serves route once, in the order
+// picked by the load-balancing strategy with healthy backends first, and
+// returns the first successful response. A stream only succeeds once its
+// first event has arrived and is not a retryable error. Backends that fail
+// with a throttling, server or network error are put in cooldown. Backends
+// whose circuit breaker is open are skipped; if that is all of them, it
+// fails with ErrCircuitOpen straight away.
+func (c *VertexClient) sendToBackends(ctx context.Context, route config.ModelRoute, stream bool, jsonData []byte) (*http.Response, *backend, error) {
+	model := route.VertexModelID()
+
+	backends, err := c.pool.order(ctx, route)
 	if err != nil {
-		log.Printf("Error sending request to Vertex AI: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
+	c.health.sortHealthy(model, backends)
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		log.Printf("Vertex AI returned non-OK status: %d, body: %s", resp.StatusCode, string(body))
-		return nil, fmt.Errorf("Vertex AI returned non-OK status: %d, body: %s", resp.StatusCode, string(body))
+	var lastErr error
+	for _, b := range backends {
+		breaker := c.breakers.get(b, model)
+		if !breaker.allow() {
+			utils.GetLogger().Warnf("Skipping backend %s for %s: circuit breaker open", b.id, model)
+			continue
+		}
+
+		url := c.vertexURL(b, route, stream)
+		utils.GetLogger().Infof("Sending request to Vertex AI: %s", url)
+
+		b.inFlight.Add(1)
+		b.quota.take(c.pool.now())
+		attempt := capture.FromContext(ctx).Attempt(b.id, url)
+		attemptCtx, span := c.startSpan(ctx, b, model, stream)
+		resp, err := c.send(attemptCtx, b.creds.httpClient, url, jsonData)
+		if err == nil {
+			// The span lasts as long as the caller reads the response
+			resp.Body = attempt.Response(&onClose{ReadCloser: resp.Body, fn: func() {
+				b.release()
+				span.End()
+			}}, stream)
+			if stream {
+				err = peekStream(resp)
+			}
+			if err == nil {
+				breaker.record(false)
+				c.health.markHealthy(b.id, model)
+				usage.FromContext(ctx).SetBackend(b.id, b.region)
+				return resp, b, nil
+			}
+			tracing.Fail(span, err)
+			resp.Body.Close()
+		} else {
+			b.release()
+			tracing.Fail(span, err)
+			span.End()
+		}
+		if ctx.Err() == nil {
+			metrics.VertexError(b.id, model, errorStatus(err))
+		}
+
+		var vertexErr *VertexError
+		var early *earlyStreamError
+		switch {
+		case errors.As(err, &vertexErr):
+			attempt.Rejected(vertexErr.StatusCode, vertexErr.Body)
+			if vertexErr.StatusCode == http.StatusTooManyRequests {
+				b.quota.exhaust(c.pool.now())
+			}
+		case errors.As(err, &early):
+			// The stream and its error event are recorded already
+		default:
+			attempt.Fail(err)
+		}
+		if !shouldFailover(ctx, err) {
+			if ctx.Err() != nil {
+				breaker.release()
+			} else {
+				// The backend answered; the request itself was bad
+				breaker.record(false)
+			}
+			return nil, nil, err
+		}
+		breaker.record(true)
+		c.health.markFailed(b.id, model)
+		utils.GetLogger().Warnf("Backend %s failed for %s: %v", b.id, model, err)
+		lastErr = err
+	}
+	if lastErr == nil && len(backends) > 0 {
+		return nil, nil, fmt.Errorf("%w for %s", ErrCircuitOpen, model)
 	}
+	return nil, nil, lastErr
+}
 
-	return resp.Body, nil
+// startSpan starts the span of an attempt against backend b, with a child
+// span for getting its access token. The token is cached, so the child is
+// only slow when the token has expired and a new one is fetched.
+func (c *VertexClient) startSpan(ctx context.Context, b *backend, model string, stream bool) (context.Context, trace.Span) {
+	method := "rawPredict"
+	if stream {
+		method = "streamRawPredict"
+	}
+	ctx, span := tracing.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("vertex.backend", b.id),
+			attribute.String("vertex.project", b.project),
+			attribute.String("vertex.region", b.region),
+			attribute.String("vertex.model", model),
+		),
+	)
+
+	_, tokenSpan := tracing.Start(ctx, "credentials")
+	if _, err := b.creds.tokens.Token(); err != nil {
+		// send fails with the same error and reports it
+		tracing.Fail(tokenSpan, err)
+	}
+	tokenSpan.End()
+	return ctx, span
 }
 
-func SendToVertexAIStream(cfg *config.Config, req *translation.VertexAIRequest, responseChan chan<- []byte) error {
-	ctx := context.Background()
+// send makes a single attempt. If a region timeout is configured and no
+// response headers arrive in time, the attempt is abandoned with
+// errRegionTimeout.
+func (c *VertexClient) send(ctx context.Context, httpClient *http.Client, url string, jsonData []byte) (*http.Response, error) {
+	attemptCtx, cancel := context.WithCancel(ctx)
 
-	credentials, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	var timer *time.Timer
+	if c.regionTimeout > 0 {
+		timer = time.AfterFunc(c.regionTimeout, cancel)
+	}
+	// timedOut must be called once the response headers are in
+	timedOut := func() bool {
+		return timer != nil && !timer.Stop()
+	}
+
+	httpReq, err := http.NewRequestWithContext(attemptCtx, http.MethodPost, url, bytes.NewReader(jsonData))
 	if err != nil {
-		log.Printf("Error finding default credentials: %v", err)
-		return err
+		cancel()
+		return nil, err
 	}
+	httpReq.Header.Set("Content-Type", "application/json")
 
-	client := oauth2.NewClient(ctx, credentials.TokenSource)
+	resp, err := httpClient.Do(httpReq)
+	if timedOut() && ctx.Err() == nil {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		utils.GetLogger().Warnf("Timed out waiting for Vertex AI after %s", c.regionTimeout)
+		return nil, errRegionTimeout
+	}
+	if err != nil {
+		cancel()
+		utils.GetLogger().Errorf("Error sending request to Vertex AI: %v", err)
+		return nil, err
+	}
 
-	url := fmt.Sprintf("%s/v1/projects/%s/locations/%s/publishers/anthropic/models/%s:streamRawPredict",
-		cfg.VertexAIEndpoint, cfg.VertexAIProjectID, cfg.VertexAIRegion, cfg.AnthropicModel)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+		logged, _ := c.cfg.Bodies().Render(body)
+		utils.GetLogger().Errorf("Vertex AI returned non-OK status: %d, body: %s", resp.StatusCode, logged)
+		return nil, &VertexError{
+			StatusCode: resp.StatusCode,
+			Body:       body,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
 
-	jsonData, err := json.Marshal(req)
+	// Release the per-attempt context once the caller is done with the body
+	resp.Body = &onClose{ReadCloser: resp.Body, fn: cancel}
+	return resp, nil
+}
+
+// SendToVertexAI sends req and returns the response body: a JSON Message, or
+// the raw event stream if req.Stream is set. The body must be closed, and
+// stays tied to ctx. Failures are retried until Vertex AI answers 200 OK,
+// and for a stream until its first event is not a retryable error; after
+// that the body is the caller's and nothing is retried.
+func (c *VertexClient) SendToVertexAI(ctx context.Context, route config.ModelRoute, req *translation.VertexAIRequest) (io.ReadCloser, error) {
+	resp, _, err := c.post(ctx, c.retry.newRetrier(), route, req, req.Stream)
+	var early *earlyStreamError
+	if errors.As(err, &early) {
+		// Out of retries: return the error event as Vertex AI sent it
+		return io.NopCloser(bytes.NewReader(early.raw)), nil
+	}
 	if err != nil {
-		log.Printf("Error marshaling request: %v", err)
-		return err
+		return nil, err
 	}
+	return resp.Body, nil
+}
 
-	log.Printf("Sending streaming request to Vertex AI: %s", url)
-	log.Printf("Request body: %s", string(jsonData))
+// SendToVertexAIStream sends a streaming request and delivers each Anthropic
+// event on events. events is always closed when it returns; an error event
+// from Vertex AI is delivered like any other event. If ctx is cancelled it
+// stops sending, closes the upstream connection and returns ctx.Err(), so
+// the receiver may stop reading from events once it has cancelled ctx.
+//
+// A stream that fails before its first event is retried, so the receiver
+// never sees a partial response followed by a new one.
+func (c *VertexClient) SendToVertexAIStream(ctx context.Context, route config.ModelRoute, req *translation.VertexAIRequest, events chan<- translation.StreamEvent) error {
+	defer close(events)
 
-	resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	resp, _, err := c.post(ctx, c.retry.newRetrier(), route, req, true)
+	var early *earlyStreamError
+	if errors.As(err, &early) {
+		// Out of retries: pass the error event on as usual
+		select {
+		case events <- early.event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 	if err != nil {
-		log.Printf("Error sending request to Vertex AI: %v", err)
 		return err
 	}
 	defer resp.Body.Close()
+	return readEvents(ctx, resp.Body, events)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("Vertex AI returned non-OK status: %d, body: %s", resp.StatusCode, string(body))
-		return fmt.Errorf("Vertex AI returned non-OK status: %d, body: %s", resp.StatusCode, string(body))
+// errorStatus labels a failed attempt in the metrics: the HTTP status
+// Vertex AI answered with, the type of the error event a stream started
+// with, "timeout" for the region timeout and "network" for anything else.
+func errorStatus(err error) string {
+	var vertexErr *VertexError
+	var early *earlyStreamError
+	switch {
+	case errors.As(err, &vertexErr):
+		return strconv.Itoa(vertexErr.StatusCode)
+	case errors.As(err, &early):
+		return early.event.Error.Type
+	case errors.Is(err, errRegionTimeout):
+		return "timeout"
 	}
+	return "network"
+}
 
-	reader := bufio.NewReader(resp.Body)
-	var currentEvent string
-	var currentData []byte
+// earlyStreamError is returned by peekStream for a stream whose first
+// event is a retryable error. raw holds the stream as it was read.
+type earlyStreamError struct {
+	event translation.StreamEvent
+	raw   []byte
+}
+
+func (e *earlyStreamError) Error() string {
+	return fmt.Sprintf("%s: %s", e.event.Error.Type, e.event.Error.Message)
+}
 
+// peekStream reads the streamed response resp up to its first event, and
+// fails with an earlyStreamError if that is a retryable error. Otherwise the
+// body is replaced so that the caller still reads the whole stream.
+func peekStream(resp *http.Response) error {
+	var buf bytes.Buffer
+	reader := sse.NewReader(io.TeeReader(resp.Body, &buf))
 	for {
-		line, err := reader.ReadBytes('\n')
+		ev, err := reader.Next()
+		if err == io.EOF {
+			// Leave an empty stream for the caller to report
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if ev.IsComment() || ev.Event == "ping" {
+			continue
+		}
+
+		var event translation.StreamEvent
+		if json.Unmarshal([]byte(ev.Data), &event) == nil && event.Type == "error" && event.Error != nil && retryableStreamError(event.Error.Type) {
+			return &earlyStreamError{event: event, raw: buf.Bytes()}
+		}
+		break
+	}
+	resp.Body = &readCloser{Reader: io.MultiReader(&buf, resp.Body), Closer: resp.Body}
+	return nil
+}
+
+// readCloser reads from Reader and closes Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func readEvents(ctx context.Context, body io.Reader, events chan<- translation.StreamEvent) error {
+	reader := sse.NewReader(body)
+
+	for {
+		ev, err := reader.Next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			log.Printf("Error reading response: %v", err)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			utils.GetLogger().Errorf("Error reading response: %v", err)
 			return err
 		}
 
-		// Trim whitespace and newline characters
-		line = bytes.TrimSpace(line)
+		// Skip comments and pings
+		if ev.IsComment() || ev.Event == "ping" {
+			continue
+		}
 
-		// Skip empty lines
-		if len(line) == 0 {
+		var event translation.StreamEvent
+		if err := json.Unmarshal([]byte(ev.Data), &event); err != nil {
+			utils.GetLogger().Errorf("Error parsing JSON: %v", err)
 			continue
 		}
 
-		// Check for SSE prefix
-		if bytes.HasPrefix(line, []byte("event: ")) {
-			currentEvent = string(bytes.TrimPrefix(line, []byte("event: ")))
-		} else if bytes.HasPrefix(line, []byte("data: ")) {
-			currentData = bytes.TrimPrefix(line, []byte("data: "))
-
-			// Process the event
-			switch currentEvent {
-			case "message_start", "ping", "content_block_start", "content_block_stop":
-				// Ignore these events
-			case "content_block_delta":
-				// Parse the JSON content
-				var event struct {
-					Delta struct {
-						Text string `json:"text"`
-					} `json:"delta"`
-				}
-				if err := json.Unmarshal(currentData, &event); err != nil {
-					log.Printf("Error parsing JSON: %v", err)
-					continue
-				}
-
-				// Format as OpenAI-compatible JSON event
-				openAIEvent := map[string]interface{}{
-					"id":      "chatcmpl-" + uuid.New().String(),
-					"object":  "chat.completion.chunk",
-					"created": time.Now().Unix(),
-					"model":   "gpt-3.5-turbo-0613", // or whatever model name you want to use
-					"choices": []map[string]interface{}{
-						{
-							"delta": map[string]string{
-								"content": event.Delta.Text,
-							},
-							"index":        0,
-							"finish_reason": nil,
-						},
-					},
-				}
-
-				jsonData, err := json.Marshal(openAIEvent)
-				if err != nil {
-					log.Printf("Error marshaling JSON: %v", err)
-					continue
-				}
-
-				// Send the formatted JSON event
-				responseChan <- jsonData
-			case "message_delta":
-				// Ignore this event for now
-			case "message_stop":
-				// End of the message
-				close(responseChan)
-				return nil
-			default:
-				log.Printf("Unexpected event type: %s", currentEvent)
-			}
-		} else {
-			log.Printf("Unexpected line format: %s", string(line))
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		// Vertex AI ends the stream after message_stop or an error event
+		if event.Type == "message_stop" || event.Type == "error" {
+			return nil
 		}
 	}
 
-	return nil
-}
\ No newline at end of file
+	return io.ErrUnexpectedEOF
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"os/exec"
 	"strings"
 	"testing"
@@ -17,6 +18,12 @@ func TestVertexAIIntegration(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping integration test in short mode")
 	}
+	if _, err := os.Stat(".env"); err != nil {
+		t.Skip("Skipping integration test: no .env file")
+	}
+	if _, err := exec.LookPath("gcloud"); err != nil {
+		t.Skip("Skipping integration test: gcloud not installed")
+	}
 
 	cfg := config.LoadConfig()
 
@@ -30,10 +37,10 @@ func TestVertexAIIntegration(t *testing.T) {
 
 	// Prepare request
 	url := fmt.Sprintf("%s/v1/projects/%s/locations/%s/publishers/anthropic/models/%s:streamRawPredict",
-		cfg.VertexAIEndpoint, cfg.VertexAIProjectID, cfg.VertexAILocation, cfg.AnthropicModel)
+		cfg.VertexAIEndpoint, cfg.VertexAIProjectID, cfg.VertexAIRegion, cfg.AnthropicModel)
 
 	reqBody := map[string]interface{}{
-		"anthropic_version": cfg.AnthropicVersion,
+		"anthropic_version": "vertex-2023-10-16",
 		"messages": []map[string]string{
 			{"role": "user", "content": "Hey Claude!"},
 		},
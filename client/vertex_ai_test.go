@@ -1,15 +1,71 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/oauth2"
+
+	"vertexai-anthropic-proxy/capture"
 	"vertexai-anthropic-proxy/config"
 	"vertexai-anthropic-proxy/translation"
 )
 
+// countingTokenSource hands out "token-1", "token-2", ... one per call to
+// the TokenSourceFunc, and counts how often Token is called.
+type countingTokenSource struct {
+	sources int
+	tokens  int
+	err     error
+}
+
+func (c *countingTokenSource) newTokenSource(ctx context.Context, credentialsFile string) (oauth2.TokenSource, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.sources++
+	name := fmt.Sprintf("token-%d", c.sources)
+	return tokenFunc(func() (*oauth2.Token, error) {
+		c.tokens++
+		return &oauth2.Token{AccessToken: name, TokenType: "Bearer"}, nil
+	}), nil
+}
+
+type tokenFunc func() (*oauth2.Token, error)
+
+func (f tokenFunc) Token() (*oauth2.Token, error) { return f() }
+
+func newTestClient(t *testing.T, server *httptest.Server, tokens *countingTokenSource) *VertexClient {
+	t.Helper()
+	cfg := &config.Config{
+		VertexAIProjectID: "test-project",
+		VertexAIRegion:    "us-east5",
+		VertexAIEndpoint:  server.URL,
+		// Keep retries fast
+		RetryInitialBackoff: time.Millisecond,
+		RetryMaxBackoff:     5 * time.Millisecond,
+	}
+	c, err := NewVertexClient(context.Background(), cfg, tokens.newTokenSource)
+	if err != nil {
+		t.Fatalf("NewVertexClient() error = %v", err)
+	}
+	return c
+}
+
 func TestSendToVertexAI(t *testing.T) {
 	// Create a mock server
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -17,79 +73,350 @@ func TestSendToVertexAI(t *testing.T) {
 		if r.Method != http.MethodPost {
 			t.Errorf("Expected POST request, got %s", r.Method)
 		}
+		if want := "/v1/projects/test-project/locations/us-east5/publishers/anthropic/models/claude-3-5-sonnet@20240620:rawPredict"; r.URL.Path != want {
+			t.Errorf("path = %s, want %s", r.URL.Path, want)
+		}
 
 		// Check the request headers
 		if r.Header.Get("Content-Type") != "application/json" {
 			t.Errorf("Expected Content-Type: application/json, got %s", r.Header.Get("Content-Type"))
 		}
+		if got := r.Header.Get("Authorization"); got != "Bearer token-1" {
+			t.Errorf("Authorization = %q", got)
+		}
 
 		// Parse the request body
 		var reqBody translation.VertexAIRequest
-		err := json.NewDecoder(r.Body).Decode(&reqBody)
-		if err != nil {
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 			t.Errorf("Error decoding request body: %v", err)
 		}
-
-		// Check the request body
-		if len(reqBody.Instances) == 0 {
-			t.Errorf("Expected non-empty instances in request body")
+		if len(reqBody.Messages) == 0 {
+			t.Errorf("Expected non-empty messages in request body")
 		}
 
 		// Send a mock response
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(translation.VertexAIResponse{
-			Predictions: []translation.Prediction{
-				{Content: "This is a mock response from Vertex AI"},
-			},
-		})
+		w.Write([]byte(`{"id":"msg_01","type":"message","role":"assistant","content":[{"type":"text","text":"This is a mock response from Vertex AI"}],"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":8}}`))
 	}))
 	defer server.Close()
 
-	// Create a test config
-	cfg := &config.Config{
-		VertexAIProjectID: "test-project",
-		VertexAILocation:  "us-central1",
-		VertexAIEndpoint:  server.URL, // Use the mock server URL
-		AnthropicModel:    "claude-3-5-sonnet@20240620",
-		AnthropicVersion:  "vertex-2023-10-16",
-	}
+	tokens := &countingTokenSource{}
+	c := newTestClient(t, server, tokens)
 
-	// Create a test request
 	req := &translation.VertexAIRequest{
-		Instances: []translation.Instance{
-			{
-				Messages: []translation.Message{
-					{Role: "user", Content: "Hello, how are you?"},
-				},
-			},
-		},
-		Parameters: translation.Parameters{
-			MaxOutputTokens: 100,
-			Temperature:     0.7,
-			TopP:            0.95,
-			TopK:            40,
-		},
-	}
-
-	// Send the request to the mock Vertex AI server
-	resp, err := SendToVertexAI(cfg, req)
+		AnthropicVersion: "vertex-2023-10-16",
+		Messages:         []translation.Message{{Role: "user", Content: translation.TextContent("Hello, how are you?")}},
+		MaxTokens:        100,
+	}
+	route := config.ModelRoute{Model: "claude-3-5-sonnet", Version: "20240620"}
+
+	for i := 0; i < 3; i++ {
+		body, err := c.SendToVertexAI(context.Background(), route, req)
+		if err != nil {
+			t.Fatalf("SendToVertexAI() error = %v", err)
+		}
+
+		var vertexResp translation.VertexAIResponse
+		if err := json.NewDecoder(body).Decode(&vertexResp); err != nil {
+			t.Fatalf("Error parsing Vertex AI response: %v", err)
+		}
+		body.Close()
+
+		if len(vertexResp.Content) != 1 || vertexResp.Content[0].Text != "This is a mock response from Vertex AI" {
+			t.Errorf("Unexpected response content: %+v", vertexResp.Content)
+		}
+	}
+
+	// Credentials are looked up once and the token is reused
+	if tokens.sources != 1 || tokens.tokens != 1 {
+		t.Errorf("token sources = %d, tokens = %d, want 1 and 1", tokens.sources, tokens.tokens)
+	}
+}
+
+func TestSendToVertexAIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"code":429,"message":"Quota exceeded"}}`))
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server, &countingTokenSource{})
+	_, err := c.SendToVertexAI(context.Background(), config.ModelRoute{Model: "claude-3-5-sonnet", Version: "20240620"}, &translation.VertexAIRequest{})
+
+	var vertexErr *VertexError
+	if !errors.As(err, &vertexErr) {
+		t.Fatalf("error = %v, want *VertexError", err)
+	}
+	if vertexErr.StatusCode != http.StatusTooManyRequests || string(vertexErr.Body) != `{"error":{"code":429,"message":"Quota exceeded"}}` {
+		t.Errorf("VertexError = %d %s", vertexErr.StatusCode, vertexErr.Body)
+	}
+}
+
+func TestSendToVertexAIStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if want := "/v1/projects/test-project/locations/us-east5/publishers/anthropic/models/claude-3-5-sonnet@20240620:streamRawPredict"; r.URL.Path != want {
+			t.Errorf("path = %s, want %s", r.URL.Path, want)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_01\"}}\n\n"+
+			"event: ping\ndata: {\"type\":\"ping\"}\n\n"+
+			"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hi\"}}\n\n"+
+			"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server, &countingTokenSource{})
+	events := make(chan translation.StreamEvent)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.SendToVertexAIStream(context.Background(), config.ModelRoute{Model: "claude-3-5-sonnet", Version: "20240620"}, &translation.VertexAIRequest{Stream: true}, events)
+	}()
+
+	var types []string
+	for ev := range events {
+		types = append(types, ev.Type)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("SendToVertexAIStream() error = %v", err)
+	}
+	if fmt.Sprint(types) != "[message_start content_block_delta message_stop]" {
+		t.Errorf("events = %v", types)
+	}
+}
+
+func TestRefreshCredentials(t *testing.T) {
+	var authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	tokens := &countingTokenSource{}
+	c := newTestClient(t, server, tokens)
+	route := config.ModelRoute{Model: "claude-3-5-sonnet", Version: "20240620"}
+
+	send := func() {
+		body, err := c.SendToVertexAI(context.Background(), route, &translation.VertexAIRequest{})
+		if err != nil {
+			t.Fatalf("SendToVertexAI() error = %v", err)
+		}
+		body.Close()
+	}
+
+	send()
+	if err := c.RefreshCredentials(context.Background()); err != nil {
+		t.Fatalf("RefreshCredentials() error = %v", err)
+	}
+	send()
+
+	if fmt.Sprint(authorizations) != "[Bearer token-1 Bearer token-2]" {
+		t.Errorf("authorizations = %v", authorizations)
+	}
+
+	// A failed refresh keeps the current token
+	tokens.err = errors.New("no credentials")
+	if err := c.RefreshCredentials(context.Background()); err == nil {
+		t.Error("RefreshCredentials() error = nil, want error")
+	}
+	send()
+	if authorizations[2] != "Bearer token-2" {
+		t.Errorf("authorization after failed refresh = %s", authorizations[2])
+	}
+}
+
+func TestSendToVertexAIStreamCancel(t *testing.T) {
+	upstreamDone := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(upstreamDone)
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_01\"}}\n\n")
+		w.(http.Flusher).Flush()
+		// Keep the stream open until the proxy hangs up
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server, &countingTokenSource{})
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan translation.StreamEvent)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.SendToVertexAIStream(ctx, config.ModelRoute{Model: "claude-3-5-sonnet", Version: "20240620"}, &translation.VertexAIRequest{Stream: true}, events)
+	}()
+
+	if ev := <-events; ev.Type != "message_start" {
+		t.Fatalf("first event = %s", ev.Type)
+	}
+	// Stop reading from events, as a handler does once its client is gone
+	cancel()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("SendToVertexAIStream() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendToVertexAIStream did not return after cancel")
+	}
+	if _, ok := <-events; ok {
+		t.Error("events was not closed")
+	}
+	select {
+	case <-upstreamDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not cancelled")
+	}
+}
+
+func TestSendToVertexAISpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(sdktrace.NewTracerProvider()) })
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"id":"msg_01"}`)
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server, &countingTokenSource{})
+	body, err := c.SendToVertexAI(context.Background(), config.ModelRoute{Model: "claude-3-5-sonnet", Version: "20240620"}, &translation.VertexAIRequest{Stream: true})
+	if err != nil {
+		t.Fatalf("SendToVertexAI() error = %v", err)
+	}
+	if n := len(recorder.Ended()); n != 1 {
+		t.Fatalf("%d spans ended before the body was closed, want only credentials", n)
+	}
+	body.Close()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	creds, call := spans[0], spans[1]
+	if creds.Name() != "credentials" || call.Name() != "streamRawPredict" {
+		t.Errorf("span names = %q, %q", creds.Name(), call.Name())
+	}
+	if creds.Parent().SpanID() != call.SpanContext().SpanID() {
+		t.Error("credentials span is not a child of the call")
+	}
+	attrs := attribute.NewSet(call.Attributes()...)
+	if v, _ := attrs.Value("vertex.backend"); v.AsString() != "test-project/us-east5" {
+		t.Errorf("vertex.backend = %q", v.AsString())
+	}
+	if v, _ := attrs.Value("http.response.status_code"); v.AsInt64() != 200 {
+		t.Errorf("http.response.status_code = %d", v.AsInt64())
+	}
+}
+
+func TestSendToVertexAICapture(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `{"error":{"code":503,"message":"overloaded"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_01\"}}\n\n"+
+			"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	sink, err := capture.Open(path, capture.Options{SampleRate: 1})
 	if err != nil {
-		t.Fatalf("Error sending request to Vertex AI: %v", err)
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	x := sink.Start(httptest.NewRequest("POST", "/v1/messages", nil), nil)
+
+	c := newTestClient(t, server, &countingTokenSource{})
+	events := make(chan translation.StreamEvent)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.SendToVertexAIStream(capture.NewContext(context.Background(), x), config.ModelRoute{Model: "claude-3-5-sonnet", Version: "20240620"}, &translation.VertexAIRequest{Stream: true}, events)
+	}()
+	for range events {
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("SendToVertexAIStream() error = %v", err)
+	}
+	if err := sink.Finish(x, http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec capture.Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatal(err)
 	}
+	if rec.Vertex == nil || rec.Vertex.Model != "claude-3-5-sonnet@20240620" || !rec.Vertex.Stream {
+		t.Errorf("vertex request = %+v", rec.Vertex)
+	}
+	if len(rec.Attempts) != 2 {
+		t.Fatalf("attempts = %+v", rec.Attempts)
+	}
+	if a := rec.Attempts[0]; a.Backend != "test-project/us-east5" || a.Status != http.StatusServiceUnavailable || !strings.Contains(string(a.Body), "overloaded") {
+		t.Errorf("first attempt = %+v", a)
+	}
+	if a := rec.Attempts[1]; a.Status != http.StatusOK || len(a.Events) != 2 || a.Events[1].Event != "message_stop" {
+		t.Errorf("second attempt = %+v", a)
+	}
+}
 
-	// Parse the response
-	var vertexResp translation.VertexAIResponse
-	err = json.Unmarshal(resp, &vertexResp)
+func TestRecordAndReplayMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_01\"}}\n\n"+
+			"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+	}))
+	route := config.ModelRoute{Model: "claude-3-5-sonnet", Version: "20240620"}
+	req := &translation.VertexAIRequest{Stream: true, MaxTokens: 10}
+	stream := func(c *VertexClient) ([]string, error) {
+		events := make(chan translation.StreamEvent)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- c.SendToVertexAIStream(context.Background(), route, req, events)
+		}()
+		var types []string
+		for ev := range events {
+			types = append(types, ev.Type)
+		}
+		return types, <-errc
+	}
+
+	cfg := &config.Config{
+		VertexAIProjectID:  "test-project",
+		VertexAIRegion:     "us-east5",
+		VertexAIEndpoint:   server.URL,
+		VertexMode:         config.VertexRecord,
+		VertexFixturesFile: filepath.Join(t.TempDir(), "fixtures.jsonl"),
+	}
+	recording, err := NewVertexClient(context.Background(), cfg, (&countingTokenSource{}).newTokenSource)
 	if err != nil {
-		t.Fatalf("Error parsing Vertex AI response: %v", err)
+		t.Fatal(err)
+	}
+	if _, err := stream(recording); err != nil {
+		t.Fatalf("recording: %v", err)
 	}
+	server.Close()
 
-	// Check the response
-	if len(vertexResp.Predictions) == 0 {
-		t.Errorf("Expected non-empty predictions in response")
+	// Replay needs neither the server nor credentials
+	cfg.VertexMode = config.VertexReplay
+	replaying, err := NewVertexClient(context.Background(), cfg, (&countingTokenSource{err: errors.New("no credentials")}).newTokenSource)
+	if err != nil {
+		t.Fatalf("NewVertexClient() in replay mode: %v", err)
+	}
+	types, err := stream(replaying)
+	if err != nil {
+		t.Fatalf("replaying: %v", err)
 	}
-	if vertexResp.Predictions[0].Content != "This is a mock response from Vertex AI" {
-		t.Errorf("Unexpected response content: %s", vertexResp.Predictions[0].Content)
+	if fmt.Sprint(types) != "[message_start message_stop]" {
+		t.Errorf("replayed events = %v", types)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Load-balancing strategies for choosing between backends
+const (
+	// StrategyOrdered tries backends in list order, or in a random order
+	// drawn by weight if any backend has a weight
+	StrategyOrdered = "ordered"
+	// StrategyRoundRobin rotates the first backend on every request
+	StrategyRoundRobin = "round-robin"
+	// StrategyLeastInFlight prefers the backend with the fewest open requests
+	StrategyLeastInFlight = "least-in-flight"
+	// StrategyQuotaAware prefers the backend with the most unused
+	// requests-per-minute quota
+	StrategyQuotaAware = "quota-aware"
+)
+
+// Backend is a Vertex AI project and region to send requests to, with the
+// credentials to use for it.
+type Backend struct {
+	Project string `json:"project"`
+	Region  string `json:"region"`
+	// Endpoint overrides the endpoint derived from the region
+	Endpoint string `json:"endpoint,omitempty"`
+	// CredentialsFile is a service account key; empty uses Application
+	// Default Credentials
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	Weight          int    `json:"weight,omitempty"`
+	// QuotaRPM is the project's requests-per-minute quota in this region,
+	// used by the quota-aware strategy; 0 means unknown
+	QuotaRPM int `json:"quota_rpm,omitempty"`
+}
+
+// ID names the backend in logs and health tracking.
+func (b Backend) ID() string {
+	return b.Project + "/" + b.Region
+}
+
+// LoadBackends reads a backend pool from a JSON file of the form
+// [{"project": "my-project", "region": "us-east5", "credentials_file": "key.json", "quota_rpm": 60}].
+func LoadBackends(path string) ([]Backend, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var backends []Backend
+	if err := json.Unmarshal(data, &backends); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("%s: no backends", path)
+	}
+	seen := make(map[string]bool)
+	for i, b := range backends {
+		if b.Project == "" || b.Region == "" {
+			return nil, fmt.Errorf("%s: backend %d needs a project and a region", path, i)
+		}
+		if b.Weight < 0 || b.QuotaRPM < 0 {
+			return nil, fmt.Errorf("%s: backend %s: negative weight or quota", path, b.ID())
+		}
+		if seen[b.ID()] {
+			return nil, fmt.Errorf("%s: duplicate backend %s", path, b.ID())
+		}
+		seen[b.ID()] = true
+	}
+	return backends, nil
+}
+
+// ValidStrategy reports whether name is a known load-balancing strategy.
+func ValidStrategy(name string) bool {
+	switch name {
+	case StrategyOrdered, StrategyRoundRobin, StrategyLeastInFlight, StrategyQuotaAware:
+		return true
+	}
+	return false
+}
+
+// BackendsFor returns the backends that may serve route. Without a backend
+// pool, there is one backend per configured region in VERTEX_AI_PROJECT_ID.
+// A route with its own regions is limited to backends in those regions, in
+// the route's order and with its weights; a listed region that no pool
+// backend covers is served from VERTEX_AI_PROJECT_ID, which
+// ValidateBackends requires in that case.
+func (c *Config) BackendsFor(route ModelRoute) []Backend {
+	pool := c.Backends
+	if len(pool) == 0 {
+		for _, r := range c.RegionsFor(ModelRoute{}) {
+			pool = append(pool, Backend{Project: c.VertexAIProjectID, Region: r.Name, Weight: r.Weight})
+		}
+	}
+	if len(route.Regions) == 0 {
+		return pool
+	}
+
+	var backends []Backend
+	for _, r := range route.Regions {
+		found := false
+		for _, b := range pool {
+			if b.Region == r.Name {
+				b.Weight = r.Weight
+				backends = append(backends, b)
+				found = true
+			}
+		}
+		if !found {
+			backends = append(backends, Backend{Project: c.VertexAIProjectID, Region: r.Name, Weight: r.Weight})
+		}
+	}
+	return backends
+}
+
+// ValidateBackends checks that every backend BackendsFor may return has a
+// project: without VERTEX_AI_PROJECT_ID, there must be a backend pool that
+// covers every region a model route lists.
+func (c *Config) ValidateBackends() error {
+	if c.VertexAIProjectID != "" {
+		return nil
+	}
+	if len(c.Backends) == 0 {
+		return fmt.Errorf("VERTEX_AI_PROJECT_ID is not set and there is no VERTEX_BACKENDS_FILE")
+	}
+	covered := make(map[string]bool)
+	for _, b := range c.Backends {
+		covered[b.Region] = true
+	}
+	names := make([]string, 0, len(c.ModelRoutes))
+	for name := range c.ModelRoutes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, r := range c.ModelRoutes[name].Regions {
+			if !covered[r.Name] {
+				return fmt.Errorf("model %s is routed to %s, which no backend covers, and VERTEX_AI_PROJECT_ID is not set", name, r.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// BackendEndpoint returns the Vertex AI base URL for b.
+func (c *Config) BackendEndpoint(b Backend) string {
+	if b.Endpoint != "" {
+		return b.Endpoint
+	}
+	return c.EndpointFor(b.Region)
+}
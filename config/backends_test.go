@@ -0,0 +1,109 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadBackends(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	path := write("backends.json", `[
+		{"project": "p1", "region": "us-east5", "quota_rpm": 60},
+		{"project": "p2", "region": "us-east5", "credentials_file": "p2.json", "weight": 2}
+	]`)
+	got, err := LoadBackends(path)
+	if err != nil {
+		t.Fatalf("LoadBackends() error = %v", err)
+	}
+	want := []Backend{
+		{Project: "p1", Region: "us-east5", QuotaRPM: 60},
+		{Project: "p2", Region: "us-east5", CredentialsFile: "p2.json", Weight: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadBackends() = %v, want %v", got, want)
+	}
+
+	for name, data := range map[string]string{
+		"empty":      `[]`,
+		"no region":  `[{"project": "p1"}]`,
+		"duplicate":  `[{"project": "p1", "region": "r"}, {"project": "p1", "region": "r"}]`,
+		"negative":   `[{"project": "p1", "region": "r", "quota_rpm": -1}]`,
+		"not a list": `{"project": "p1"}`,
+	} {
+		if _, err := LoadBackends(write(name+".json", data)); err == nil {
+			t.Errorf("LoadBackends(%s) should fail", name)
+		}
+	}
+}
+
+func TestBackendsFor(t *testing.T) {
+	cfg := &Config{
+		VertexAIProjectID: "default",
+		VertexAIRegion:    "us-east5",
+		VertexAIRegions:   []Region{{Name: "us-east5"}, {Name: "europe-west1", Weight: 2}},
+	}
+	want := []Backend{{Project: "default", Region: "us-east5"}, {Project: "default", Region: "europe-west1", Weight: 2}}
+	if got := cfg.BackendsFor(ModelRoute{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("BackendsFor() without a pool = %v, want %v", got, want)
+	}
+
+	cfg.Backends = []Backend{
+		{Project: "p1", Region: "us-east5"},
+		{Project: "p2", Region: "us-east5", CredentialsFile: "p2.json"},
+		{Project: "p1", Region: "europe-west1"},
+	}
+	if got := cfg.BackendsFor(ModelRoute{}); !reflect.DeepEqual(got, cfg.Backends) {
+		t.Errorf("BackendsFor() = %v, want the pool", got)
+	}
+
+	route := ModelRoute{Model: "m", Regions: []Region{{Name: "us-east5", Weight: 1}, {Name: "asia-southeast1"}}}
+	want = []Backend{
+		{Project: "p1", Region: "us-east5", Weight: 1},
+		{Project: "p2", Region: "us-east5", CredentialsFile: "p2.json", Weight: 1},
+		{Project: "default", Region: "asia-southeast1"},
+	}
+	if got := cfg.BackendsFor(route); !reflect.DeepEqual(got, want) {
+		t.Errorf("BackendsFor(route) = %v, want %v", got, want)
+	}
+}
+
+func TestValidateBackends(t *testing.T) {
+	cfg := &Config{
+		VertexAIRegions: []Region{{Name: "us-east5"}},
+		ModelRoutes: ModelRoutes{
+			"claude-3-5-sonnet": {Model: "claude-3-5-sonnet", Regions: []Region{{Name: "us-east5"}, {Name: "europe-west1"}}},
+			"claude-3-haiku":    {Model: "claude-3-haiku"},
+		},
+	}
+	if err := cfg.ValidateBackends(); err == nil {
+		t.Error("ValidateBackends() accepted no project and no pool")
+	}
+
+	cfg.Backends = []Backend{{Project: "p1", Region: "us-east5"}}
+	err := cfg.ValidateBackends()
+	if err == nil || !strings.Contains(err.Error(), "europe-west1") {
+		t.Errorf("ValidateBackends() with an uncovered route region = %v", err)
+	}
+
+	cfg.Backends = append(cfg.Backends, Backend{Project: "p2", Region: "europe-west1"})
+	if err := cfg.ValidateBackends(); err != nil {
+		t.Errorf("ValidateBackends() with a covering pool = %v", err)
+	}
+
+	cfg.Backends = nil
+	cfg.VertexAIProjectID = "default"
+	if err := cfg.ValidateBackends(); err != nil {
+		t.Errorf("ValidateBackends() with VERTEX_AI_PROJECT_ID = %v", err)
+	}
+}
@@ -1,25 +1,115 @@
 package config
 
 import (
-	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
+
+	"vertexai-anthropic-proxy/redact"
+	"vertexai-anthropic-proxy/utils"
+)
+
+// Ways of reaching Vertex AI (VERTEX_MODE)
+const (
+	// VertexLive sends requests to Vertex AI
+	VertexLive = "live"
+	// VertexRecord sends requests to Vertex AI and records the responses
+	// in the fixtures file
+	VertexRecord = "record"
+	// VertexReplay answers from the fixtures file, without network access
+	// or Google credentials
+	VertexReplay = "replay"
 )
 
 type Config struct {
 	VertexAIProjectID    string
 	VertexAIRegion       string
+	VertexAIRegions      []Region
 	VertexAIEndpoint     string
 	AnthropicModel       string
 	AnthropicProxyAPIKey string
 	OpenAIProxyAPIKey    string
+	// KeysFile holds the API keys and their policies; without it the two
+	// keys above are used
+	KeysFile    string
+	ModelRoutes ModelRoutes
+
+	// Retries of failed Vertex AI requests; zero values use the defaults
+	// of client.RetryPolicy
+	RetryMaxAttempts    int
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	RetryBudget         time.Duration
+
+	// How long a region that failed is skipped, and how long to wait for
+	// response headers before failing over (0 waits indefinitely)
+	RegionCooldown time.Duration
+	RegionTimeout  time.Duration
+
+	// Backends pools several projects (and credentials) behind the proxy;
+	// empty means VertexAIProjectID in each of VertexAIRegions
+	Backends        []Backend
+	BackendStrategy string
+
+	// Circuit breaker per backend and model; zero values use the defaults
+	// of client.BreakerPolicy
+	BreakerFailureRate  float64
+	BreakerMinRequests  int
+	BreakerWindow       time.Duration
+	BreakerOpenDuration time.Duration
+	BreakerProbes       int
+
+	// Default per-key rate limits per minute; 0 is unlimited
+	RateLimitRequests     int
+	RateLimitInputTokens  int
+	RateLimitOutputTokens int
+
+	// How request and response bodies are logged (LOG_BODIES), and how
+	// much of them in truncated mode
+	LogBodies       redact.BodyMode
+	LogBodyMaxBytes int
+
+	// AdminAPIKey protects the admin endpoints; AdminAddr serves them on a
+	// separate address instead of the main port
+	AdminAPIKey string
+	AdminAddr   string
+
+	// TracesExporter is where spans go: otlp, console or none
+	TracesExporter string
+
+	// UsageLedgerFile records the tokens and cost of every request;
+	// PricesFile adds to or replaces the default price table
+	UsageLedgerFile string
+	PricesFile      string
+	// TeamBudgetsFile holds the budgets shared by the keys of each team
+	TeamBudgetsFile string
+
+	// CaptureFile records whole requests and responses for debugging;
+	// a share of CaptureSampleRate is captured, the file is rotated at
+	// CaptureMaxBytes or every CaptureRotateEvery keeping CaptureMaxFiles
+	// old files, and the JSON fields in CaptureRedactFields
+	// (comma-separated) are left out
+	CaptureFile         string
+	CaptureSampleRate   float64
+	CaptureMaxBytes     int64
+	CaptureRotateEvery  time.Duration
+	CaptureMaxFiles     int
+	CaptureRedactFields string
+
+	// VertexMode is live, record or replay; the last two use the
+	// recordings in VertexFixturesFile, and replay plays streams back at
+	// VertexReplaySpeed times the recorded pace (0 without delays)
+	VertexMode         string
+	VertexFixturesFile string
+	VertexReplaySpeed  float64
 }
 
 func LoadConfig() *Config {
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		utils.GetLogger().Fatal("Error loading .env file")
 	}
 
 	cfg := &Config{
@@ -29,11 +119,159 @@ func LoadConfig() *Config {
 		AnthropicModel:       os.Getenv("MODEL"),
 		AnthropicProxyAPIKey: os.Getenv("ANTHROPIC_PROXY_API_KEY"),
 		OpenAIProxyAPIKey:    os.Getenv("OPENAI_PROXY_API_KEY"),
+		KeysFile:             os.Getenv("API_KEYS_FILE"),
+		AdminAPIKey:          os.Getenv("ADMIN_API_KEY"),
+		AdminAddr:            os.Getenv("ADMIN_ADDR"),
+		TracesExporter:       os.Getenv("OTEL_TRACES_EXPORTER"),
+		UsageLedgerFile:      os.Getenv("USAGE_LEDGER_FILE"),
+		PricesFile:           os.Getenv("PRICES_FILE"),
+		TeamBudgetsFile:      os.Getenv("TEAM_BUDGETS_FILE"),
+		CaptureFile:          os.Getenv("CAPTURE_FILE"),
+		CaptureRedactFields:  os.Getenv("CAPTURE_REDACT_FIELDS"),
+		VertexMode:           os.Getenv("VERTEX_MODE"),
+		VertexFixturesFile:   os.Getenv("VERTEX_FIXTURES_FILE"),
+	}
+
+	if regions := os.Getenv("VERTEX_AI_REGIONS"); regions != "" {
+		cfg.VertexAIRegions, err = ParseRegions(regions)
+		if err != nil {
+			utils.GetLogger().Fatalf("Invalid VERTEX_AI_REGIONS: %v", err)
+		}
+	}
+	if len(cfg.VertexAIRegions) == 0 {
+		cfg.VertexAIRegions = []Region{{Name: cfg.VertexAIRegion}}
+	} else if cfg.VertexAIRegion == "" {
+		cfg.VertexAIRegion = cfg.VertexAIRegions[0].Name
+	}
+	if path := os.Getenv("VERTEX_BACKENDS_FILE"); path != "" {
+		cfg.Backends, err = LoadBackends(path)
+		if err != nil {
+			utils.GetLogger().Fatalf("Error loading backends: %v", err)
+		}
+	}
+	cfg.BackendStrategy = os.Getenv("VERTEX_BACKEND_STRATEGY")
+	if cfg.BackendStrategy == "" {
+		cfg.BackendStrategy = StrategyOrdered
+	}
+	if !ValidStrategy(cfg.BackendStrategy) {
+		utils.GetLogger().Fatalf("Invalid VERTEX_BACKEND_STRATEGY: %s", cfg.BackendStrategy)
+	}
+	switch cfg.VertexMode {
+	case "":
+		cfg.VertexMode = VertexLive
+	case VertexLive:
+	case VertexRecord, VertexReplay:
+		if cfg.VertexFixturesFile == "" {
+			utils.GetLogger().Fatalf("VERTEX_MODE=%s needs VERTEX_FIXTURES_FILE", cfg.VertexMode)
+		}
+	default:
+		utils.GetLogger().Fatalf("Invalid VERTEX_MODE: %s (want live, record or replay)", cfg.VertexMode)
+	}
+	cfg.VertexReplaySpeed = 1
+	if os.Getenv("VERTEX_REPLAY_SPEED") != "" {
+		cfg.VertexReplaySpeed = envFloat("VERTEX_REPLAY_SPEED")
+	}
+	cfg.RegionCooldown = envDuration("VERTEX_REGION_COOLDOWN")
+	cfg.RegionTimeout = envDuration("VERTEX_REGION_TIMEOUT")
+
+	cfg.RetryMaxAttempts = envInt("VERTEX_RETRY_MAX_ATTEMPTS")
+	cfg.RetryInitialBackoff = envDuration("VERTEX_RETRY_INITIAL_BACKOFF")
+	cfg.RetryMaxBackoff = envDuration("VERTEX_RETRY_MAX_BACKOFF")
+	cfg.RetryBudget = envDuration("VERTEX_RETRY_BUDGET")
+
+	cfg.BreakerFailureRate = envFloat("VERTEX_BREAKER_FAILURE_RATE")
+	cfg.BreakerMinRequests = envInt("VERTEX_BREAKER_MIN_REQUESTS")
+	cfg.BreakerWindow = envDuration("VERTEX_BREAKER_WINDOW")
+	cfg.BreakerOpenDuration = envDuration("VERTEX_BREAKER_OPEN_DURATION")
+	cfg.BreakerProbes = envInt("VERTEX_BREAKER_PROBES")
+
+	cfg.RateLimitRequests = envInt("RATE_LIMIT_REQUESTS_PER_MINUTE")
+	cfg.RateLimitInputTokens = envInt("RATE_LIMIT_INPUT_TOKENS_PER_MINUTE")
+	cfg.RateLimitOutputTokens = envInt("RATE_LIMIT_OUTPUT_TOKENS_PER_MINUTE")
+
+	cfg.LogBodies, err = redact.ParseBodyMode(os.Getenv("LOG_BODIES"))
+	if err != nil {
+		utils.GetLogger().Fatalf("Invalid LOG_BODIES: %v", err)
+	}
+	cfg.LogBodyMaxBytes = envInt("LOG_BODY_MAX_BYTES")
+
+	cfg.CaptureSampleRate = 1
+	if os.Getenv("CAPTURE_SAMPLE_RATE") != "" {
+		cfg.CaptureSampleRate = envFloat("CAPTURE_SAMPLE_RATE")
+	}
+	cfg.CaptureMaxBytes = int64(envInt("CAPTURE_MAX_BYTES"))
+	cfg.CaptureRotateEvery = envDuration("CAPTURE_ROTATE_EVERY")
+	cfg.CaptureMaxFiles = 10
+	if os.Getenv("CAPTURE_MAX_FILES") != "" {
+		cfg.CaptureMaxFiles = envInt("CAPTURE_MAX_FILES")
 	}
 
 	if cfg.VertexAIEndpoint == "" {
-		log.Fatal("VERTEX_AI_ENDPOINT is not set in the environment")
+		utils.GetLogger().Fatal("VERTEX_AI_ENDPOINT is not set in the environment")
+	}
+
+	if path := os.Getenv("MODEL_ROUTES_FILE"); path != "" {
+		cfg.ModelRoutes, err = LoadModelRoutes(path)
+		if err != nil {
+			utils.GetLogger().Fatalf("Error loading model routes: %v", err)
+		}
+	} else {
+		cfg.ModelRoutes = DefaultModelRoutes()
+	}
+	// Keep clients that send the configured MODEL working
+	if cfg.AnthropicModel != "" {
+		if _, ok := cfg.ModelRoutes[cfg.AnthropicModel]; !ok {
+			cfg.ModelRoutes.AddVertexModelID(cfg.AnthropicModel)
+		}
+	}
+	if err := cfg.ValidateBackends(); err != nil {
+		utils.GetLogger().Fatalf("Invalid backends: %v", err)
 	}
 
 	return cfg
-}
\ No newline at end of file
+}
+
+// Bodies returns how request and response bodies may be logged.
+func (c *Config) Bodies() redact.Bodies {
+	return redact.Bodies{Mode: c.LogBodies, MaxBytes: c.LogBodyMaxBytes}
+}
+
+// envInt reads an optional integer setting, returning 0 if it is unset.
+func envInt(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		utils.GetLogger().Fatalf("Invalid %s: %v", name, err)
+	}
+	return n
+}
+
+// envFloat reads an optional number setting, returning 0 if it is unset.
+func envFloat(name string) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		utils.GetLogger().Fatalf("Invalid %s: %v", name, err)
+	}
+	return f
+}
+
+// envDuration reads an optional duration setting such as "500ms" or "30s",
+// returning 0 if it is unset.
+func envDuration(name string) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		utils.GetLogger().Fatalf("Invalid %s: %v", name, err)
+	}
+	return d
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrUnknownModel = errors.New("unknown model")
+
+// ModelRoute identifies the Vertex AI publisher model that serves a
+// client-visible model name.
+type ModelRoute struct {
+	Model   string `json:"model"`
+	Version string `json:"version,omitempty"`
+	// Regions overrides VERTEX_AI_REGIONS for this model
+	Regions []Region `json:"regions,omitempty"`
+}
+
+// VertexModelID returns the model ID used in Vertex AI URLs, e.g.
+// claude-3-5-sonnet@20240620.
+func (r ModelRoute) VertexModelID() string {
+	if r.Version == "" {
+		return r.Model
+	}
+	return r.Model + "@" + r.Version
+}
+
+// ModelRoutes maps the model names clients send, including OpenAI names
+// such as gpt-4o, to Vertex AI models.
+type ModelRoutes map[string]ModelRoute
+
+func (mr ModelRoutes) Resolve(name string) (ModelRoute, error) {
+	route, ok := mr[name]
+	if !ok {
+		return ModelRoute{}, fmt.Errorf("%w: %s", ErrUnknownModel, name)
+	}
+	return route, nil
+}
+
+// AddVertexModelID registers a route for a Vertex model ID such as
+// claude-3-5-sonnet@20240620 under that same name.
+func (mr ModelRoutes) AddVertexModelID(id string) {
+	model, version, _ := strings.Cut(id, "@")
+	mr[id] = ModelRoute{Model: model, Version: version}
+}
+
+func DefaultModelRoutes() ModelRoutes {
+	routes := ModelRoutes{}
+
+	// Each model is reachable by its Vertex ID, its Anthropic API name and
+	// any short aliases
+	models := []struct {
+		vertexID string
+		aliases  []string
+	}{
+		{"claude-3-5-sonnet@20240620", []string{"claude-3-5-sonnet-20240620", "claude-3.5-sonnet-20240620", "claude-3-5-sonnet", "claude-3.5-sonnet"}},
+		{"claude-3-5-sonnet-v2@20241022", []string{"claude-3-5-sonnet-20241022", "claude-3-5-sonnet-latest"}},
+		{"claude-3-5-haiku@20241022", []string{"claude-3-5-haiku-20241022", "claude-3-5-haiku", "claude-3-5-haiku-latest"}},
+		{"claude-3-opus@20240229", []string{"claude-3-opus-20240229", "claude-3-opus", "claude-3-opus-latest"}},
+		{"claude-3-haiku@20240307", []string{"claude-3-haiku-20240307", "claude-3-haiku"}},
+		{"claude-3-7-sonnet@20250219", []string{"claude-3-7-sonnet-20250219", "claude-3-7-sonnet", "claude-3-7-sonnet-latest"}},
+		{"claude-sonnet-4@20250514", []string{"claude-sonnet-4-20250514", "claude-sonnet-4-0"}},
+		{"claude-opus-4@20250514", []string{"claude-opus-4-20250514", "claude-opus-4-0"}},
+	}
+	for _, m := range models {
+		routes.AddVertexModelID(m.vertexID)
+		for _, alias := range m.aliases {
+			routes[alias] = routes[m.vertexID]
+		}
+	}
+
+	// OpenAI model names used by /v1/chat/completions clients
+	routes["gpt-4o"] = routes["claude-3-5-sonnet-v2@20241022"]
+	routes["gpt-4"] = routes["claude-3-5-sonnet-v2@20241022"]
+	routes["gpt-4o-mini"] = routes["claude-3-5-haiku@20241022"]
+	routes["gpt-3.5-turbo"] = routes["claude-3-5-haiku@20241022"]
+
+	return routes
+}
+
+// LoadModelRoutes reads a routing table from a JSON file of the form
+// {"gpt-4o": {"model": "claude-3-5-sonnet-v2", "version": "20241022"}}.
+// A route may also list "regions", either as names or as
+// {"name": "us-east5", "weight": 3} objects.
+func LoadModelRoutes(path string) (ModelRoutes, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes ModelRoutes
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for name, route := range routes {
+		if route.Model == "" {
+			return nil, fmt.Errorf("%s: route %q has no model", path, name)
+		}
+	}
+	return routes, nil
+}
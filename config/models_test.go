@@ -0,0 +1,60 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultModelRoutes(t *testing.T) {
+	routes := DefaultModelRoutes()
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"claude-3-5-sonnet", "claude-3-5-sonnet@20240620"},
+		{"claude-3.5-sonnet-20240620", "claude-3-5-sonnet@20240620"},
+		{"claude-3-5-sonnet-v2@20241022", "claude-3-5-sonnet-v2@20241022"},
+		{"claude-3-5-haiku-20241022", "claude-3-5-haiku@20241022"},
+		{"gpt-4o", "claude-3-5-sonnet-v2@20241022"},
+	}
+	for _, tt := range tests {
+		route, err := routes.Resolve(tt.name)
+		if err != nil {
+			t.Errorf("Resolve(%q) error = %v", tt.name, err)
+			continue
+		}
+		if got := route.VertexModelID(); got != tt.want {
+			t.Errorf("Resolve(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := routes.Resolve("claude-v1"); !errors.Is(err, ErrUnknownModel) {
+		t.Errorf("Resolve(claude-v1) error = %v, want ErrUnknownModel", err)
+	}
+}
+
+func TestLoadModelRoutes(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "routes.json")
+	os.WriteFile(path, []byte(`{"gpt-4o": {"model": "claude-3-5-sonnet-v2", "version": "20241022"}, "tuned": {"model": "my-claude"}}`), 0o600)
+	routes, err := LoadModelRoutes(path)
+	if err != nil {
+		t.Fatalf("LoadModelRoutes() error = %v", err)
+	}
+	if got := routes["gpt-4o"].VertexModelID(); got != "claude-3-5-sonnet-v2@20241022" {
+		t.Errorf("gpt-4o = %s", got)
+	}
+	if got := routes["tuned"].VertexModelID(); got != "my-claude" {
+		t.Errorf("tuned = %s", got)
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(bad, []byte(`{"gpt-4o": {"version": "20241022"}}`), 0o600)
+	if _, err := LoadModelRoutes(bad); err == nil {
+		t.Error("LoadModelRoutes() expected error for route without model")
+	}
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Region is a Vertex AI location that can serve a model. Weight is used to
+// spread traffic when several regions are listed; when no region has a
+// weight, the list order is the failover order.
+type Region struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// UnmarshalJSON accepts either a bare region name or an object with a name
+// and weight.
+func (r *Region) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*r = Region{Name: name}
+		return nil
+	}
+
+	type plain Region
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	if p.Name == "" {
+		return fmt.Errorf("region has no name")
+	}
+	if p.Weight < 0 {
+		return fmt.Errorf("region %s: negative weight", p.Name)
+	}
+	*r = Region(p)
+	return nil
+}
+
+// ParseRegions parses a comma-separated region list such as
+// "us-east5,europe-west1" or, with weights, "us-east5=3,europe-west1=1".
+func ParseRegions(s string) ([]Region, error) {
+	var regions []Region
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, weight, hasWeight := strings.Cut(item, "=")
+		region := Region{Name: strings.TrimSpace(name)}
+		if hasWeight {
+			w, err := strconv.Atoi(strings.TrimSpace(weight))
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("region %s: invalid weight %q", region.Name, weight)
+			}
+			region.Weight = w
+		}
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
+
+// RegionsFor returns the regions to send requests for route to: the route's
+// own list if it has one, otherwise the configured default list.
+func (c *Config) RegionsFor(route ModelRoute) []Region {
+	if len(route.Regions) > 0 {
+		return route.Regions
+	}
+	if len(c.VertexAIRegions) > 0 {
+		return c.VertexAIRegions
+	}
+	return []Region{{Name: c.VertexAIRegion}}
+}
+
+// EndpointFor returns the Vertex AI base URL for a region. VERTEX_AI_ENDPOINT
+// is used for the primary region, or for every region if it contains a
+// "{region}" placeholder; other regions use their regional endpoint.
+func (c *Config) EndpointFor(region string) string {
+	if strings.Contains(c.VertexAIEndpoint, "{region}") {
+		return strings.ReplaceAll(c.VertexAIEndpoint, "{region}", region)
+	}
+	if region == c.VertexAIRegion && c.VertexAIEndpoint != "" {
+		return c.VertexAIEndpoint
+	}
+	if region == "global" {
+		return "https://aiplatform.googleapis.com"
+	}
+	return fmt.Sprintf("https://%s-aiplatform.googleapis.com", region)
+}
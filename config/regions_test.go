@@ -0,0 +1,74 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseRegions(t *testing.T) {
+	got, err := ParseRegions("us-east5, europe-west1=2,,asia-southeast1=0")
+	if err != nil {
+		t.Fatalf("ParseRegions() error = %v", err)
+	}
+	want := []Region{{Name: "us-east5"}, {Name: "europe-west1", Weight: 2}, {Name: "asia-southeast1"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseRegions() = %v, want %v", got, want)
+	}
+
+	if _, err := ParseRegions("us-east5=heavy"); err == nil {
+		t.Error("ParseRegions() with a bad weight should fail")
+	}
+}
+
+func TestRouteRegionsJSON(t *testing.T) {
+	var route ModelRoute
+	data := `{"model": "claude-3-5-sonnet-v2", "version": "20241022", "regions": ["us-east5", {"name": "europe-west1", "weight": 3}]}`
+	if err := json.Unmarshal([]byte(data), &route); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	want := []Region{{Name: "us-east5"}, {Name: "europe-west1", Weight: 3}}
+	if !reflect.DeepEqual(route.Regions, want) {
+		t.Errorf("Regions = %v, want %v", route.Regions, want)
+	}
+
+	if err := json.Unmarshal([]byte(`{"model": "m", "regions": [{"weight": 1}]}`), &route); err == nil {
+		t.Error("a region without a name should be rejected")
+	}
+}
+
+func TestRegionsFor(t *testing.T) {
+	cfg := &Config{VertexAIRegion: "us-east5"}
+	if got := cfg.RegionsFor(ModelRoute{}); !reflect.DeepEqual(got, []Region{{Name: "us-east5"}}) {
+		t.Errorf("RegionsFor() = %v", got)
+	}
+
+	cfg.VertexAIRegions = []Region{{Name: "us-east5"}, {Name: "europe-west1"}}
+	if got := cfg.RegionsFor(ModelRoute{}); !reflect.DeepEqual(got, cfg.VertexAIRegions) {
+		t.Errorf("RegionsFor() = %v", got)
+	}
+
+	route := ModelRoute{Regions: []Region{{Name: "asia-southeast1"}}}
+	if got := cfg.RegionsFor(route); !reflect.DeepEqual(got, route.Regions) {
+		t.Errorf("RegionsFor(route) = %v", got)
+	}
+}
+
+func TestEndpointFor(t *testing.T) {
+	cfg := &Config{VertexAIRegion: "us-east5", VertexAIEndpoint: "https://us-east5-aiplatform.googleapis.com"}
+	tests := map[string]string{
+		"us-east5":     "https://us-east5-aiplatform.googleapis.com",
+		"europe-west1": "https://europe-west1-aiplatform.googleapis.com",
+		"global":       "https://aiplatform.googleapis.com",
+	}
+	for region, want := range tests {
+		if got := cfg.EndpointFor(region); got != want {
+			t.Errorf("EndpointFor(%s) = %s, want %s", region, got, want)
+		}
+	}
+
+	cfg.VertexAIEndpoint = "https://{region}-vertex.example.com"
+	if got := cfg.EndpointFor("europe-west1"); got != "https://europe-west1-vertex.example.com" {
+		t.Errorf("EndpointFor with placeholder = %s", got)
+	}
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"vertexai-anthropic-proxy/client"
+	"vertexai-anthropic-proxy/metrics"
+	"vertexai-anthropic-proxy/usage"
+	"vertexai-anthropic-proxy/utils"
+)
+
+// CredentialsRefresher reloads the Google credentials.
+type CredentialsRefresher interface {
+	RefreshCredentials(ctx context.Context) error
+}
+
+// AdminBackend is what the admin endpoints manage.
+type AdminBackend interface {
+	CredentialsRefresher
+	CircuitBreakers
+}
+
+// NewAdminRouter returns a router with every admin endpoint. The caller
+// puts it behind the admin key, on the main server or on ADMIN_ADDR; admin
+// APIs added later belong here so they are protected the same way.
+func NewAdminRouter(backend AdminBackend, ledger UsageLedger) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/set-log-level", HandleSetLogLevel)
+	mux.HandleFunc("/refresh-credentials", HandleRefreshCredentials(backend))
+	mux.HandleFunc("/admin/circuit-breakers", HandleCircuitBreakers(backend))
+	mux.HandleFunc("/admin/usage", HandleUsage(ledger))
+	// Metrics are labelled with key IDs, so they are not public either
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
+}
+
+// CircuitBreakers reports the circuit breaker of each backend and model.
+type CircuitBreakers interface {
+	CircuitBreakers() []client.BreakerState
+}
+
+// HandleCircuitBreakers lists the circuit breakers and whether they are
+// closed, open or half-open.
+func HandleCircuitBreakers(breakers CircuitBreakers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{"breakers": breakers.CircuitBreakers()})
+	}
+}
+
+// UsageLedger summarises the usage recorded by the proxy.
+type UsageLedger interface {
+	Summarize(q usage.Query) ([]usage.Summary, usage.Summary, error)
+}
+
+// HandleUsage adds up the usage ledger. The query parameters are
+// group_by (a comma-separated list of key, model and day; all three by
+// default), from and to (days such as 2024-07-01, both included), key and
+// model (a Vertex AI model ID).
+func HandleUsage(ledger UsageLedger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		params := r.URL.Query()
+		q := usage.Query{
+			Key:     params.Get("key"),
+			Model:   params.Get("model"),
+			GroupBy: []string{usage.GroupKey, usage.GroupModel, usage.GroupDay},
+		}
+		if groupBy := params.Get("group_by"); groupBy != "" {
+			q.GroupBy = strings.Split(groupBy, ",")
+		}
+		for _, g := range q.GroupBy {
+			if !usage.ValidGroup(g) {
+				utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid group_by %q: want key, model or day", g))
+				return
+			}
+		}
+		if from := params.Get("from"); from != "" {
+			day, err := usage.ParseDay(from)
+			if err != nil {
+				utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid from: %v", err))
+				return
+			}
+			q.From = day
+		}
+		if to := params.Get("to"); to != "" {
+			day, err := usage.ParseDay(to)
+			if err != nil {
+				utils.RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid to: %v", err))
+				return
+			}
+			q.To = day.AddDate(0, 0, 1)
+		}
+
+		summaries, total, err := ledger.Summarize(q)
+		if errors.Is(err, usage.ErrNoLedger) {
+			utils.RespondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			utils.GetLogger().Errorf("Error summarizing usage: %v", err)
+			utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error summarizing usage: %v", err))
+			return
+		}
+		utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{"usage": summaries, "total": total})
+	}
+}
@@ -1,40 +1,34 @@
 package handlers
 
 import (
+    "context"
     "encoding/json"
+    "errors"
     "fmt"
     "io"
     "net/http"
+    "vertexai-anthropic-proxy/apierror"
+    "vertexai-anthropic-proxy/budget"
     "vertexai-anthropic-proxy/config"
+    "vertexai-anthropic-proxy/keystore"
+    "vertexai-anthropic-proxy/metrics"
+    "vertexai-anthropic-proxy/ratelimit"
+    "vertexai-anthropic-proxy/sse"
+    "vertexai-anthropic-proxy/tracing"
     "vertexai-anthropic-proxy/translation"
-    "vertexai-anthropic-proxy/client"
+    "vertexai-anthropic-proxy/usage"
     "vertexai-anthropic-proxy/utils"
-    "bufio"
-    "strings"
 )
 
-type ContentItem struct {
-    Type string `json:"type"`
-    Text string `json:"text"`
+// VertexAI is the Vertex AI client the handlers send requests with. It is
+// implemented by *client.VertexClient; tests substitute a fake.
+type VertexAI interface {
+    SendToVertexAI(ctx context.Context, route config.ModelRoute, req *translation.VertexAIRequest) (io.ReadCloser, error)
+    SendToVertexAIStream(ctx context.Context, route config.ModelRoute, req *translation.VertexAIRequest, events chan<- translation.StreamEvent) error
+    RefreshCredentials(ctx context.Context) error
 }
 
-type AnthropicResponse struct {
-    ID            string        `json:"id"`
-    Type          string        `json:"type"`
-    Role          string        `json:"role"`
-    Model         string        `json:"model"`
-    Content       []ContentItem `json:"content"`
-    StopReason    string        `json:"stop_reason"`
-    StopSequence  interface{}   `json:"stop_sequence"`
-    Usage         Usage         `json:"usage"`
-}
-
-type Usage struct {
-    InputTokens  int `json:"input_tokens"`
-    OutputTokens int `json:"output_tokens"`
-}
-
-func HandleMessages(cfg *config.Config) http.HandlerFunc {
+func HandleMessages(cfg *config.Config, vertex VertexAI) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         logger := utils.GetLogger()
 
@@ -44,71 +38,196 @@ func HandleMessages(cfg *config.Config) http.HandlerFunc {
         body, err := io.ReadAll(r.Body)
         if err != nil {
             logger.Errorf("Error reading request body: %v", err)
-            http.Error(w, "Error reading request", http.StatusBadRequest)
+            apierror.WriteAnthropic(w, apierror.New(http.StatusBadRequest, "Error reading request"))
             return
         }
         defer r.Body.Close()
 
-        logger.Infof("Request body: %s", string(body))
+        if logged, ok := cfg.Bodies().Render(body); ok {
+            logger.Infof("Request body: %s", logged)
+        }
 
         // Parse the Anthropic request
         var anthropicReq translation.AnthropicRequest
         if err := json.Unmarshal(body, &anthropicReq); err != nil {
             logger.Errorf("Error parsing request: %v", err)
-            http.Error(w, "Error parsing request", http.StatusBadRequest)
+            apierror.WriteAnthropic(w, apierror.New(http.StatusBadRequest, "Error parsing request: %v", err))
             return
         }
 
         logger.Info("Parsed Anthropic request successfully")
 
+        route, err := cfg.ModelRoutes.Resolve(anthropicReq.Model)
+        if err != nil {
+            logger.Warnf("Rejecting request: %v", err)
+            apierror.WriteAnthropic(w, apierror.New(http.StatusNotFound, "model: %s", anthropicReq.Model))
+            return
+        }
+        trackModel(r, anthropicReq.Model, route)
+
         // Translate Anthropic request to Vertex AI request
+        _, span := tracing.Start(r.Context(), "AnthropicToVertexAI")
         vertexAIReq, err := translation.AnthropicToVertexAI(anthropicReq)
+        if err != nil {
+            tracing.Fail(span, err)
+        }
+        span.End()
         if err != nil {
             logger.Errorf("Error translating Anthropic request to Vertex AI: %v", err)
-            http.Error(w, "Error processing request", http.StatusInternalServerError)
+            apierror.WriteAnthropic(w, apierror.New(http.StatusBadRequest, "%v", err))
             return
         }
 
-        logger.Info("Translated request to Vertex AI format")
+        if apiErr := authorizeRequest(r, anthropicReq.Model, route, vertexAIReq.MaxTokens); apiErr != nil {
+            logger.Warnf("Rejecting request: %v", apiErr)
+            apierror.WriteAnthropic(w, apiErr)
+            return
+        }
 
-        // Set headers for SSE
-        w.Header().Set("Content-Type", "text/event-stream")
-        w.Header().Set("Cache-Control", "no-cache")
-        w.Header().Set("Connection", "keep-alive")
+        logger.Info("Translated request to Vertex AI format")
 
-        // Send request to Vertex AI
-        responseStream, err := client.SendToVertexAI(cfg, &vertexAIReq)
+        // Send request to Vertex AI. Using the request context means the
+        // upstream request is cancelled if the client disconnects.
+        responseStream, err := vertex.SendToVertexAI(r.Context(), route, &vertexAIReq)
         if err != nil {
             logger.Errorf("Error sending request to Vertex AI: %v", err)
-            http.Error(w, "Error processing request", http.StatusInternalServerError)
+            apierror.WriteAnthropic(w, apierror.FromUpstream(err))
             return
         }
         defer responseStream.Close()
 
         logger.Info("Received response from Vertex AI")
 
-        // Process the SSE stream
-        scanner := bufio.NewScanner(responseStream)
-        for scanner.Scan() {
-            line := scanner.Text()
-            if strings.HasPrefix(line, "data: ") {
-                data := strings.TrimPrefix(line, "data: ")
-                if data == "[DONE]" {
-                    break
-                }
-                fmt.Fprintf(w, "data: %s\n\n", data)
-                w.(http.Flusher).Flush()
-            }
+        if !anthropicReq.Stream {
+            usage := writeMessageResponse(w, responseStream, anthropicReq.Model)
+            recordUsage(r, usage)
+            return
         }
 
-        if err := scanner.Err(); err != nil {
-            logger.Errorf("Error reading response: %v", err)
+        events, usage, err := relayEvents(w, sse.NewReader(responseStream), newTokenTimer(r.Context()))
+        recordUsage(r, usage)
+        if err != nil {
+            if r.Context().Err() != nil {
+                logger.Warnf("Client disconnected, cancelled upstream request: %v", err)
+                return
+            }
+            logger.Errorf("Error relaying response: %v", err)
+            apiErr := apierror.New(http.StatusInternalServerError, "Error reading response from Vertex AI")
+            if events == nil {
+                // Nothing has been sent yet, so the error can still be plain JSON
+                apierror.WriteAnthropic(w, apiErr)
+                return
+            }
+            // Headers are already sent, so report the failure in-stream
+            apierror.WriteAnthropicEvent(events, apiErr)
         }
 
         logger.Info("Finished sending response to client")
     }
 }
 
+// authorizeRequest checks the model and max_tokens of a request against the
+// policy of the API key it was authenticated with, if any.
+func authorizeRequest(r *http.Request, model string, route config.ModelRoute, maxTokens int) *apierror.Error {
+    key := keystore.FromContext(r.Context())
+    if key == nil {
+        return nil
+    }
+
+    err := key.Authorize(model, route.VertexModelID(), maxTokens)
+    switch {
+    case err == nil:
+        return nil
+    case errors.Is(err, keystore.ErrModelNotAllowed):
+        return apierror.New(http.StatusForbidden, "%v", err)
+    default:
+        return apierror.New(http.StatusBadRequest, "%v", err)
+    }
+}
+
+// trackModel labels the request's metrics, usage record and budget charge
+// with the model the client asked for and where it was routed.
+func trackModel(r *http.Request, model string, route config.ModelRoute) {
+    metrics.FromContext(r.Context()).SetModel(model)
+    usage.FromContext(r.Context()).SetModel(model, route.VertexModelID())
+    budget.FromContext(r.Context()).SetModel(route.VertexModelID())
+}
+
+// recordUsage charges the token usage of a request that reached Vertex AI
+// to the API key's rate limits and budgets, and counts it in the metrics
+// and the usage ledger.
+func recordUsage(r *http.Request, u translation.Usage) {
+    metrics.FromContext(r.Context()).Usage(u.InputTokens+u.CacheCreationInputTokens, u.OutputTokens)
+    usage.FromContext(r.Context()).SetUsage(u)
+    budget.FromContext(r.Context()).Settle(u)
+    if reservation := ratelimit.FromContext(r.Context()); reservation != nil {
+        reservation.Settle(u.InputTokens+u.CacheCreationInputTokens, u.OutputTokens)
+    }
+}
+
+// relayEvents copies events from Vertex AI to the client unchanged, keeping
+// event names, pings and error events intact. The SSE writer is only created
+// once the first event has been read, and is nil if nothing was sent. It
+// returns the usage reported by the events relayed so far, and times the
+// content deltas with tokens.
+func relayEvents(w http.ResponseWriter, r *sse.Reader, tokens *tokenTimer) (*sse.Writer, translation.Usage, error) {
+    defer tokens.done()
+
+    var events *sse.Writer
+    var usage translation.Usage
+    for {
+        ev, err := r.Next()
+        if err == io.EOF {
+            if events == nil {
+                events = sse.NewWriter(w)
+            }
+            return events, usage, nil
+        }
+        if err != nil {
+            return events, usage, err
+        }
+        if events == nil {
+            events = sse.NewWriter(w)
+        }
+        if ev.Event == "message_start" || ev.Event == "message_delta" {
+            var event translation.StreamEvent
+            if json.Unmarshal([]byte(ev.Data), &event) == nil {
+                usage.Observe(event)
+            }
+        }
+        if err := events.WriteEvent(ev); err != nil {
+            return events, usage, err
+        }
+        if ev.Event == "content_block_delta" {
+            tokens.delta()
+        }
+    }
+}
+
+// writeMessageResponse converts a rawPredict response into an Anthropic
+// Message object and writes it as JSON. It returns the response's usage.
+func writeMessageResponse(w http.ResponseWriter, responseStream io.Reader, model string) translation.Usage {
+    logger := utils.GetLogger()
+
+    var vertexAIResp translation.VertexAIResponse
+    if err := json.NewDecoder(responseStream).Decode(&vertexAIResp); err != nil {
+        logger.Errorf("Error parsing response: %v", err)
+        apierror.WriteAnthropic(w, apierror.New(http.StatusInternalServerError, "Error processing response"))
+        return translation.Usage{}
+    }
+
+    anthropicResp, err := translation.VertexAIToAnthropic(vertexAIResp, model)
+    if err != nil {
+        logger.Errorf("Error translating Vertex AI response: %v", err)
+        apierror.WriteAnthropic(w, apierror.New(http.StatusInternalServerError, "Error processing response"))
+        return vertexAIResp.Usage
+    }
+
+    utils.RespondWithJSON(w, http.StatusOK, anthropicResp)
+    logger.Info("Finished sending response to client")
+    return vertexAIResp.Usage
+}
+
 func splitResponse(response string, chunks int) []string {
     var result []string
     length := len(response)
@@ -123,29 +242,38 @@ func splitResponse(response string, chunks int) []string {
     return result
 }
 
-func HandleChatCompletions(cfg *config.Config) http.HandlerFunc {
+func HandleChatCompletions(cfg *config.Config, vertex VertexAI) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         if r.Method != http.MethodPost {
-            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            apierror.WriteAnthropic(w, apierror.New(http.StatusMethodNotAllowed, "Method not allowed"))
             return
         }
 
         // For now, we'll use the same logic as HandleMessages
         // In the future, you might want to implement specific chat completion logic
-        HandleMessages(cfg).ServeHTTP(w, r)
+        HandleMessages(cfg, vertex).ServeHTTP(w, r)
     }
 }
 
-func HandleRefreshCredentials(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// HandleRefreshCredentials reloads the Google credentials and fetches a new
+// access token, e.g. after a service account key has been rotated.
+func HandleRefreshCredentials(vertex CredentialsRefresher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	// Since we've removed the RefreshCredentials function, we'll just return a success message.
-	// In a production environment, you might want to implement a different refresh mechanism or remove this endpoint.
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Credentials refresh is not necessary with the current implementation"})
+		logger := utils.GetLogger()
+		if err := vertex.RefreshCredentials(r.Context()); err != nil {
+			logger.Errorf("Error refreshing credentials: %v", err)
+			utils.RespondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error refreshing credentials: %v", err))
+			return
+		}
+
+		logger.Info("Refreshed Google credentials")
+		utils.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Credentials refreshed successfully"})
+	}
 }
 
 func HandleSetLogLevel(w http.ResponseWriter, r *http.Request) {
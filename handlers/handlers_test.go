@@ -2,17 +2,72 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"golang.org/x/oauth2"
+
+	"vertexai-anthropic-proxy/client"
 	"vertexai-anthropic-proxy/config"
+	"vertexai-anthropic-proxy/keystore"
+	"vertexai-anthropic-proxy/ratelimit"
 	"vertexai-anthropic-proxy/translation"
+	"vertexai-anthropic-proxy/usage"
 	"vertexai-anthropic-proxy/utils"
 )
 
+const mockStream = `event: message_start
+data: {"type":"message_start","message":{"id":"msg_01","type":"message","role":"assistant","content":[],"model":"claude-3-5-sonnet","usage":{"input_tokens":10,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: ping
+data: {"type": "ping"}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":0}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn","stop_sequence":null},"usage":{"output_tokens":5}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+// fakeVertex implements VertexAI with canned responses.
+type fakeVertex struct {
+	send    func(ctx context.Context, route config.ModelRoute, req *translation.VertexAIRequest) (io.ReadCloser, error)
+	stream  func(ctx context.Context, route config.ModelRoute, req *translation.VertexAIRequest, events chan<- translation.StreamEvent) error
+	refresh func(ctx context.Context) error
+}
+
+func (f *fakeVertex) SendToVertexAI(ctx context.Context, route config.ModelRoute, req *translation.VertexAIRequest) (io.ReadCloser, error) {
+	return f.send(ctx, route, req)
+}
+
+func (f *fakeVertex) SendToVertexAIStream(ctx context.Context, route config.ModelRoute, req *translation.VertexAIRequest, events chan<- translation.StreamEvent) error {
+	return f.stream(ctx, route, req, events)
+}
+
+func (f *fakeVertex) RefreshCredentials(ctx context.Context) error {
+	return f.refresh(ctx)
+}
+
 func TestHandleMessages(t *testing.T) {
 	// Initialize the logger
 	utils.InitLogger("info")
@@ -23,18 +78,18 @@ func TestHandleMessages(t *testing.T) {
 		VertexAIRegion:       "us-central1",
 		VertexAIEndpoint:     "https://test-endpoint.com",
 		AnthropicProxyAPIKey: "test-api-key",
+		ModelRoutes:          config.DefaultModelRoutes(),
 	}
 
-	// Add this at the beginning of the TestHandleMessages function
-	MockVertexAIClient = func(cfg *config.Config, vertexReq *translation.VertexAIRequest) ([]byte, error) {
-		// This is a mock response. In a real scenario, you'd validate the input and return appropriate responses.
-		return []byte(`{"predictions": [{"content": "This is a mock response from Vertex AI"}]}`), nil
-	}
-
-	// Make sure to reset the mock at the end of the test
-	defer func() {
-		MockVertexAIClient = nil
-	}()
+	var gotRoute config.ModelRoute
+	vertex := &fakeVertex{send: func(ctx context.Context, route config.ModelRoute, vertexReq *translation.VertexAIRequest) (io.ReadCloser, error) {
+		gotRoute = route
+		if vertexReq.Stream {
+			return io.NopCloser(strings.NewReader(mockStream)), nil
+		}
+		// This is a mock rawPredict response
+		return io.NopCloser(strings.NewReader(`{"id":"msg_01","type":"message","role":"assistant","model":"claude-3-5-sonnet@20240620","content":[{"type":"text","text":"This is a mock response from Vertex AI"}],"stop_reason":"end_turn","stop_sequence":null,"usage":{"input_tokens":10,"output_tokens":8}}`)), nil
+	}}
 
 	tests := []struct {
 		name           string
@@ -45,22 +100,27 @@ func TestHandleMessages(t *testing.T) {
 		{
 			name: "Valid request",
 			inputJSON: `{
-				"model": "claude-v1",
+				"model": "claude-3-5-sonnet",
 				"messages": [
 					{"role": "user", "content": "Hello, how are you?"}
 				],
 				"max_tokens": 100
 			}`,
 			expectedStatus: http.StatusOK,
-			expectedBody:   `{"content":"This is a mock response from Vertex AI"}`,
+			expectedBody:   `{"id":"msg_01","type":"message","role":"assistant","model":"claude-3-5-sonnet","content":[{"type":"text","text":"This is a mock response from Vertex AI"}],"stop_reason":"end_turn","stop_sequence":null,"usage":{"input_tokens":10,"output_tokens":8}}`,
 		},
 		{
 			name:           "Invalid JSON",
 			inputJSON:      `{"invalid": "json"`,
 			expectedStatus: http.StatusBadRequest,
-			expectedBody:   "Error parsing request body",
+			expectedBody:   "Error parsing request",
+		},
+		{
+			name:           "Unknown model",
+			inputJSON:      `{"model": "claude-v1", "messages": [{"role": "user", "content": "Hi"}], "max_tokens": 100}`,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "model: claude-v1",
 		},
-		// Add more test cases here
 	}
 
 	for _, tt := range tests {
@@ -75,7 +135,7 @@ func TestHandleMessages(t *testing.T) {
 			rr := httptest.NewRecorder()
 
 			// Call the handler function
-			handler := HandleMessages(mockConfig)
+			handler := HandleMessages(mockConfig, vertex)
 			handler.ServeHTTP(rr, req)
 
 			// Check the status code
@@ -92,6 +152,12 @@ func TestHandleMessages(t *testing.T) {
 				if !jsonEqual(got, want) {
 					t.Errorf("handler returned unexpected body: got %v want %v", got, want)
 				}
+				if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+					t.Errorf("Content-Type = %q, want application/json", ct)
+				}
+				if gotRoute.VertexModelID() != "claude-3-5-sonnet@20240620" {
+					t.Errorf("routed to %s", gotRoute.VertexModelID())
+				}
 			} else {
 				// For error cases, just check if the expected message is contained in the response
 				if !strings.Contains(rr.Body.String(), tt.expectedBody) {
@@ -102,6 +168,485 @@ func TestHandleMessages(t *testing.T) {
 	}
 }
 
+func TestHandleMessagesStreaming(t *testing.T) {
+	utils.InitLogger("info")
+
+	mockConfig := &config.Config{ModelRoutes: config.DefaultModelRoutes()}
+	vertex := &fakeVertex{send: func(ctx context.Context, route config.ModelRoute, vertexReq *translation.VertexAIRequest) (io.ReadCloser, error) {
+		if !vertexReq.Stream {
+			t.Errorf("expected a streaming Vertex AI request")
+		}
+		return io.NopCloser(strings.NewReader(mockStream)), nil
+	}}
+
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "claude-3-5-sonnet", "stream": true, "max_tokens": 100, "messages": [{"role": "user", "content": "Hi"}]}`))
+	rr := httptest.NewRecorder()
+	HandleMessages(mockConfig, vertex).ServeHTTP(rr, req)
+
+	if ct := rr.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+	if rr.Body.String() != mockStream {
+		t.Errorf("stream was not relayed verbatim:\n%s", rr.Body.String())
+	}
+}
+
+func TestHandleMessagesStreamRetry(t *testing.T) {
+	utils.InitLogger("info")
+	const overloaded = "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n"
+
+	for _, tt := range []struct {
+		name     string
+		attempts int
+		want     string
+	}{
+		{name: "Error before first event is retried", attempts: 3, want: mockStream},
+		{name: "Retries exhausted", attempts: 1, want: ": keep-alive\n\n" + overloaded},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.Header().Set("Content-Type", "text/event-stream")
+				if calls == 1 {
+					io.WriteString(w, ": keep-alive\n\n"+overloaded)
+					return
+				}
+				io.WriteString(w, mockStream)
+			}))
+			defer server.Close()
+
+			cfg := &config.Config{
+				ModelRoutes:         config.DefaultModelRoutes(),
+				VertexAIProjectID:   "test-project",
+				VertexAIRegion:      "us-east5",
+				VertexAIEndpoint:    server.URL,
+				RetryMaxAttempts:    tt.attempts,
+				RetryInitialBackoff: time.Millisecond,
+			}
+			vertex, err := client.NewVertexClient(context.Background(), cfg, func(ctx context.Context, credentialsFile string) (oauth2.TokenSource, error) {
+				return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token", TokenType: "Bearer"}), nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "claude-3-5-sonnet", "stream": true, "max_tokens": 100, "messages": [{"role": "user", "content": "Hi"}]}`))
+			rr := httptest.NewRecorder()
+			HandleMessages(cfg, vertex).ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK || rr.Body.String() != tt.want {
+				t.Errorf("response = %d:\n%s\nwant:\n%s", rr.Code, rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleMessagesUpstreamError(t *testing.T) {
+	utils.InitLogger("info")
+
+	mockConfig := &config.Config{ModelRoutes: config.DefaultModelRoutes()}
+	vertex := &fakeVertex{send: func(ctx context.Context, route config.ModelRoute, vertexReq *translation.VertexAIRequest) (io.ReadCloser, error) {
+		return nil, &client.VertexError{StatusCode: 429, Body: []byte(`{"error":{"code":429,"message":"Quota exceeded","status":"RESOURCE_EXHAUSTED"}}`)}
+	}}
+
+	for _, stream := range []bool{false, true} {
+		body := fmt.Sprintf(`{"model": "claude-3-5-sonnet", "stream": %t, "max_tokens": 100, "messages": [{"role": "user", "content": "Hi"}]}`, stream)
+		rr := httptest.NewRecorder()
+		HandleMessages(mockConfig, vertex).ServeHTTP(rr, httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body)))
+
+		if rr.Code != http.StatusTooManyRequests {
+			t.Errorf("stream=%t: status = %d, want 429", stream, rr.Code)
+		}
+		want := `{"type":"error","error":{"type":"rate_limit_error","message":"Quota exceeded"}}`
+		if rr.Body.String() != want {
+			t.Errorf("stream=%t: body = %s, want %s", stream, rr.Body.String(), want)
+		}
+	}
+}
+
+func TestHandleMessagesStreamReadError(t *testing.T) {
+	utils.InitLogger("info")
+
+	mockConfig := &config.Config{ModelRoutes: config.DefaultModelRoutes()}
+	vertex := &fakeVertex{send: func(ctx context.Context, route config.ModelRoute, vertexReq *translation.VertexAIRequest) (io.ReadCloser, error) {
+		return io.NopCloser(iotest.ErrReader(errors.New("connection reset"))), nil
+	}}
+
+	body := `{"model": "claude-3-5-sonnet", "stream": true, "max_tokens": 100, "messages": [{"role": "user", "content": "Hi"}]}`
+	rr := httptest.NewRecorder()
+	HandleMessages(mockConfig, vertex).ServeHTTP(rr, httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body)))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	if cc := rr.Header().Get("Cache-Control"); cc != "" {
+		t.Errorf("Cache-Control = %q, want no stream headers", cc)
+	}
+	want := `{"type":"error","error":{"type":"api_error","message":"Error reading response from Vertex AI"}}`
+	if rr.Body.String() != want {
+		t.Errorf("body = %s, want %s", rr.Body.String(), want)
+	}
+}
+
+func TestHandleOpenAIMessagesErrors(t *testing.T) {
+	utils.InitLogger("info")
+
+	mockConfig := &config.Config{ModelRoutes: config.DefaultModelRoutes()}
+	request := `{"model": "gpt-4o", "stream": true, "messages": [{"role": "user", "content": "Hi"}]}`
+
+	t.Run("Before first chunk", func(t *testing.T) {
+		vertex := &fakeVertex{stream: func(ctx context.Context, route config.ModelRoute, req *translation.VertexAIRequest, events chan<- translation.StreamEvent) error {
+			close(events)
+			return &client.VertexError{StatusCode: 529, Body: []byte(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)}
+		}}
+
+		rr := httptest.NewRecorder()
+		HandleOpenAIMessages(mockConfig, vertex).ServeHTTP(rr, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(request)))
+
+		if rr.Code != 529 {
+			t.Errorf("status = %d, want 529", rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+		if cc := rr.Header().Get("Cache-Control"); cc != "" {
+			t.Errorf("Cache-Control = %q, want no stream headers", cc)
+		}
+		want := `{"error":{"message":"Overloaded","type":"server_error","param":null,"code":"overloaded"}}`
+		if rr.Body.String() != want {
+			t.Errorf("body = %s, want %s", rr.Body.String(), want)
+		}
+	})
+
+	t.Run("Mid-stream", func(t *testing.T) {
+		vertex := &fakeVertex{stream: func(ctx context.Context, route config.ModelRoute, req *translation.VertexAIRequest, events chan<- translation.StreamEvent) error {
+			defer close(events)
+			events <- translation.StreamEvent{Type: "message_start", Message: &translation.VertexAIResponse{ID: "msg_01"}}
+			events <- translation.StreamEvent{Type: "error", Error: &translation.StreamError{Type: "overloaded_error", Message: "Overloaded"}}
+			return nil
+		}}
+
+		rr := httptest.NewRecorder()
+		HandleOpenAIMessages(mockConfig, vertex).ServeHTTP(rr, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(request)))
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("status = %d, want 200", rr.Code)
+		}
+		body := rr.Body.String()
+		if !strings.Contains(body, `"role":"assistant"`) {
+			t.Errorf("role chunk missing:\n%s", body)
+		}
+		if !strings.Contains(body, "data: {\"error\":{\"message\":\"Overloaded\",\"type\":\"server_error\"") {
+			t.Errorf("error chunk missing:\n%s", body)
+		}
+		if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+			t.Errorf("stream not terminated:\n%s", body)
+		}
+	})
+}
+
+// brokenWriter fails every write after the first, like a connection the
+// client has closed.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *brokenWriter) Write(b []byte) (int, error) {
+	w.writes++
+	if w.writes > 1 {
+		return 0, errors.New("broken pipe")
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func (w *brokenWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func TestHandleOpenAIMessagesClientDisconnect(t *testing.T) {
+	utils.InitLogger("info")
+
+	mockConfig := &config.Config{ModelRoutes: config.DefaultModelRoutes()}
+	upstreamErr := make(chan error, 1)
+	vertex := &fakeVertex{stream: func(ctx context.Context, route config.ModelRoute, req *translation.VertexAIRequest, events chan<- translation.StreamEvent) error {
+		defer close(events)
+		events <- translation.StreamEvent{Type: "message_start", Message: &translation.VertexAIResponse{ID: "msg_01"}}
+		// An endless stream that only stops when the request is cancelled
+		for {
+			select {
+			case events <- translation.StreamEvent{Type: "content_block_delta", Delta: &translation.StreamDelta{Type: "text_delta", Text: "more"}}:
+			case <-ctx.Done():
+				upstreamErr <- ctx.Err()
+				return ctx.Err()
+			}
+		}
+	}}
+
+	request := `{"model": "gpt-4o", "stream": true, "messages": [{"role": "user", "content": "Hi"}]}`
+	w := &brokenWriter{ResponseRecorder: httptest.NewRecorder()}
+
+	done := make(chan struct{})
+	go func() {
+		HandleOpenAIMessages(mockConfig, vertex).ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(request)))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return after the client disconnected")
+	}
+	select {
+	case err := <-upstreamErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("upstream error = %v, want context.Canceled", err)
+		}
+	default:
+		t.Error("upstream stream was not cancelled")
+	}
+}
+
+func TestHandleRefreshCredentials(t *testing.T) {
+	utils.InitLogger("info")
+
+	refreshed := 0
+	vertex := &fakeVertex{refresh: func(ctx context.Context) error {
+		refreshed++
+		if refreshed > 1 {
+			return errors.New("could not find default credentials")
+		}
+		return nil
+	}}
+	handler := HandleRefreshCredentials(vertex)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/refresh-credentials", nil))
+	if rr.Code != http.StatusOK || refreshed != 1 {
+		t.Errorf("status = %d, refreshed %d times", rr.Code, refreshed)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/refresh-credentials", nil))
+	if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), "could not find default credentials") {
+		t.Errorf("status = %d, body = %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/refresh-credentials", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want 405", rr.Code)
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	utils.InitLogger("info")
+
+	cfg := &config.Config{ModelRoutes: config.DefaultModelRoutes()}
+	sent := 0
+	vertex := &fakeVertex{send: func(ctx context.Context, route config.ModelRoute, vertexReq *translation.VertexAIRequest) (io.ReadCloser, error) {
+		sent++
+		return io.NopCloser(strings.NewReader(`{"id":"msg_01","type":"message","role":"assistant","content":[],"usage":{"input_tokens":1,"output_tokens":1}}`)), nil
+	}}
+	key := &keystore.Key{ID: "ci", AllowedModels: []string{"claude-3-5-haiku@*"}, MaxTokens: 500}
+
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "Allowed model",
+			handler:    HandleMessages(cfg, vertex),
+			path:       "/v1/messages",
+			body:       `{"model": "claude-3-5-haiku", "messages": [{"role": "user", "content": "Hi"}], "max_tokens": 100}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Model not allowed",
+			handler:    HandleMessages(cfg, vertex),
+			path:       "/v1/messages",
+			body:       `{"model": "claude-3-5-sonnet", "messages": [{"role": "user", "content": "Hi"}], "max_tokens": 100}`,
+			wantStatus: http.StatusForbidden,
+			wantBody:   `"type":"permission_error"`,
+		},
+		{
+			name:       "max_tokens over the ceiling",
+			handler:    HandleMessages(cfg, vertex),
+			path:       "/v1/messages",
+			body:       `{"model": "claude-3-5-haiku", "messages": [{"role": "user", "content": "Hi"}], "max_tokens": 4096}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "max_tokens exceeds the limit",
+		},
+		{
+			// The OpenAI default of 1000 max_tokens also counts
+			name:       "OpenAI default max_tokens",
+			handler:    HandleOpenAIMessages(cfg, vertex),
+			path:       "/v1/chat/completions",
+			body:       `{"model": "gpt-4o-mini", "messages": [{"role": "user", "content": "Hi"}]}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `"type":"invalid_request_error"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent = 0
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req = req.WithContext(keystore.NewContext(req.Context(), key))
+			rr := httptest.NewRecorder()
+			tt.handler(rr, req)
+
+			if rr.Code != tt.wantStatus || !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("got %d %s, want %d containing %s", rr.Code, rr.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if wantSent := map[bool]int{true: 1}[tt.wantStatus == http.StatusOK]; sent != wantSent {
+				t.Errorf("sent %d requests to Vertex AI, want %d", sent, wantSent)
+			}
+		})
+	}
+}
+
+func TestUsageSettlesRateLimit(t *testing.T) {
+	utils.InitLogger("info")
+
+	cfg := &config.Config{ModelRoutes: config.DefaultModelRoutes()}
+	vertex := &fakeVertex{send: func(ctx context.Context, route config.ModelRoute, vertexReq *translation.VertexAIRequest) (io.ReadCloser, error) {
+		if vertexReq.Stream {
+			return io.NopCloser(strings.NewReader(mockStream)), nil
+		}
+		return io.NopCloser(strings.NewReader(`{"id":"msg_01","type":"message","role":"assistant","content":[],"usage":{"input_tokens":10,"output_tokens":8}}`)), nil
+	}}
+	limits := ratelimit.Limits{OutputTokensPerMinute: 4}
+
+	for _, stream := range []bool{false, true} {
+		limiter := ratelimit.New()
+		res := limiter.Reserve("ci", limits, 0)
+
+		body := fmt.Sprintf(`{"model": "claude-3-5-sonnet", "messages": [{"role": "user", "content": "Hi"}], "max_tokens": 100, "stream": %v}`, stream)
+		req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+		req = req.WithContext(ratelimit.NewContext(req.Context(), res.Reservation))
+		HandleMessages(cfg, vertex).ServeHTTP(httptest.NewRecorder(), req)
+
+		// The output tokens were charged, leaving the bucket in debt
+		if next := limiter.Reserve("ci", limits, 0); next.Allowed || next.Exceeded != ratelimit.OutputTokens {
+			t.Errorf("stream=%v: next request %+v, want output-tokens exceeded", stream, next)
+		}
+	}
+}
+
+type fakeBreakers []client.BreakerState
+
+func (f fakeBreakers) CircuitBreakers() []client.BreakerState { return f }
+
+func TestHandleCircuitBreakers(t *testing.T) {
+	handler := HandleCircuitBreakers(fakeBreakers{
+		{Backend: "p/us-east5", Project: "p", Region: "us-east5", Model: "claude-3-5-sonnet@20240620", State: client.BreakerOpen, Requests: 10, Failures: 6},
+	})
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/circuit-breakers", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d", rr.Code)
+	}
+	var body struct {
+		Breakers []client.BreakerState `json:"breakers"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %s: %v", rr.Body.String(), err)
+	}
+	if len(body.Breakers) != 1 || body.Breakers[0].State != "open" || body.Breakers[0].Failures != 6 {
+		t.Errorf("breakers = %+v", body.Breakers)
+	}
+}
+
+type fakeAdmin struct {
+	*fakeVertex
+	fakeBreakers
+}
+
+func TestAdminRouter(t *testing.T) {
+	refreshed := false
+	router := NewAdminRouter(fakeAdmin{fakeVertex: &fakeVertex{refresh: func(ctx context.Context) error {
+		refreshed = true
+		return nil
+	}}}, (*usage.Ledger)(nil))
+
+	tests := []struct {
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{"GET", "/admin/circuit-breakers", http.StatusOK},
+		{"POST", "/refresh-credentials", http.StatusOK},
+		{"POST", "/set-log-level", http.StatusBadRequest},
+		{"GET", "/admin/usage", http.StatusNotFound},
+		{"GET", "/metrics", http.StatusOK},
+		{"POST", "/v1/messages", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, nil))
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, rr.Code, tt.wantStatus)
+		}
+	}
+	if !refreshed {
+		t.Error("credentials were not refreshed")
+	}
+}
+
+func TestHandleUsage(t *testing.T) {
+	ledger, err := usage.Open(filepath.Join(t.TempDir(), "usage.jsonl"), usage.DefaultPrices())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+	today := time.Now().UTC().Format("2006-01-02")
+	for _, key := range []string{"ci", "ci", "web"} {
+		entry := ledger.Start("/v1/messages", usage.Account{Key: key})
+		entry.SetModel("claude-3-5-sonnet", "claude-3-5-sonnet@20240620")
+		entry.SetUsage(translation.Usage{InputTokens: 1000, OutputTokens: 100})
+		if err := ledger.Finish(entry, http.StatusOK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := HandleUsage(ledger)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/usage?group_by=key&from="+today+"&to="+today, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var body struct {
+		Usage []usage.Summary `json:"usage"`
+		Total usage.Summary   `json:"total"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %s: %v", rr.Body.String(), err)
+	}
+	if len(body.Usage) != 2 || body.Usage[0].Key != "ci" || body.Usage[0].Requests != 2 || body.Usage[0].Model != "" {
+		t.Errorf("usage = %+v", body.Usage)
+	}
+	if body.Total.Requests != 3 || body.Total.InputTokens != 3000 {
+		t.Errorf("total = %+v", body.Total)
+	}
+
+	for _, query := range []string{"group_by=team", "from=yesterday"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/usage?"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, rr.Code)
+		}
+	}
+}
+
 // Helper function to compare JSON objects
 func jsonEqual(a, b map[string]interface{}) bool {
 	return string(mustMarshalJSON(a)) == string(mustMarshalJSON(b))
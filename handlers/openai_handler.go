@@ -1,17 +1,21 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
-	"vertexai-anthropic-proxy/client"
+	"vertexai-anthropic-proxy/apierror"
 	"vertexai-anthropic-proxy/config"
+	"vertexai-anthropic-proxy/sse"
+	"vertexai-anthropic-proxy/tracing"
 	"vertexai-anthropic-proxy/translation"
 	"vertexai-anthropic-proxy/utils"
+
+	"github.com/google/uuid"
 )
 
-func HandleOpenAIMessages(cfg *config.Config) http.HandlerFunc {
+func HandleOpenAIMessages(cfg *config.Config, vertex VertexAI) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger := utils.GetLogger()
 
@@ -21,69 +25,156 @@ func HandleOpenAIMessages(cfg *config.Config) http.HandlerFunc {
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
 			logger.Errorf("Error reading request body: %v", err)
-			http.Error(w, "Error reading request", http.StatusBadRequest)
+			apierror.WriteOpenAI(w, apierror.New(http.StatusBadRequest, "Error reading request"))
 			return
 		}
 		defer r.Body.Close()
 
-		logger.Infof("Request body: %s", string(body))
+		if logged, ok := cfg.Bodies().Render(body); ok {
+			logger.Infof("Request body: %s", logged)
+		}
 
 		// Parse the OpenAI request
 		var openAIReq translation.OpenAIRequest
 		if err := json.Unmarshal(body, &openAIReq); err != nil {
 			logger.Errorf("Error parsing request: %v", err)
-			http.Error(w, "Error parsing request", http.StatusBadRequest)
+			apierror.WriteOpenAI(w, apierror.New(http.StatusBadRequest, "Error parsing request: %v", err))
 			return
 		}
 
 		logger.Info("Parsed OpenAI request successfully")
 
+		route, err := cfg.ModelRoutes.Resolve(openAIReq.Model)
+		if err != nil {
+			logger.Warnf("Rejecting request: %v", err)
+			apierror.WriteOpenAI(w, apierror.New(http.StatusNotFound, "model: %s", openAIReq.Model))
+			return
+		}
+		trackModel(r, openAIReq.Model, route)
+
 		// Translate OpenAI request to Anthropic request
-		anthropicReq := translation.OpenAIToAnthropic(openAIReq)
+		_, span := tracing.Start(r.Context(), "OpenAIToAnthropic")
+		anthropicReq, err := translation.OpenAIToAnthropic(openAIReq)
+		if err != nil {
+			tracing.Fail(span, err)
+		}
+		span.End()
+		if err != nil {
+			logger.Errorf("Error translating OpenAI request to Anthropic: %v", err)
+			apierror.WriteOpenAI(w, apierror.New(http.StatusBadRequest, "%v", err))
+			return
+		}
 
 		// Translate Anthropic request to Vertex AI request
+		_, span = tracing.Start(r.Context(), "AnthropicToVertexAI")
 		vertexAIReq, err := translation.AnthropicToVertexAI(anthropicReq)
+		if err != nil {
+			tracing.Fail(span, err)
+		}
+		span.End()
 		if err != nil {
 			logger.Errorf("Error translating Anthropic request to Vertex AI: %v", err)
-			http.Error(w, "Error processing request", http.StatusInternalServerError)
+			apierror.WriteOpenAI(w, apierror.New(http.StatusBadRequest, "%v", err))
+			return
+		}
+
+		if apiErr := authorizeRequest(r, openAIReq.Model, route, vertexAIReq.MaxTokens); apiErr != nil {
+			logger.Warnf("Rejecting request: %v", apiErr)
+			apierror.WriteOpenAI(w, apiErr)
 			return
 		}
 
 		logger.Info("Translated request to Vertex AI format")
 
 		if openAIReq.Stream {
-			// Set headers for SSE
-			w.Header().Set("Content-Type", "text/event-stream")
-			w.Header().Set("Cache-Control", "no-cache")
-			w.Header().Set("Connection", "keep-alive")
+			// The upstream request is cancelled when the client disconnects or
+			// when writing to it fails, and in any case before returning
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
 
-			// Create a channel to receive streaming responses
-			responseChan := make(chan []byte)
+			// Create a channel to receive streaming responses. The goroutine
+			// always closes it and then sends exactly one value on errChan, so
+			// ranging over responseChan and reading errChan never blocks forever.
+			responseChan := make(chan translation.StreamEvent)
+			errChan := make(chan error, 1)
 
 			// Start a goroutine to send the request to Vertex AI and write responses to the channel
 			go func() {
-				err := client.SendToVertexAIStream(cfg, &vertexAIReq, responseChan)
-				if err != nil {
-					logger.Errorf("Error sending request to Vertex AI: %v", err)
-					close(responseChan)
-				}
+				errChan <- vertex.SendToVertexAIStream(ctx, route, &vertexAIReq, responseChan)
 			}()
 
-			// Stream responses back to the client
-			for response := range responseChan {
-				fmt.Fprintf(w, "data: %s\n\n", response)
-				w.(http.Flusher).Flush()
+			includeUsage := openAIReq.StreamOptions != nil && openAIReq.StreamOptions.IncludeUsage
+			converter := translation.NewOpenAIStreamConverter("chatcmpl-"+uuid.New().String(), openAIReq.Model, includeUsage)
+
+			// Stream responses back to the client. The SSE writer is created
+			// with the first chunk, so an error before that is still sent as a
+			// plain JSON response with the upstream status.
+			var events *sse.Writer
+			var streamErr *apierror.Error
+			var writeErr error
+			var usage translation.Usage
+			tokens := newTokenTimer(r.Context())
+			for event := range responseChan {
+				usage.Observe(event)
+				if event.Type == "content_block_delta" && writeErr == nil {
+					tokens.delta()
+				}
+				if writeErr != nil {
+					// Drain until the goroutine notices the cancellation
+					continue
+				}
+				if event.Type == "error" && event.Error != nil {
+					streamErr = apierror.FromStreamError(event.Error)
+					continue
+				}
+				for _, chunk := range converter.Convert(event) {
+					data, err := json.Marshal(chunk)
+					if err != nil {
+						logger.Errorf("Error marshaling chunk: %v", err)
+						continue
+					}
+					if events == nil {
+						events = sse.NewWriter(w)
+					}
+					if writeErr = events.WriteData(string(data)); writeErr != nil {
+						cancel()
+						break
+					}
+				}
+			}
+
+			err := <-errChan
+			tokens.done()
+			recordUsage(r, usage)
+			if writeErr != nil || r.Context().Err() != nil {
+				logger.Warnf("Client disconnected, cancelled upstream request: %v", err)
+				return
+			}
+			if err != nil {
+				logger.Errorf("Error sending request to Vertex AI: %v", err)
+				streamErr = apierror.FromUpstream(err)
+			}
+
+			if streamErr != nil {
+				if events == nil {
+					// Nothing has been sent yet, so the upstream status can still be used
+					apierror.WriteOpenAI(w, streamErr)
+					return
+				}
+				apierror.WriteOpenAIEvent(events, streamErr)
 			}
 
 			// Send the final SSE message
-			fmt.Fprintf(w, "data: [DONE]\n\n")
-			w.(http.Flusher).Flush()
+			if events == nil {
+				events = sse.NewWriter(w)
+			}
+			events.WriteData("[DONE]")
 		} else {
 			// Send request to Vertex AI
-			responseStream, err := client.SendToVertexAI(cfg, &vertexAIReq)
+			responseStream, err := vertex.SendToVertexAI(r.Context(), route, &vertexAIReq)
 			if err != nil {
 				logger.Errorf("Error sending request to Vertex AI: %v", err)
-				http.Error(w, "Error processing request", http.StatusInternalServerError)
+				apierror.WriteOpenAI(w, apierror.FromUpstream(err))
 				return
 			}
 			defer responseStream.Close()
@@ -94,21 +185,25 @@ func HandleOpenAIMessages(cfg *config.Config) http.HandlerFunc {
 			responseBody, err := io.ReadAll(responseStream)
 			if err != nil {
 				logger.Errorf("Error reading response from Vertex AI: %v", err)
-				http.Error(w, "Error processing response", http.StatusInternalServerError)
+				apierror.WriteOpenAI(w, apierror.New(http.StatusInternalServerError, "Error processing response"))
 				return
 			}
 
-			logger.Infof("Response body from Vertex AI: %s", string(responseBody))
+			if logged, ok := cfg.Bodies().Render(responseBody); ok {
+				logger.Infof("Response body from Vertex AI: %s", logged)
+			}
 
 			// Parse the response
 			var vertexAIResp translation.VertexAIResponse
 			err = json.Unmarshal(responseBody, &vertexAIResp)
 			if err != nil {
 				logger.Errorf("Error parsing response: %v", err)
-				http.Error(w, "Error processing response", http.StatusInternalServerError)
+				apierror.WriteOpenAI(w, apierror.New(http.StatusInternalServerError, "Error processing response"))
 				return
 			}
 
+			recordUsage(r, vertexAIResp.Usage)
+
 			// Translate Vertex AI response to OpenAI response
 			openAIResp := translation.VertexAIToOpenAI(vertexAIResp, openAIReq.Model)
 
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"vertexai-anthropic-proxy/metrics"
+)
+
+// tokenTimer marks the first and last content deltas of a stream: the
+// first in the time-to-first-token metric and both as events on the
+// request's span.
+type tokenTimer struct {
+	ctx   context.Context
+	first bool
+	last  time.Time
+}
+
+func newTokenTimer(ctx context.Context) *tokenTimer {
+	return &tokenTimer{ctx: ctx}
+}
+
+// delta is called for every content delta relayed to the client.
+func (t *tokenTimer) delta() {
+	t.last = time.Now()
+	if t.first {
+		return
+	}
+	t.first = true
+	metrics.FromContext(t.ctx).FirstToken()
+	trace.SpanFromContext(t.ctx).AddEvent("first_token", trace.WithTimestamp(t.last))
+}
+
+// done is called once the stream has ended.
+func (t *tokenTimer) done() {
+	if t.first {
+		trace.SpanFromContext(t.ctx).AddEvent("last_token", trace.WithTimestamp(t.last))
+	}
+}
@@ -0,0 +1,259 @@
+// Package keystore holds the API keys clients use to call the proxy and the
+// policy attached to each: who owns it, whether it is enabled, when it
+// expires, which endpoints, models and max_tokens it may use, and how fast.
+package keystore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"vertexai-anthropic-proxy/budget"
+	"vertexai-anthropic-proxy/config"
+	"vertexai-anthropic-proxy/ratelimit"
+)
+
+// Errors returned by Authenticate and Authorize.
+var (
+	ErrUnknownKey         = errors.New("invalid x-api-key")
+	ErrKeyDisabled        = errors.New("API key is disabled")
+	ErrKeyExpired         = errors.New("API key has expired")
+	ErrEndpointNotAllowed = errors.New("API key may not use this endpoint")
+	ErrModelNotAllowed    = errors.New("API key may not use this model")
+	ErrMaxTokens          = errors.New("max_tokens exceeds the limit for this API key")
+)
+
+// Key is an API key and its policy. Empty allow lists and a zero MaxTokens
+// mean no restriction.
+type Key struct {
+	// ID names the key in logs and accounting; it is not secret
+	ID string `json:"id"`
+	// Secret is the key clients send. Alternatively SecretSHA256 holds the
+	// hex SHA-256 of the key, so the file need not contain it.
+	Secret       string `json:"key,omitempty"`
+	SecretSHA256 string `json:"key_sha256,omitempty"`
+
+	Owner string `json:"owner"`
+	// Team shares the team's budgets with the other keys of the team
+	Team string `json:"team,omitempty"`
+	// Enabled defaults to true
+	Enabled   *bool      `json:"enabled,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// AllowedModels are model names as sent by clients or Vertex AI model
+	// IDs, and may use * wildcards, e.g. "claude-3-5-*"
+	AllowedModels []string `json:"allowed_models,omitempty"`
+	// AllowedEndpoints are request paths such as "/v1/messages"
+	AllowedEndpoints []string `json:"allowed_endpoints,omitempty"`
+	MaxTokens        int      `json:"max_tokens,omitempty"`
+	// RateLimits override the default limits field by field; -1 removes
+	// a limit
+	RateLimits ratelimit.Limits `json:"rate_limits"`
+	// Budgets cap the key's spend per day, week or month
+	Budgets []budget.Budget `json:"budgets,omitempty"`
+}
+
+// IsEnabled reports whether the key has not been switched off.
+func (k *Key) IsEnabled() bool {
+	return k.Enabled == nil || *k.Enabled
+}
+
+// AllowsEndpoint reports whether the key may call the endpoint at path.
+func (k *Key) AllowsEndpoint(endpoint string) bool {
+	if len(k.AllowedEndpoints) == 0 {
+		return true
+	}
+	for _, allowed := range k.AllowedEndpoints {
+		if allowed == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsModel reports whether the key may use a model known by any of
+// names, typically the name the client sent and the Vertex AI model ID.
+func (k *Key) AllowsModel(names ...string) bool {
+	if len(k.AllowedModels) == 0 {
+		return true
+	}
+	for _, pattern := range k.AllowedModels {
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authorize checks a request for model (the requested name and the Vertex
+// AI model ID) with the given max_tokens against the key's policy.
+func (k *Key) Authorize(model, vertexModelID string, maxTokens int) error {
+	if !k.AllowsModel(model, vertexModelID) {
+		return fmt.Errorf("%w: %s", ErrModelNotAllowed, model)
+	}
+	if k.MaxTokens > 0 && maxTokens > k.MaxTokens {
+		return fmt.Errorf("%w: %d > %d", ErrMaxTokens, maxTokens, k.MaxTokens)
+	}
+	return nil
+}
+
+// Store looks up keys by their secret. It is safe for concurrent use.
+type Store struct {
+	path string
+	now  func() time.Time
+
+	mu   sync.RWMutex
+	keys map[[sha256.Size]byte]*Key
+}
+
+// New returns a store holding keys.
+func New(keys []*Key) (*Store, error) {
+	s := &Store{now: time.Now}
+	if err := s.set(keys); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load reads keys from a JSON file of the form
+// [{"id": "ci", "key": "sk-...", "owner": "build-team", "allowed_models": ["claude-3-5-*"], "max_tokens": 4096}].
+// Reload reads the file again.
+func Load(path string) (*Store, error) {
+	s := &Store{path: path, now: time.Now}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// FromConfig loads the key file named by API_KEYS_FILE. Without one, the
+// store holds ANTHROPIC_PROXY_API_KEY and OPENAI_PROXY_API_KEY, each
+// allowed everywhere, as before key files existed.
+func FromConfig(cfg *config.Config) (*Store, error) {
+	if cfg.KeysFile != "" {
+		return Load(cfg.KeysFile)
+	}
+
+	var keys []*Key
+	if cfg.AnthropicProxyAPIKey != "" {
+		keys = append(keys, &Key{ID: "anthropic", Secret: cfg.AnthropicProxyAPIKey, Owner: "default"})
+	}
+	if cfg.OpenAIProxyAPIKey != "" && cfg.OpenAIProxyAPIKey != cfg.AnthropicProxyAPIKey {
+		keys = append(keys, &Key{ID: "openai", Secret: cfg.OpenAIProxyAPIKey, Owner: "default"})
+	}
+	return New(keys)
+}
+
+// Reload rereads the key file, e.g. after keys were added or revoked. On
+// error the current keys are kept.
+func (s *Store) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var keys []*Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("parsing %s: %v", s.path, err)
+	}
+	if err := s.set(keys); err != nil {
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+	return nil
+}
+
+func (s *Store) set(keys []*Key) error {
+	byHash := make(map[[sha256.Size]byte]*Key, len(keys))
+	ids := make(map[string]bool, len(keys))
+	for i, k := range keys {
+		if k.ID == "" {
+			return fmt.Errorf("key %d has no id", i)
+		}
+		if ids[k.ID] {
+			return fmt.Errorf("duplicate key id %s", k.ID)
+		}
+		ids[k.ID] = true
+		if err := budget.Validate(k.Budgets); err != nil {
+			return fmt.Errorf("key %s: %v", k.ID, err)
+		}
+
+		var hash [sha256.Size]byte
+		switch {
+		case k.Secret != "" && k.SecretSHA256 != "":
+			return fmt.Errorf("key %s has both key and key_sha256", k.ID)
+		case k.Secret != "":
+			hash = sha256.Sum256([]byte(k.Secret))
+		case k.SecretSHA256 != "":
+			decoded, err := hex.DecodeString(k.SecretSHA256)
+			if err != nil || len(decoded) != sha256.Size {
+				return fmt.Errorf("key %s: key_sha256 is not a hex SHA-256", k.ID)
+			}
+			copy(hash[:], decoded)
+		default:
+			return fmt.Errorf("key %s has neither key nor key_sha256", k.ID)
+		}
+		if _, ok := byHash[hash]; ok {
+			return fmt.Errorf("key %s is the same as another key", k.ID)
+		}
+		byHash[hash] = k
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = byHash
+	return nil
+}
+
+// Len returns the number of keys.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.keys)
+}
+
+// Authenticate returns the key whose secret is secret, if it is enabled,
+// unexpired and allowed to call endpoint.
+func (s *Store) Authenticate(secret, endpoint string) (*Key, error) {
+	if secret == "" {
+		return nil, ErrUnknownKey
+	}
+
+	s.mu.RLock()
+	k, ok := s.keys[sha256.Sum256([]byte(secret))]
+	s.mu.RUnlock()
+
+	switch {
+	case !ok:
+		return nil, ErrUnknownKey
+	case !k.IsEnabled():
+		return k, ErrKeyDisabled
+	case k.ExpiresAt != nil && !s.now().Before(*k.ExpiresAt):
+		return k, ErrKeyExpired
+	case !k.AllowsEndpoint(endpoint):
+		return k, ErrEndpointNotAllowed
+	}
+	return k, nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying k.
+func NewContext(ctx context.Context, k *Key) context.Context {
+	return context.WithValue(ctx, contextKey{}, k)
+}
+
+// FromContext returns the key the request was authenticated with, or nil.
+func FromContext(ctx context.Context) *Key {
+	k, _ := ctx.Value(contextKey{}).(*Key)
+	return k
+}
@@ -0,0 +1,150 @@
+package keystore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vertexai-anthropic-proxy/config"
+)
+
+func writeKeys(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthenticate(t *testing.T) {
+	hashed := sha256.Sum256([]byte("sk-hashed"))
+	path := writeKeys(t, `[
+		{"id": "ci", "key": "sk-ci", "owner": "build", "allowed_endpoints": ["/v1/messages"]},
+		{"id": "hashed", "key_sha256": "`+hex.EncodeToString(hashed[:])+`", "owner": "ops"},
+		{"id": "off", "key": "sk-off", "owner": "ops", "enabled": false},
+		{"id": "old", "key": "sk-old", "owner": "ops", "expires_at": "2024-01-01T00:00:00Z"}
+	]`)
+	store, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	tests := []struct {
+		secret   string
+		endpoint string
+		wantID   string
+		wantErr  error
+	}{
+		{secret: "sk-ci", endpoint: "/v1/messages", wantID: "ci"},
+		{secret: "sk-ci", endpoint: "/v1/chat/completions", wantErr: ErrEndpointNotAllowed},
+		{secret: "sk-hashed", endpoint: "/v1/chat/completions", wantID: "hashed"},
+		{secret: "sk-off", endpoint: "/v1/messages", wantErr: ErrKeyDisabled},
+		{secret: "sk-old", endpoint: "/v1/messages", wantErr: ErrKeyExpired},
+		{secret: "sk-nope", endpoint: "/v1/messages", wantErr: ErrUnknownKey},
+		{secret: "", endpoint: "/v1/messages", wantErr: ErrUnknownKey},
+	}
+	for _, tt := range tests {
+		key, err := store.Authenticate(tt.secret, tt.endpoint)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("Authenticate(%q, %s) error = %v, want %v", tt.secret, tt.endpoint, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr == nil && key.ID != tt.wantID {
+			t.Errorf("Authenticate(%q) = %s, want %s", tt.secret, key.ID, tt.wantID)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := writeKeys(t, `[{"id": "a", "key": "sk-a", "owner": "x"}]`)
+	store, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	os.WriteFile(path, []byte(`[{"id": "b", "key": "sk-b", "owner": "x"}]`), 0o600)
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if _, err := store.Authenticate("sk-a", "/v1/messages"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("revoked key: error = %v", err)
+	}
+	if _, err := store.Authenticate("sk-b", "/v1/messages"); err != nil {
+		t.Errorf("added key: error = %v", err)
+	}
+
+	// A broken file keeps the current keys
+	os.WriteFile(path, []byte(`[{"id": "c", "owner": "x"}]`), 0o600)
+	if err := store.Reload(); err == nil {
+		t.Error("Reload() of a key without a secret should fail")
+	}
+	if _, err := store.Authenticate("sk-b", "/v1/messages"); err != nil {
+		t.Errorf("after failed reload: error = %v", err)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"no id":        `[{"key": "sk-a"}]`,
+		"duplicate id": `[{"id": "a", "key": "sk-a"}, {"id": "a", "key": "sk-b"}]`,
+		"same secret":  `[{"id": "a", "key": "sk-a"}, {"id": "b", "key": "sk-a"}]`,
+		"bad hash":     `[{"id": "a", "key_sha256": "abc"}]`,
+		"both":         `[{"id": "a", "key": "sk-a", "key_sha256": "abc"}]`,
+		"bad budget":   `[{"id": "a", "key": "sk-a", "budgets": [{"period": "yearly", "usd": 10}]}]`,
+	} {
+		if _, err := Load(writeKeys(t, data)); err == nil {
+			t.Errorf("Load(%s) should fail", name)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	key := &Key{ID: "a", AllowedModels: []string{"claude-3-5-*"}, MaxTokens: 1024}
+
+	if err := key.Authorize("claude-3-5-sonnet", "claude-3-5-sonnet@20240620", 1024); err != nil {
+		t.Errorf("Authorize() error = %v", err)
+	}
+	// Aliases are allowed through the Vertex model ID
+	if err := key.Authorize("gpt-4o-mini", "claude-3-5-haiku@20241022", 100); err != nil {
+		t.Errorf("Authorize(alias) error = %v", err)
+	}
+	if err := key.Authorize("claude-3-opus", "claude-3-opus@20240229", 100); !errors.Is(err, ErrModelNotAllowed) {
+		t.Errorf("Authorize(opus) error = %v, want ErrModelNotAllowed", err)
+	}
+	if err := key.Authorize("claude-3-5-sonnet", "claude-3-5-sonnet@20240620", 2048); !errors.Is(err, ErrMaxTokens) {
+		t.Errorf("Authorize(2048 tokens) error = %v, want ErrMaxTokens", err)
+	}
+	if err := (&Key{ID: "open"}).Authorize("anything", "anything", 1<<20); err != nil {
+		t.Errorf("unrestricted key: error = %v", err)
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	store, err := FromConfig(&config.Config{AnthropicProxyAPIKey: "sk-ant", OpenAIProxyAPIKey: "sk-oai"})
+	if err != nil {
+		t.Fatalf("FromConfig() error = %v", err)
+	}
+	for secret, id := range map[string]string{"sk-ant": "anthropic", "sk-oai": "openai"} {
+		// Both keys work on both endpoints, as before key files existed
+		key, err := store.Authenticate(secret, "/v1/chat/completions")
+		if err != nil || key.ID != id {
+			t.Errorf("Authenticate(%s) = %v, %v", secret, key, err)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != nil {
+		t.Error("FromContext() of a bare context should be nil")
+	}
+	key := &Key{ID: "a", ExpiresAt: func() *time.Time { t := time.Now(); return &t }()}
+	if got := FromContext(NewContext(context.Background(), key)); got != key {
+		t.Errorf("FromContext() = %v, want %v", got, key)
+	}
+}
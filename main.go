@@ -1,39 +1,126 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"vertexai-anthropic-proxy/budget"
+	"vertexai-anthropic-proxy/capture"
+	"vertexai-anthropic-proxy/client"
 	"vertexai-anthropic-proxy/config"
 	"vertexai-anthropic-proxy/handlers"
+	"vertexai-anthropic-proxy/keystore"
 	"vertexai-anthropic-proxy/middleware"
+	"vertexai-anthropic-proxy/ratelimit"
+	"vertexai-anthropic-proxy/tracing"
+	"vertexai-anthropic-proxy/usage"
 	"vertexai-anthropic-proxy/utils"
 )
 
 func main() {
-	cfg := config.LoadConfig()
-
 	// Initialize logger
 	utils.InitLogger("info")
 	logger := utils.GetLogger()
 
-	// Set log flags to include file name and line number
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	cfg := config.LoadConfig()
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TracesExporter)
+	if err != nil {
+		logger.Fatalf("Error setting up tracing: %v", err)
+	}
+
+	// One client is shared by all requests so tokens and connections are reused
+	vertexClient, err := client.NewVertexClient(context.Background(), cfg, client.DefaultTokenSource)
+	if err != nil {
+		logger.Fatalf("Error creating Vertex AI client: %v", err)
+	}
+
+	keys, err := keystore.FromConfig(cfg)
+	if err != nil {
+		logger.Fatalf("Error loading API keys: %v", err)
+	}
+	prices, err := usage.PricesFromConfig(cfg)
+	if err != nil {
+		logger.Fatalf("Error loading prices: %v", err)
+	}
+	ledger, err := usage.FromConfig(cfg, prices)
+	if err != nil {
+		logger.Fatalf("Error opening usage ledger: %v", err)
+	}
+	tracker, err := budget.FromConfig(cfg, prices)
+	if err != nil {
+		logger.Fatalf("Error loading team budgets: %v", err)
+	}
+	if ledger != nil {
+		if err := tracker.Seed(ledger); err != nil {
+			logger.Fatalf("Error reading spend from usage ledger: %v", err)
+		}
+	}
+	reloadOnSIGHUP(keys, tracker)
+
+	sink, err := capture.FromConfig(cfg)
+	if err != nil {
+		logger.Fatalf("Error opening capture file: %v", err)
+	}
+	if sink != nil {
+		logger.Infof("Capturing %.0f%% of requests to %s", 100*cfg.CaptureSampleRate, cfg.CaptureFile)
+	}
 
 	// Set up routes with middleware
-	http.HandleFunc("/v1/messages", middleware.AuthMiddleware(cfg)(handlers.HandleMessages(cfg)))
-	http.HandleFunc("/v1/chat/completions", middleware.AuthMiddleware(cfg)(handlers.HandleOpenAIMessages(cfg)))
-	http.HandleFunc("/set-log-level", handlers.HandleSetLogLevel)
-	http.HandleFunc("/refresh-credentials", handlers.HandleRefreshCredentials)
+	auth := middleware.AuthMiddleware(keys)
+	rateLimit := middleware.RateLimitMiddleware(ratelimit.New(), ratelimit.Limits{
+		RequestsPerMinute:     cfg.RateLimitRequests,
+		InputTokensPerMinute:  cfg.RateLimitInputTokens,
+		OutputTokensPerMinute: cfg.RateLimitOutputTokens,
+	})
+	observe := func(next http.HandlerFunc) http.HandlerFunc {
+		return middleware.TracingMiddleware(middleware.MetricsMiddleware(next))
+	}
+	capturing := middleware.CaptureMiddleware(sink)
+	record := middleware.UsageMiddleware(ledger)
+	spend := middleware.BudgetMiddleware(tracker)
+	http.HandleFunc("/v1/messages", observe(auth(capturing(record(spend(rateLimit(handlers.HandleMessages(cfg, vertexClient))))))))
+	http.HandleFunc("/v1/chat/completions", observe(auth(capturing(record(spend(rateLimit(handlers.HandleOpenAIMessages(cfg, vertexClient))))))))
+
+	// Admin endpoints only accept ADMIN_API_KEY, and move to their own
+	// listener when ADMIN_ADDR is set
+	admin := middleware.AdminAuthMiddleware(cfg.AdminAPIKey)(handlers.NewAdminRouter(vertexClient, ledger).ServeHTTP)
+	if cfg.AdminAddr != "" {
+		go func() {
+			logger.Infof("Admin server listening on %s", cfg.AdminAddr)
+			if err := http.ListenAndServe(cfg.AdminAddr, admin); err != nil {
+				logger.Fatalf("Error starting admin server: %v", err)
+			}
+		}()
+	} else {
+		http.HandleFunc("/set-log-level", admin)
+		http.HandleFunc("/refresh-credentials", admin)
+		http.HandleFunc("/admin/", admin)
+		http.HandleFunc("/metrics", admin)
+	}
+	if cfg.AdminAPIKey == "" {
+		logger.Warn("ADMIN_API_KEY is not set; admin endpoints are disabled")
+	}
 
 	// Log configuration
 	logger.Infof("Starting server with configuration:")
 	logger.Infof("Vertex AI Project ID: %s", cfg.VertexAIProjectID)
 	logger.Infof("Vertex AI Region: %s", cfg.VertexAIRegion)
+	logger.Infof("Vertex AI Regions: %v", cfg.VertexAIRegions)
+	if len(cfg.Backends) > 0 {
+		logger.Infof("Vertex AI Backends: %d (%s)", len(cfg.Backends), cfg.BackendStrategy)
+	}
 	logger.Infof("Vertex AI Endpoint: %s", cfg.VertexAIEndpoint)
-	logger.Infof("ANTHROPIC_API_KEY: %s", cfg.AnthropicProxyAPIKey[:5]+"...") // Log only the first 5 characters for security
+	logger.Infof("API keys: %d", keys.Len())
+	if cfg.UsageLedgerFile != "" {
+		logger.Infof("Usage ledger: %s", cfg.UsageLedgerFile)
+	}
+	logger.Infof("Body logging: %s", cfg.LogBodies)
 
 	// Get port from environment variable
 	port := os.Getenv("PORT")
@@ -42,9 +129,59 @@ func main() {
 	}
 
 	// Start server
-	addr := fmt.Sprintf(":%s", port)
-	logger.Infof("Server listening on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("Error starting server: %v", err)
+	server := &http.Server{Addr: fmt.Sprintf(":%s", port)}
+	go func() {
+		logger.Infof("Server listening on %s", server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("Error starting server: %v", err)
+		}
+	}()
+	shutdownOnSignal(server, shutdownTracing)
+}
+
+// shutdownTimeout bounds each step of shutdownOnSignal.
+const shutdownTimeout = 10 * time.Second
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, then stops server, giving
+// requests in progress a while to finish, and exports the spans not yet
+// sent.
+func shutdownOnSignal(server *http.Server, shutdownTracing func(context.Context) error) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+
+	logger := utils.GetLogger()
+	logger.Infof("Received %v, shutting down", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warnf("Requests still in progress at shutdown: %v", err)
 	}
-}
\ No newline at end of file
+
+	ctx, cancel = context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Errorf("Error exporting remaining spans: %v", err)
+	}
+}
+
+// reloadOnSIGHUP rereads the API key and team budget files whenever the
+// process receives SIGHUP, so keys can be added or revoked and budgets
+// changed without a restart.
+func reloadOnSIGHUP(keys *keystore.Store, tracker *budget.Tracker) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		logger := utils.GetLogger()
+		for range hup {
+			if err := keys.Reload(); err != nil {
+				logger.Errorf("Error reloading API keys: %v", err)
+			} else {
+				logger.Infof("Reloaded API keys: %d", keys.Len())
+			}
+			if err := tracker.Reload(); err != nil {
+				logger.Errorf("Error reloading team budgets: %v", err)
+			}
+		}
+	}()
+}
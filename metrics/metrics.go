@@ -0,0 +1,184 @@
+// Package metrics collects the Prometheus metrics served on /metrics:
+// requests by endpoint, model, status and API key, their latency and time
+// to first token, Vertex AI errors and retries, and token counts.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// none labels a model or key that is not known, e.g. for a request that
+// failed authentication.
+const none = "none"
+
+var (
+	// Registry holds the proxy's metrics along with the Go runtime and
+	// process collectors.
+	Registry = prometheus.NewRegistry()
+
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_requests_total",
+		Help: "Requests handled, by endpoint, model, HTTP status and API key ID.",
+	}, []string{"endpoint", "model", "status", "key"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_request_duration_seconds",
+		Help:    "Time from receiving a request to finishing the response, streams included.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"endpoint", "model"})
+
+	timeToFirstToken = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_time_to_first_token_seconds",
+		Help:    "Time from receiving a streaming request to relaying its first content delta.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30},
+	}, []string{"endpoint", "model"})
+
+	inFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_requests_in_flight",
+		Help: "Requests in progress, open streams included.",
+	}, []string{"endpoint"})
+
+	vertexErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_vertex_errors_total",
+		Help: "Failed Vertex AI attempts, by backend, model and HTTP status, or timeout, network or a stream error type.",
+	}, []string{"backend", "model", "status"})
+
+	vertexRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_vertex_retries_total",
+		Help: "Vertex AI requests retried after every backend failed.",
+	}, []string{"model"})
+
+	tokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_tokens_total",
+		Help: "Tokens reported by Vertex AI, by model, API key ID and type (input or output).",
+	}, []string{"model", "key", "type"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requests, requestDuration, timeToFirstToken, inFlight,
+		vertexErrors, vertexRetries, tokens,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// VertexError counts a failed attempt against a Vertex AI backend. status
+// is the HTTP status, or a word such as "timeout" if there was none.
+func VertexError(backend, model, status string) {
+	vertexErrors.WithLabelValues(backend, model, status).Inc()
+}
+
+// VertexRetry counts a retried Vertex AI request.
+func VertexRetry(model string) {
+	vertexRetries.WithLabelValues(model).Inc()
+}
+
+// Request collects the labels of one request while it is handled. The
+// handlers fill in what they learn, such as the model, and Finish records
+// everything. Handlers called without MetricsMiddleware, as in their
+// tests, find a nil Request in the context; its methods then ignore what
+// they are told.
+type Request struct {
+	endpoint string
+	start    time.Time
+	now      func() time.Time
+
+	mu         sync.Mutex
+	model      string
+	key        string
+	firstToken bool
+}
+
+// Start counts a request to endpoint as in flight until Finish is called.
+func Start(endpoint string) *Request {
+	return start(endpoint, time.Now)
+}
+
+func start(endpoint string, now func() time.Time) *Request {
+	inFlight.WithLabelValues(endpoint).Inc()
+	return &Request{endpoint: endpoint, start: now(), now: now, model: none, key: none}
+}
+
+// SetModel sets the model the request is for, as named by the client.
+func (r *Request) SetModel(model string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.model = model
+}
+
+// SetKey sets the ID of the API key the request was authenticated with.
+func (r *Request) SetKey(id string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.key = id
+}
+
+// FirstToken records the time to first token. Only the first call counts.
+func (r *Request) FirstToken() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.firstToken {
+		return
+	}
+	r.firstToken = true
+	timeToFirstToken.WithLabelValues(r.endpoint, r.model).Observe(r.now().Sub(r.start).Seconds())
+}
+
+// Usage counts the tokens used by the request.
+func (r *Request) Usage(inputTokens, outputTokens int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tokens.WithLabelValues(r.model, r.key, "input").Add(float64(inputTokens))
+	tokens.WithLabelValues(r.model, r.key, "output").Add(float64(outputTokens))
+}
+
+// Finish records the request as done with the given HTTP status.
+func (r *Request) Finish(status int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	inFlight.WithLabelValues(r.endpoint).Dec()
+	requests.WithLabelValues(r.endpoint, r.model, strconv.Itoa(status), r.key).Inc()
+	requestDuration.WithLabelValues(r.endpoint, r.model).Observe(r.now().Sub(r.start).Seconds())
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying r.
+func NewContext(ctx context.Context, r *Request) context.Context {
+	return context.WithValue(ctx, contextKey{}, r)
+}
+
+// FromContext returns the Request in ctx, or nil if there is none.
+func FromContext(ctx context.Context) *Request {
+	r, _ := ctx.Value(contextKey{}).(*Request)
+	return r
+}
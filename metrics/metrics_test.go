@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequest(t *testing.T) {
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	rec := start("/test/request", clock)
+	if got := testutil.ToFloat64(inFlight.WithLabelValues("/test/request")); got != 1 {
+		t.Errorf("in flight = %v, want 1", got)
+	}
+
+	rec.SetModel("claude-3-5-sonnet")
+	rec.SetKey("ci")
+	now = now.Add(500 * time.Millisecond)
+	rec.FirstToken()
+	now = now.Add(time.Second)
+	rec.FirstToken() // only the first call counts
+	rec.Usage(120, 30)
+	rec.Finish(200)
+
+	if got := testutil.ToFloat64(inFlight.WithLabelValues("/test/request")); got != 0 {
+		t.Errorf("in flight = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(requests.WithLabelValues("/test/request", "claude-3-5-sonnet", "200", "ci")); got != 1 {
+		t.Errorf("requests = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(tokens.WithLabelValues("claude-3-5-sonnet", "ci", "input")); got != 120 {
+		t.Errorf("input tokens = %v, want 120", got)
+	}
+	if got := testutil.ToFloat64(tokens.WithLabelValues("claude-3-5-sonnet", "ci", "output")); got != 30 {
+		t.Errorf("output tokens = %v, want 30", got)
+	}
+
+	want := `
+# HELP proxy_time_to_first_token_seconds Time from receiving a streaming request to relaying its first content delta.
+# TYPE proxy_time_to_first_token_seconds histogram
+proxy_time_to_first_token_seconds_bucket{endpoint="/test/request",model="claude-3-5-sonnet",le="0.05"} 0
+proxy_time_to_first_token_seconds_bucket{endpoint="/test/request",model="claude-3-5-sonnet",le="0.1"} 0
+proxy_time_to_first_token_seconds_bucket{endpoint="/test/request",model="claude-3-5-sonnet",le="0.25"} 0
+proxy_time_to_first_token_seconds_bucket{endpoint="/test/request",model="claude-3-5-sonnet",le="0.5"} 1
+proxy_time_to_first_token_seconds_bucket{endpoint="/test/request",model="claude-3-5-sonnet",le="1"} 1
+proxy_time_to_first_token_seconds_bucket{endpoint="/test/request",model="claude-3-5-sonnet",le="2"} 1
+proxy_time_to_first_token_seconds_bucket{endpoint="/test/request",model="claude-3-5-sonnet",le="4"} 1
+proxy_time_to_first_token_seconds_bucket{endpoint="/test/request",model="claude-3-5-sonnet",le="8"} 1
+proxy_time_to_first_token_seconds_bucket{endpoint="/test/request",model="claude-3-5-sonnet",le="15"} 1
+proxy_time_to_first_token_seconds_bucket{endpoint="/test/request",model="claude-3-5-sonnet",le="30"} 1
+proxy_time_to_first_token_seconds_bucket{endpoint="/test/request",model="claude-3-5-sonnet",le="+Inf"} 1
+proxy_time_to_first_token_seconds_sum{endpoint="/test/request",model="claude-3-5-sonnet"} 0.5
+proxy_time_to_first_token_seconds_count{endpoint="/test/request",model="claude-3-5-sonnet"} 1
+`
+	if err := testutil.CollectAndCompare(timeToFirstToken, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestDefaults(t *testing.T) {
+	// A request rejected before the model or key is known
+	rec := Start("/test/defaults")
+	rec.Finish(401)
+	if got := testutil.ToFloat64(requests.WithLabelValues("/test/defaults", "none", "401", "none")); got != 1 {
+		t.Errorf("requests = %v, want 1", got)
+	}
+
+	// Without the middleware there is no Request, and nothing happens
+	missing := FromContext(context.Background())
+	missing.SetModel("m")
+	missing.FirstToken()
+	missing.Usage(1, 1)
+	missing.Finish(200)
+}
+
+func TestHandler(t *testing.T) {
+	VertexError("p/us-east5", "claude-3-5-sonnet@20240620", "429")
+	VertexRetry("claude-3-5-sonnet@20240620")
+
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+	for _, want := range []string{
+		`proxy_vertex_errors_total{backend="p/us-east5",model="claude-3-5-sonnet@20240620",status="429"} 1`,
+		`proxy_vertex_retries_total{model="claude-3-5-sonnet@20240620"} 1`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
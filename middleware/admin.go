@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"vertexai-anthropic-proxy/apierror"
+	"vertexai-anthropic-proxy/redact"
+	"vertexai-anthropic-proxy/utils"
+)
+
+// AdminAuthMiddleware only lets requests with adminKey through. API keys
+// from the key store are not accepted. With an empty adminKey every
+// request is refused, so the admin endpoints stay closed until a key is
+// configured.
+func AdminAuthMiddleware(adminKey string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if adminKey == "" {
+				utils.GetLogger().Warnf("Refused admin request to %s: ADMIN_API_KEY is not set", r.URL.Path)
+				apierror.Write(w, r, apierror.New(http.StatusForbidden, "admin endpoints are disabled: ADMIN_API_KEY is not set"))
+				return
+			}
+
+			apiKey := requestKey(r)
+			if subtle.ConstantTimeCompare([]byte(apiKey), []byte(adminKey)) != 1 {
+				utils.GetLogger().Warnf("Unauthorized admin request to %s with key %s", r.URL.Path, redact.Fingerprint(apiKey))
+				apierror.Write(w, r, apierror.New(http.StatusUnauthorized, "invalid admin API key"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		adminKey   string
+		header     string
+		value      string
+		wantStatus int
+	}{
+		{name: "x-api-key", adminKey: "sk-admin", header: "X-API-Key", value: "sk-admin", wantStatus: 200},
+		{name: "Bearer", adminKey: "sk-admin", header: "Authorization", value: "Bearer sk-admin", wantStatus: 200},
+		{name: "Wrong key", adminKey: "sk-admin", header: "X-API-Key", value: "sk-client", wantStatus: 401},
+		{name: "No key", adminKey: "sk-admin", wantStatus: 401},
+		{name: "Not configured", header: "X-API-Key", value: "", wantStatus: 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			handler := AdminAuthMiddleware(tt.adminKey)(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			req := httptest.NewRequest("POST", "/set-log-level", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if called != (tt.wantStatus == 200) {
+				t.Errorf("handler called = %v", called)
+			}
+		})
+	}
+}
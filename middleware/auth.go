@@ -1,34 +1,67 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"strings"
-	"vertexai-anthropic-proxy/config"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"vertexai-anthropic-proxy/apierror"
+	"vertexai-anthropic-proxy/keystore"
+	"vertexai-anthropic-proxy/metrics"
+	"vertexai-anthropic-proxy/redact"
+	"vertexai-anthropic-proxy/tracing"
 	"vertexai-anthropic-proxy/utils"
 )
 
-func AuthMiddleware(cfg *config.Config) func(http.HandlerFunc) http.HandlerFunc {
+// AuthMiddleware checks the request's API key against keys and attaches the
+// key to the request context for the handlers.
+func AuthMiddleware(keys *keystore.Store) func(http.HandlerFunc) http.HandlerFunc {
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
 			logger := utils.GetLogger()
-			apiKey := r.Header.Get("Authorization")
-
-			// Remove "Bearer " prefix if present
-			apiKey = strings.TrimPrefix(apiKey, "Bearer ")
-
-			if apiKey == "" {
-				apiKey = r.Header.Get("X-API-Key")
+			apiKey := requestKey(r)
+			_, span := tracing.Start(r.Context(), "AuthMiddleware")
+			key, err := keys.Authenticate(apiKey, r.URL.Path)
+			if key != nil {
+				span.SetAttributes(attribute.String("proxy.key.id", key.ID))
 			}
+			if err != nil {
+				tracing.Fail(span, err)
+			}
+			span.End()
 
-			logger.Infof("Received API Key: %s", apiKey)
-
-			if apiKey == "" || (apiKey != cfg.AnthropicProxyAPIKey && apiKey != cfg.OpenAIProxyAPIKey) {
-				logger.Warn("Unauthorized access attempt")
-				utils.RespondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			if err != nil {
+				status := http.StatusUnauthorized
+				if errors.Is(err, keystore.ErrEndpointNotAllowed) {
+					status = http.StatusForbidden
+				}
+				if key != nil {
+					logger.Warnf("Rejected key %s (%s): %v", key.ID, key.Owner, err)
+				} else {
+					logger.Warnf("Unauthorized access attempt with key %s", redact.Fingerprint(apiKey))
+				}
+				apierror.Write(w, r, apierror.New(status, "%v", err))
 				return
 			}
 
-			next.ServeHTTP(w, r)
+			logger.Infof("Authenticated key %s (%s)", key.ID, key.Owner)
+			metrics.FromContext(r.Context()).SetKey(key.ID)
+			next.ServeHTTP(w, r.WithContext(keystore.NewContext(r.Context(), key)))
 		}
 	}
-}
\ No newline at end of file
+}
+
+// requestKey returns the key sent as a Bearer token or in X-API-Key.
+func requestKey(r *http.Request) string {
+	apiKey := r.Header.Get("Authorization")
+
+	// Remove "Bearer " prefix if present
+	apiKey = strings.TrimPrefix(apiKey, "Bearer ")
+
+	if apiKey == "" {
+		apiKey = r.Header.Get("X-API-Key")
+	}
+	return apiKey
+}
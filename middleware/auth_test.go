@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vertexai-anthropic-proxy/keystore"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	disabled := false
+	keys, err := keystore.New([]*keystore.Key{
+		{ID: "ci", Secret: "sk-ci", Owner: "build", AllowedEndpoints: []string{"/v1/messages"}},
+		{ID: "off", Secret: "sk-off", Owner: "ops", Enabled: &disabled},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen *keystore.Key
+	handler := AuthMiddleware(keys)(func(w http.ResponseWriter, r *http.Request) {
+		seen = keystore.FromContext(r.Context())
+	})
+
+	tests := []struct {
+		name       string
+		path       string
+		header     string
+		value      string
+		wantStatus int
+		wantType   string
+	}{
+		{name: "x-api-key", path: "/v1/messages", header: "X-API-Key", value: "sk-ci", wantStatus: 200},
+		{name: "Bearer", path: "/v1/messages", header: "Authorization", value: "Bearer sk-ci", wantStatus: 200},
+		{name: "Unknown key", path: "/v1/messages", header: "X-API-Key", value: "sk-nope", wantStatus: 401, wantType: `"type":"authentication_error"`},
+		{name: "Disabled key", path: "/v1/messages", header: "X-API-Key", value: "sk-off", wantStatus: 401, wantType: `"type":"authentication_error"`},
+		{name: "Endpoint not allowed", path: "/v1/chat/completions", header: "Authorization", value: "Bearer sk-ci", wantStatus: 403, wantType: `"code":"permission_denied"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen = nil
+			req := httptest.NewRequest("POST", tt.path, nil)
+			req.Header.Set(tt.header, tt.value)
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantStatus == 200 {
+				if seen == nil || seen.ID != "ci" {
+					t.Errorf("key in context = %v, want ci", seen)
+				}
+			} else if !strings.Contains(rr.Body.String(), tt.wantType) {
+				t.Errorf("body = %s, want %s", rr.Body.String(), tt.wantType)
+			}
+		})
+	}
+}
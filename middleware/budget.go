@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"net/http"
+
+	"vertexai-anthropic-proxy/apierror"
+	"vertexai-anthropic-proxy/budget"
+	"vertexai-anthropic-proxy/keystore"
+	"vertexai-anthropic-proxy/utils"
+)
+
+// BudgetWarningHeader carries a warning for each budget of the key or its
+// team that is past its soft limit.
+const BudgetWarningHeader = "x-budget-warning"
+
+// BudgetMiddleware checks the budgets of the request's API key and its team
+// before the request is sent to Vertex AI. It must run after
+// AuthMiddleware. A request is rejected with a 402 budget_exceeded_error
+// once a budget is used up; past the soft limit it gets an x-budget-warning
+// header, and the first such request in a period is logged. The handler
+// reports the request's usage through the budget.Charge in the context.
+func BudgetMiddleware(tracker *budget.Tracker) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			key := keystore.FromContext(r.Context())
+			if key == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			logger := utils.GetLogger()
+			result := tracker.Check(key.ID, key.Team, key.Budgets)
+			for _, s := range result.NewWarnings {
+				logger.Warnf("Budget soft limit reached: %s", s)
+			}
+			for _, s := range result.Warnings {
+				w.Header().Add(BudgetWarningHeader, s.String())
+			}
+			if s := result.Exceeded; s != nil {
+				logger.Warnf("Rejected key %s (%s): budget exceeded: %s", key.ID, key.Owner, s)
+				apierror.Write(w, r, apierror.New(http.StatusPaymentRequired, "Budget exceeded: %s", s))
+				return
+			}
+
+			charge := tracker.NewCharge(key.ID, key.Team)
+			next.ServeHTTP(w, r.WithContext(budget.NewContext(r.Context(), charge)))
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vertexai-anthropic-proxy/budget"
+	"vertexai-anthropic-proxy/keystore"
+	"vertexai-anthropic-proxy/translation"
+	"vertexai-anthropic-proxy/usage"
+)
+
+func TestBudgetMiddleware(t *testing.T) {
+	tracker := budget.NewTracker(usage.DefaultPrices(), nil)
+	key := &keystore.Key{ID: "ci", Owner: "build", Budgets: []budget.Budget{{Period: budget.Daily, Tokens: 1000}}}
+
+	calls := 0
+	handler := BudgetMiddleware(tracker)(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		charge := budget.FromContext(r.Context())
+		if charge == nil {
+			t.Fatal("no budget.Charge in the context")
+		}
+		charge.SetModel("claude-3-5-sonnet@20240620")
+		charge.Settle(translation.Usage{InputTokens: 500, OutputTokens: 400})
+	})
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/messages", nil)
+		req = req.WithContext(keystore.NewContext(req.Context(), key))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	if rec := serve(); rec.Code != http.StatusOK || rec.Header().Get(BudgetWarningHeader) != "" {
+		t.Errorf("first request: status %d, warning %q", rec.Code, rec.Header().Get(BudgetWarningHeader))
+	}
+	// 900 of 1000 tokens used: past the soft limit
+	rec := serve()
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Header().Get(BudgetWarningHeader), "key ci: 90% of daily budget used") {
+		t.Errorf("second request: status %d, warning %q", rec.Code, rec.Header().Get(BudgetWarningHeader))
+	}
+	// 1800 tokens used: rejected before the handler
+	rec = serve()
+	if rec.Code != http.StatusPaymentRequired || !strings.Contains(rec.Body.String(), `"type":"budget_exceeded_error"`) {
+		t.Errorf("third request: status %d, body %s", rec.Code, rec.Body)
+	}
+	if calls != 2 {
+		t.Errorf("handler called %d times, want 2", calls)
+	}
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"vertexai-anthropic-proxy/apierror"
+	"vertexai-anthropic-proxy/capture"
+	"vertexai-anthropic-proxy/keystore"
+	"vertexai-anthropic-proxy/utils"
+)
+
+// CaptureMiddleware records a sample of requests in sink, with their
+// translation and the Vertex AI responses. It goes inside AuthMiddleware,
+// so only authenticated requests are captured and each record carries its
+// key; the handlers and Vertex AI client fill in the capture.Exchange in
+// the context. With a nil sink it does nothing.
+func CaptureMiddleware(sink *capture.Sink) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		if sink == nil {
+			return next
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !sink.Sample() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Read the body for the capture and hand the handler a copy
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				utils.GetLogger().Errorf("Error reading request body: %v", err)
+				apierror.Write(w, r, apierror.New(http.StatusBadRequest, "Error reading request"))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			x := sink.Start(r, body)
+			if key := keystore.FromContext(r.Context()); key != nil {
+				x.SetKey(key.ID)
+			}
+			sw := &statusWriter{ResponseWriter: w}
+
+			next.ServeHTTP(sw, r.WithContext(capture.NewContext(r.Context(), x)))
+
+			if err := sink.Finish(x, sw.Status()); err != nil {
+				utils.GetLogger().Errorf("Error writing capture: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"vertexai-anthropic-proxy/capture"
+	"vertexai-anthropic-proxy/keystore"
+)
+
+func TestCaptureMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	sink, err := capture.Open(path, capture.Options{SampleRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	handler := CaptureMiddleware(sink)(func(w http.ResponseWriter, r *http.Request) {
+		// The handler still gets the whole body
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"model":"claude-3-5-sonnet"}` {
+			t.Errorf("handler got body %q", body)
+		}
+		if capture.FromContext(r.Context()) == nil {
+			t.Fatal("no capture.Exchange in the context")
+		}
+		w.WriteHeader(http.StatusTeapot)
+	})
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model":"claude-3-5-sonnet"}`))
+	handler(httptest.NewRecorder(), req.WithContext(keystore.NewContext(req.Context(), &keystore.Key{ID: "ci"})))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec capture.Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatalf("capture %s: %v", data, err)
+	}
+	if rec.Key != "ci" || rec.Status != http.StatusTeapot || string(rec.Request.Body) != `{"model":"claude-3-5-sonnet"}` {
+		t.Errorf("record = %+v", rec)
+	}
+
+	// Without a sink the handler is called directly
+	called := false
+	CaptureMiddleware(nil)(func(w http.ResponseWriter, r *http.Request) { called = true })(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/messages", nil))
+	if !called {
+		t.Error("handler not called without a sink")
+	}
+}
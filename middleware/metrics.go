@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"net/http"
+
+	"vertexai-anthropic-proxy/metrics"
+)
+
+// MetricsMiddleware records each request's status, latency and labels.
+// It goes outside AuthMiddleware so rejected requests are counted too; the
+// handlers add the model and key to the metrics.Request in the context.
+func MetricsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := metrics.Start(r.URL.Path)
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() { rec.Finish(sw.Status()) }()
+
+		next.ServeHTTP(sw, r.WithContext(metrics.NewContext(r.Context(), rec)))
+	}
+}
+
+// statusWriter remembers the status written to a response. It passes
+// Flush through so streams are still flushed event by event.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status returns the status sent, which is 200 if the handler wrote
+// nothing.
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"vertexai-anthropic-proxy/metrics"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	var rec *metrics.Request
+	flushed := false
+	handler := MetricsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		rec = metrics.FromContext(r.Context())
+		w.WriteHeader(http.StatusTooManyRequests)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+			flushed = true
+		}
+	})
+
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("POST", "/v1/messages", nil))
+	if rec == nil {
+		t.Fatal("no metrics.Request in the context")
+	}
+	if !flushed || !rr.Flushed {
+		t.Error("Flush was not passed through")
+	}
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429", rr.Code)
+	}
+}
+
+func TestStatusWriter(t *testing.T) {
+	sw := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+	if sw.Status() != http.StatusOK {
+		t.Errorf("status before writing = %d, want 200", sw.Status())
+	}
+	sw.Write([]byte("data"))
+	sw.WriteHeader(http.StatusInternalServerError)
+	if sw.Status() != http.StatusOK {
+		t.Errorf("status = %d, want the implicit 200", sw.Status())
+	}
+}
@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+	"vertexai-anthropic-proxy/apierror"
+	"vertexai-anthropic-proxy/keystore"
+	"vertexai-anthropic-proxy/ratelimit"
+	"vertexai-anthropic-proxy/utils"
+)
+
+// Input tokens are charged before Vertex AI has counted them, estimated
+// from the text of the request at bytesPerToken. Images and documents are
+// charged a fixed amount each instead of the size of their base64 data.
+const (
+	bytesPerToken  = 4
+	imageTokens    = 1600
+	documentTokens = 3000
+)
+
+// RateLimitMiddleware applies the per-minute limits of the request's API key
+// (defaults overridden by the key's rate_limits). It must run after
+// AuthMiddleware. Rejected requests get a 429 with retry-after; all requests
+// get anthropic-ratelimit-* headers. The handler reports the actual token
+// usage through the reservation in the request context.
+func RateLimitMiddleware(limiter *ratelimit.Limiter, defaults ratelimit.Limits) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			key := keystore.FromContext(r.Context())
+			if key == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			limits := defaults.Override(key.RateLimits)
+			if limits.IsZero() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The body is read here to estimate the input tokens and put
+			// back for the handler
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				apierror.Write(w, r, apierror.New(http.StatusBadRequest, "Error reading request"))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			result := limiter.Reserve(key.ID, limits, estimateInputTokens(body))
+			writeRateLimitHeaders(w, result.States)
+			if !result.Allowed {
+				seconds := int(math.Ceil(result.RetryAfter.Seconds()))
+				w.Header().Set("retry-after", fmt.Sprint(seconds))
+				utils.GetLogger().Warnf("Rate limited key %s (%s): %s per minute exceeded", key.ID, key.Owner, result.Exceeded)
+				apierror.Write(w, r, apierror.New(http.StatusTooManyRequests, "Rate limit exceeded: %s per minute for this API key; retry after %d seconds", result.Exceeded, seconds))
+				return
+			}
+
+			// Handlers settle the reservation with the actual usage; if
+			// they don't (e.g. the request was invalid), the estimate is
+			// given back
+			defer result.Reservation.Release()
+			next.ServeHTTP(w, r.WithContext(ratelimit.NewContext(r.Context(), result.Reservation)))
+		}
+	}
+}
+
+func writeRateLimitHeaders(w http.ResponseWriter, states []ratelimit.State) {
+	for _, s := range states {
+		prefix := "anthropic-ratelimit-" + s.Name
+		w.Header().Set(prefix+"-limit", fmt.Sprint(s.Limit))
+		w.Header().Set(prefix+"-remaining", fmt.Sprint(s.Remaining))
+		w.Header().Set(prefix+"-reset", s.Reset.UTC().Format(time.RFC3339))
+	}
+}
+
+// estimateInputTokens estimates the input tokens of an Anthropic or OpenAI
+// request body. A body that is not JSON is counted as text.
+func estimateInputTokens(body []byte) int {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return len(body) / bytesPerToken
+	}
+	var textBytes, tokens int
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			// Content blocks in both formats; OpenAI images may be data URLs
+			switch v["type"] {
+			case "image", "image_url":
+				tokens += imageTokens
+				return
+			case "document", "file":
+				tokens += documentTokens
+				return
+			}
+			for _, e := range v {
+				walk(e)
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		case string:
+			textBytes += len(v)
+		}
+	}
+	walk(v)
+	return tokens + textBytes/bytesPerToken
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vertexai-anthropic-proxy/keystore"
+	"vertexai-anthropic-proxy/ratelimit"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	limiter := ratelimit.New()
+	var reserved bool
+	handler := RateLimitMiddleware(limiter, ratelimit.Limits{RequestsPerMinute: 1})(func(w http.ResponseWriter, r *http.Request) {
+		reserved = ratelimit.FromContext(r.Context()) != nil
+		w.WriteHeader(http.StatusOK)
+	})
+
+	send := func(key *keystore.Key) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "claude-3-5-sonnet"}`))
+		req = req.WithContext(keystore.NewContext(req.Context(), key))
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	key := &keystore.Key{ID: "ci"}
+	rr := send(key)
+	if rr.Code != http.StatusOK || !reserved {
+		t.Fatalf("first request: status %d, reservation %v", rr.Code, reserved)
+	}
+	if got := rr.Header().Get("anthropic-ratelimit-requests-limit"); got != "1" {
+		t.Errorf("requests-limit = %q", got)
+	}
+	if got := rr.Header().Get("anthropic-ratelimit-requests-remaining"); got != "0" {
+		t.Errorf("requests-remaining = %q", got)
+	}
+
+	rr = send(key)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: status %d, want 429", rr.Code)
+	}
+	if got := rr.Header().Get("retry-after"); got != "60" {
+		t.Errorf("retry-after = %q, want 60", got)
+	}
+	if !strings.Contains(rr.Body.String(), `"type":"rate_limit_error"`) {
+		t.Errorf("body = %s", rr.Body.String())
+	}
+
+	// A key can lift the default limit
+	unlimited := &keystore.Key{ID: "batch", RateLimits: ratelimit.Limits{RequestsPerMinute: -1}}
+	for i := 0; i < 3; i++ {
+		if rr := send(unlimited); rr.Code != http.StatusOK || reserved || rr.Header().Get("anthropic-ratelimit-requests-limit") != "" {
+			t.Fatalf("unlimited key: status %d, headers %v", rr.Code, rr.Header())
+		}
+	}
+}
+
+func TestRateLimitMiddlewareImages(t *testing.T) {
+	limiter := ratelimit.New()
+	handler := RateLimitMiddleware(limiter, ratelimit.Limits{InputTokensPerMinute: 10000})(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	send := func(body string) int {
+		req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+		req = req.WithContext(keystore.NewContext(req.Context(), &keystore.Key{ID: "ci"}))
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr.Code
+	}
+
+	// A 1 MB image is charged as one image, not as 256k tokens of text
+	image := base64.StdEncoding.EncodeToString(make([]byte, 1024*1024))
+	if code := send(`{"model": "claude-3-5-sonnet", "messages": [{"role": "user", "content": [` +
+		`{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "` + image + `"}},` +
+		`{"type": "text", "text": "What is this?"}]}]}`); code != http.StatusOK {
+		t.Fatalf("image request: status %d", code)
+	}
+	if code := send(`{"model": "claude-3-5-sonnet", "messages": [{"role": "user", "content": "Hi"}]}`); code != http.StatusOK {
+		t.Errorf("text request after an image: status %d, want 200", code)
+	}
+
+	if got := estimateInputTokens([]byte(`{"messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"data:image/png;base64,` + image + `"}}]}]}`)); got > imageTokens+10 {
+		t.Errorf("OpenAI image estimated at %d tokens", got)
+	}
+}
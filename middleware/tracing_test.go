@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"vertexai-anthropic-proxy/keystore"
+)
+
+func TestTracingMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(sdktrace.NewTracerProvider()) })
+
+	keys, err := keystore.New([]*keystore.Key{{ID: "ci", Secret: "sk-ci"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := TracingMiddleware(AuthMiddleware(keys)(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest("POST", "/v1/messages", nil)
+	req.Header.Set("X-API-Key", "sk-ci")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	auth, server := spans[0], spans[1]
+	if server.Name() != "POST /v1/messages" || auth.Name() != "AuthMiddleware" {
+		t.Errorf("span names = %q, %q", server.Name(), auth.Name())
+	}
+	if got := server.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID = %s, want the client's", got)
+	}
+	if server.Parent().SpanID().String() != "00f067aa0ba902b7" || !server.Parent().IsRemote() {
+		t.Errorf("server span parent = %v, want the client's span", server.Parent())
+	}
+	if auth.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("auth span is not a child of the server span")
+	}
+}
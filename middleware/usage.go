@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"net/http"
+
+	"vertexai-anthropic-proxy/keystore"
+	"vertexai-anthropic-proxy/usage"
+	"vertexai-anthropic-proxy/utils"
+)
+
+// UsageMiddleware records the tokens and cost of each request in ledger.
+// It goes inside AuthMiddleware so the record has the key; the handlers
+// and the Vertex AI client fill in the rest of the usage.Entry in the
+// context. With a nil ledger it does nothing.
+func UsageMiddleware(ledger *usage.Ledger) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		if ledger == nil {
+			return next
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			var account usage.Account
+			if key := keystore.FromContext(r.Context()); key != nil {
+				account = usage.Account{Key: key.ID, Owner: key.Owner, Team: key.Team}
+			}
+			entry := ledger.Start(r.URL.Path, account)
+			sw := &statusWriter{ResponseWriter: w}
+
+			next.ServeHTTP(sw, r.WithContext(usage.NewContext(r.Context(), entry)))
+
+			if err := ledger.Finish(entry, sw.Status()); err != nil {
+				utils.GetLogger().Errorf("Error recording usage: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"vertexai-anthropic-proxy/keystore"
+	"vertexai-anthropic-proxy/translation"
+	"vertexai-anthropic-proxy/usage"
+)
+
+func TestUsageMiddleware(t *testing.T) {
+	ledger, err := usage.Open(filepath.Join(t.TempDir(), "usage.jsonl"), usage.DefaultPrices())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+
+	handler := UsageMiddleware(ledger)(func(w http.ResponseWriter, r *http.Request) {
+		entry := usage.FromContext(r.Context())
+		entry.SetModel("claude-3-5-sonnet", "claude-3-5-sonnet@20240620")
+		entry.SetUsage(translation.Usage{InputTokens: 10, OutputTokens: 5})
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	req := httptest.NewRequest("POST", "/v1/messages", nil)
+	req = req.WithContext(keystore.NewContext(req.Context(), &keystore.Key{ID: "ci", Owner: "build"}))
+	handler(httptest.NewRecorder(), req)
+
+	summaries, _, err := ledger.Summarize(usage.Query{GroupBy: []string{usage.GroupKey, usage.GroupModel}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].Key != "ci" || summaries[0].InputTokens != 10 || summaries[0].OutputTokens != 5 {
+		t.Errorf("summaries = %+v", summaries)
+	}
+
+	// Without a ledger the handler is called directly
+	called := false
+	UsageMiddleware(nil)(func(w http.ResponseWriter, r *http.Request) { called = true })(httptest.NewRecorder(), req)
+	if !called {
+		t.Error("handler not called without a ledger")
+	}
+}
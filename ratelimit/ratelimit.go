@@ -0,0 +1,260 @@
+// Package ratelimit limits how fast each API key may send requests and use
+// input and output tokens, with one token bucket per key and quantity.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limits are per-minute allowances. Zero means unlimited.
+type Limits struct {
+	RequestsPerMinute     int `json:"requests_per_minute,omitempty"`
+	InputTokensPerMinute  int `json:"input_tokens_per_minute,omitempty"`
+	OutputTokensPerMinute int `json:"output_tokens_per_minute,omitempty"`
+}
+
+// Override returns l with every field that is set in o replaced. A negative
+// value in o removes the limit.
+func (l Limits) Override(o Limits) Limits {
+	pick := func(base, override int) int {
+		switch {
+		case override < 0:
+			return 0
+		case override > 0:
+			return override
+		}
+		return base
+	}
+	return Limits{
+		RequestsPerMinute:     pick(l.RequestsPerMinute, o.RequestsPerMinute),
+		InputTokensPerMinute:  pick(l.InputTokensPerMinute, o.InputTokensPerMinute),
+		OutputTokensPerMinute: pick(l.OutputTokensPerMinute, o.OutputTokensPerMinute),
+	}
+}
+
+// IsZero reports whether l limits nothing.
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// Names of the limited quantities, as used in the anthropic-ratelimit-*
+// headers.
+const (
+	Requests     = "requests"
+	InputTokens  = "input-tokens"
+	OutputTokens = "output-tokens"
+)
+
+// State is the state of one bucket after a reservation, for the
+// anthropic-ratelimit-* headers.
+type State struct {
+	Name      string
+	Limit     int
+	Remaining int
+	// Reset is when the bucket will be full again
+	Reset time.Time
+}
+
+// Result is the outcome of Limiter.Reserve.
+type Result struct {
+	// Allowed is false if the request must wait; Reservation is then nil
+	Allowed     bool
+	Reservation *Reservation
+	// RetryAfter is how long to wait before the request would be allowed,
+	// and Exceeded the limit that stopped it
+	RetryAfter time.Duration
+	Exceeded   string
+	// States has one entry per limited quantity
+	States []State
+}
+
+// Limiter keeps the buckets of every key. It is safe for concurrent use.
+type Limiter struct {
+	mu   sync.Mutex
+	keys map[string]*keyBuckets
+	now  func() time.Time
+}
+
+// New returns an empty limiter.
+func New() *Limiter {
+	return &Limiter{keys: make(map[string]*keyBuckets), now: time.Now}
+}
+
+type keyBuckets struct {
+	requests, input, output bucket
+}
+
+// Reserve takes one request and inputTokens (an estimate of the request's
+// input tokens) from key's buckets, unless a bucket is short. An estimate
+// larger than the input bucket is cut to its size, so one request never
+// puts the bucket in debt before Settle knows the actual usage. Output
+// tokens are only known afterwards, so a request is admitted as long as the
+// output bucket is not in debt; Settle charges the actual usage.
+func (l *Limiter) Reserve(key string, limits Limits, inputTokens int) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	kb, ok := l.keys[key]
+	if !ok {
+		kb = &keyBuckets{}
+		l.keys[key] = kb
+	}
+	now := l.now()
+	kb.requests.configure(limits.RequestsPerMinute, now)
+	kb.input.configure(limits.InputTokensPerMinute, now)
+	kb.output.configure(limits.OutputTokensPerMinute, now)
+	if kb.input.limit > 0 && inputTokens > kb.input.limit {
+		inputTokens = kb.input.limit
+	}
+
+	checks := []struct {
+		name string
+		b    *bucket
+		need float64
+	}{
+		{Requests, &kb.requests, 1},
+		{InputTokens, &kb.input, float64(inputTokens)},
+		{OutputTokens, &kb.output, 0},
+	}
+
+	result := Result{Allowed: true}
+	for _, c := range checks {
+		if wait := c.b.wait(c.need); wait > result.RetryAfter {
+			result.Allowed = false
+			result.RetryAfter = wait
+			result.Exceeded = c.name
+		}
+	}
+	if result.Allowed {
+		kb.requests.take(1)
+		kb.input.take(float64(inputTokens))
+		result.Reservation = &Reservation{limiter: l, buckets: kb, estimate: inputTokens}
+	}
+	for _, c := range checks {
+		if c.b.limit > 0 {
+			result.States = append(result.States, c.b.state(c.name, now))
+		}
+	}
+	return result
+}
+
+// Reservation is an admitted request whose token usage is not known yet.
+type Reservation struct {
+	limiter  *Limiter
+	buckets  *keyBuckets
+	estimate int
+
+	mu      sync.Mutex
+	settled bool
+}
+
+// Settle charges the request's actual token usage, correcting the input
+// estimate taken by Reserve. Buckets may go into debt, which delays later
+// requests. Only the first call has an effect.
+func (r *Reservation) Settle(inputTokens, outputTokens int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.settled {
+		return
+	}
+	r.settled = true
+
+	r.limiter.mu.Lock()
+	defer r.limiter.mu.Unlock()
+	now := r.limiter.now()
+	r.buckets.input.refill(now)
+	r.buckets.input.take(float64(inputTokens - r.estimate))
+	r.buckets.output.refill(now)
+	r.buckets.output.take(float64(outputTokens))
+}
+
+// Release gives back the input estimate of a request that never reached
+// Vertex AI, e.g. because it was invalid. The request itself still counts.
+// It does nothing after Settle.
+func (r *Reservation) Release() {
+	r.Settle(0, 0)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying r.
+func NewContext(ctx context.Context, r *Reservation) context.Context {
+	return context.WithValue(ctx, contextKey{}, r)
+}
+
+// FromContext returns the request's reservation, or nil if the request is
+// not rate limited.
+func FromContext(ctx context.Context) *Reservation {
+	r, _ := ctx.Value(contextKey{}).(*Reservation)
+	return r
+}
+
+// bucket is a token bucket holding up to limit tokens and refilling at
+// limit per minute. A limit of 0 disables it.
+type bucket struct {
+	limit  int
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) configure(limit int, now time.Time) {
+	if limit != b.limit {
+		if b.limit == 0 || b.tokens > float64(limit) {
+			// A new bucket starts full
+			b.tokens = float64(limit)
+		}
+		b.limit = limit
+		b.last = now
+	}
+	b.refill(now)
+}
+
+func (b *bucket) rate() float64 {
+	return float64(b.limit) / float64(time.Minute)
+}
+
+func (b *bucket) refill(now time.Time) {
+	if b.limit == 0 {
+		return
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit), b.tokens+float64(elapsed)*b.rate())
+	}
+	b.last = now
+}
+
+// wait returns how long until n tokens are available. n is capped at the
+// limit, so a request larger than the whole bucket is let through once the
+// bucket is full. With n = 0 it only waits for a bucket in debt.
+func (b *bucket) wait(n float64) time.Duration {
+	if b.limit == 0 {
+		return 0
+	}
+	n = math.Min(n, float64(b.limit))
+	missing := n - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(missing / b.rate()))
+}
+
+func (b *bucket) take(n float64) {
+	if b.limit == 0 {
+		return
+	}
+	b.tokens = math.Min(float64(b.limit), b.tokens-n)
+}
+
+func (b *bucket) state(name string, now time.Time) State {
+	s := State{Name: name, Limit: b.limit, Reset: now}
+	if b.tokens > 0 {
+		s.Remaining = int(b.tokens)
+	}
+	if missing := float64(b.limit) - b.tokens; missing > 0 {
+		s.Reset = now.Add(time.Duration(math.Ceil(missing / b.rate())))
+	}
+	return s
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLimiter() (*Limiter, *time.Time) {
+	now := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	l := New()
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestReserveRequests(t *testing.T) {
+	l, now := newTestLimiter()
+	limits := Limits{RequestsPerMinute: 2}
+
+	for i := 0; i < 2; i++ {
+		if res := l.Reserve("a", limits, 0); !res.Allowed {
+			t.Fatalf("request %d rejected", i+1)
+		}
+	}
+	res := l.Reserve("a", limits, 0)
+	if res.Allowed || res.Exceeded != Requests {
+		t.Fatalf("third request: %+v, want requests exceeded", res)
+	}
+	// One request refills every 30s
+	if res.RetryAfter != 30*time.Second {
+		t.Errorf("RetryAfter = %v, want 30s", res.RetryAfter)
+	}
+
+	// Keys have separate buckets
+	if res := l.Reserve("b", limits, 0); !res.Allowed {
+		t.Error("other key rejected")
+	}
+
+	*now = now.Add(30 * time.Second)
+	res = l.Reserve("a", limits, 0)
+	if !res.Allowed {
+		t.Fatal("request after refill rejected")
+	}
+	if len(res.States) != 1 || res.States[0].Remaining != 0 || !res.States[0].Reset.Equal(now.Add(time.Minute)) {
+		t.Errorf("States = %+v", res.States)
+	}
+}
+
+func TestReserveTokens(t *testing.T) {
+	l, now := newTestLimiter()
+	limits := Limits{InputTokensPerMinute: 1000, OutputTokensPerMinute: 600}
+
+	res := l.Reserve("a", limits, 400)
+	if !res.Allowed {
+		t.Fatal("first request rejected")
+	}
+	// The estimate was too low, and the output uses more than the bucket
+	res.Reservation.Settle(900, 900)
+
+	res = l.Reserve("a", limits, 100)
+	if res.Allowed {
+		t.Fatal("request admitted with the output bucket in debt")
+	}
+	// Output is 300 in debt at 10 tokens per second
+	if res.Exceeded != OutputTokens || res.RetryAfter != 30*time.Second {
+		t.Errorf("got %s for %v, want output-tokens for 30s", res.Exceeded, res.RetryAfter)
+	}
+
+	*now = now.Add(30 * time.Second)
+	res = l.Reserve("a", limits, 100)
+	if !res.Allowed {
+		t.Fatalf("request after 30s rejected: %+v", res)
+	}
+	// A request larger than the whole bucket waits for a full bucket
+	// rather than forever
+	res.Reservation.Release()
+	*now = now.Add(time.Minute)
+	res = l.Reserve("a", limits, 5000)
+	if !res.Allowed {
+		t.Fatalf("oversized request rejected with a full bucket: %+v", res)
+	}
+	// and takes only the whole bucket, so the next request waits for 100
+	// tokens to refill rather than for 4000 tokens of debt
+	*now = now.Add(6 * time.Second)
+	if res := l.Reserve("a", limits, 100); !res.Allowed {
+		t.Errorf("request after an oversized estimate rejected: %+v", res)
+	}
+}
+
+func TestReleaseRefundsEstimate(t *testing.T) {
+	l, _ := newTestLimiter()
+	limits := Limits{InputTokensPerMinute: 1000}
+
+	res := l.Reserve("a", limits, 800)
+	res.Reservation.Release()
+	res.Reservation.Settle(800, 0) // ignored after Release
+	if res := l.Reserve("a", limits, 800); !res.Allowed {
+		t.Errorf("estimate was not refunded: %+v", res)
+	}
+}
+
+func TestOverride(t *testing.T) {
+	defaults := Limits{RequestsPerMinute: 60, InputTokensPerMinute: 1000}
+	got := defaults.Override(Limits{RequestsPerMinute: 10, InputTokensPerMinute: -1, OutputTokensPerMinute: 500})
+	want := Limits{RequestsPerMinute: 10, OutputTokensPerMinute: 500}
+	if got != want {
+		t.Errorf("Override() = %+v, want %+v", got, want)
+	}
+	if !(Limits{}).IsZero() || defaults.IsZero() {
+		t.Error("IsZero() is wrong")
+	}
+}
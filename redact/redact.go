@@ -0,0 +1,131 @@
+// Package redact keeps secrets and prompts out of the logs: API keys are
+// logged as fingerprints, and request and response bodies only as much as
+// LOG_BODIES allows.
+package redact
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Fingerprint identifies a secret in logs without revealing it: a short
+// prefix of its SHA-256, e.g. "sha256:3f2a9c0d41b7".
+func Fingerprint(secret string) string {
+	if secret == "" {
+		return "none"
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// BodyMode controls how request and response bodies are logged.
+type BodyMode string
+
+const (
+	// BodiesOff logs nothing about bodies
+	BodiesOff BodyMode = "off"
+	// BodiesMetadata logs the size and a few non-content fields such as
+	// the model, max_tokens and the number of messages
+	BodiesMetadata BodyMode = "metadata"
+	// BodiesTruncated logs the first bytes of the body
+	BodiesTruncated BodyMode = "truncated"
+	// BodiesFull logs the whole body, prompts included
+	BodiesFull BodyMode = "full"
+)
+
+// DefaultTruncateBytes is how much of a body BodiesTruncated logs when no
+// limit is configured.
+const DefaultTruncateBytes = 512
+
+// ParseBodyMode reads a LOG_BODIES setting. An empty value means metadata.
+func ParseBodyMode(s string) (BodyMode, error) {
+	switch mode := BodyMode(strings.ToLower(s)); mode {
+	case "":
+		return BodiesMetadata, nil
+	case BodiesOff, BodiesMetadata, BodiesTruncated, BodiesFull:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown body logging mode %q (want off, metadata, truncated or full)", s)
+}
+
+// Bodies renders bodies for logging according to Mode.
+type Bodies struct {
+	Mode BodyMode
+	// MaxBytes is the BodiesTruncated limit; 0 uses DefaultTruncateBytes
+	MaxBytes int
+}
+
+// Render returns what may be logged of body, and false if nothing may.
+func (b Bodies) Render(body []byte) (string, bool) {
+	switch b.Mode {
+	case BodiesOff:
+		return "", false
+	case BodiesFull:
+		return string(body), true
+	case BodiesTruncated:
+		limit := b.MaxBytes
+		if limit <= 0 {
+			limit = DefaultTruncateBytes
+		}
+		if len(body) <= limit {
+			return string(body), true
+		}
+		return fmt.Sprintf("%s... (%d bytes)", body[:limit], len(body)), true
+	}
+	return Metadata(body), true
+}
+
+// metadataFields are top-level fields safe to log: they describe a request
+// or response without containing prompt or completion text.
+var metadataFields = []string{"model", "max_tokens", "stream", "stop_reason", "id", "usage"}
+
+// countedFields are top-level arrays whose length is logged.
+var countedFields = []string{"messages", "tools", "content", "choices"}
+
+// Metadata summarises a JSON body as "bytes=1234 model=... messages=3".
+// Bodies that are not JSON objects are reduced to their size.
+func Metadata(body []byte) string {
+	parts := []string{fmt.Sprintf("bytes=%d", len(body))}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return parts[0]
+	}
+	for _, name := range metadataFields {
+		if value, ok := fields[name]; ok {
+			parts = append(parts, name+"="+compact(value))
+		}
+	}
+	for _, name := range countedFields {
+		var items []json.RawMessage
+		if json.Unmarshal(fields[name], &items) == nil && items != nil {
+			parts = append(parts, fmt.Sprintf("%s=%d", name, len(items)))
+		}
+	}
+	if _, ok := fields["system"]; ok {
+		parts = append(parts, "system=yes")
+	}
+	if len(parts) == 1 {
+		// Name the fields so unfamiliar bodies are still recognisable
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		parts = append(parts, "fields="+strings.Join(names, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func compact(value json.RawMessage) string {
+	var b bytes.Buffer
+	if err := json.Compact(&b, value); err != nil {
+		return string(value)
+	}
+	return b.String()
+}
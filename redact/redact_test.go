@@ -0,0 +1,83 @@
+package redact
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	fp := Fingerprint("sk-secret-key")
+	if !strings.HasPrefix(fp, "sha256:") || len(fp) != len("sha256:")+12 {
+		t.Errorf("Fingerprint() = %q", fp)
+	}
+	if strings.Contains(fp, "secret") {
+		t.Errorf("Fingerprint() leaks the key: %q", fp)
+	}
+	if Fingerprint("sk-secret-key") != fp || Fingerprint("other") == fp {
+		t.Error("Fingerprint() is not a stable, distinct identifier")
+	}
+	if got := Fingerprint(""); got != "none" {
+		t.Errorf("Fingerprint(\"\") = %q, want none", got)
+	}
+}
+
+func TestParseBodyMode(t *testing.T) {
+	tests := map[string]BodyMode{
+		"":          BodiesMetadata,
+		"off":       BodiesOff,
+		"Truncated": BodiesTruncated,
+		"full":      BodiesFull,
+	}
+	for in, want := range tests {
+		got, err := ParseBodyMode(in)
+		if err != nil || got != want {
+			t.Errorf("ParseBodyMode(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseBodyMode("everything"); err == nil {
+		t.Error("ParseBodyMode accepted an unknown mode")
+	}
+}
+
+func TestRender(t *testing.T) {
+	body := []byte(`{"model": "claude-3-5-sonnet", "max_tokens": 100, "system": "be terse", "messages": [{"role": "user", "content": "my password is hunter2"}]}`)
+
+	if _, ok := (Bodies{Mode: BodiesOff}).Render(body); ok {
+		t.Error("off mode logged the body")
+	}
+	if got, _ := (Bodies{Mode: BodiesFull}).Render(body); got != string(body) {
+		t.Errorf("full mode = %q", got)
+	}
+
+	got, _ := (Bodies{Mode: BodiesTruncated, MaxBytes: 10}).Render(body)
+	want := string(body[:10]) + "... (" + strconv.Itoa(len(body)) + " bytes)"
+	if got != want {
+		t.Errorf("truncated mode = %q, want %q", got, want)
+	}
+
+	got, ok := (Bodies{Mode: BodiesMetadata}).Render(body)
+	want = "bytes=" + strconv.Itoa(len(body)) + ` model="claude-3-5-sonnet" max_tokens=100 messages=1 system=yes`
+	if !ok || got != want {
+		t.Errorf("metadata mode = %q, want %q", got, want)
+	}
+	if strings.Contains(got, "hunter2") || strings.Contains(got, "terse") {
+		t.Errorf("metadata mode leaked content: %q", got)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`not json`, "bytes=8"},
+		{`{"usage":{"input_tokens": 3},"content":[{},{}],"stop_reason":"end_turn"}`, `bytes=72 stop_reason="end_turn" usage={"input_tokens":3} content=2`},
+		{`{"b":"x","a":"y"}`, "bytes=17 fields=a,b"},
+	}
+	for _, tt := range tests {
+		if got := Metadata([]byte(tt.body)); got != tt.want {
+			t.Errorf("Metadata(%s) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package replay
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+
+	"vertexai-anthropic-proxy/capture"
+	"vertexai-anthropic-proxy/utils"
+)
+
+// Recorder is an http.RoundTripper that sends requests to Vertex AI with
+// base and appends each request and its response to a capture file, for a
+// Player to replay. Every attempt is a record of its own, failed ones
+// included.
+type Recorder struct {
+	base http.RoundTripper
+	sink *capture.Sink
+}
+
+// NewRecorder returns a Recorder that sends requests with base and records
+// them in the capture file at path.
+func NewRecorder(path string, base http.RoundTripper) (*Recorder, error) {
+	sink, err := capture.Open(path, capture.Options{SampleRate: 1})
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{base: base, sink: sink}, nil
+}
+
+// Close closes the capture file.
+func (r *Recorder) Close() error {
+	return r.sink.Close()
+}
+
+// RoundTrip sends req and records it. A successful response is recorded
+// as the caller reads it, and written out once the body is closed.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	vertexModel, stream, err := parseURL(req)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		// Leave the caller's request as it was
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	// The body is only kept in the vertex request
+	x := r.sink.Start(req, nil)
+	x.VertexRequest(vertexModel, stream, body)
+	attempt := x.Attempt(req.URL.Host, req.URL.String())
+
+	resp, err := r.base.RoundTrip(req)
+	if err != nil {
+		attempt.Fail(err)
+		r.finish(x, 0)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			attempt.Fail(err)
+			r.finish(x, 0)
+			return nil, err
+		}
+		attempt.Rejected(resp.StatusCode, data)
+		r.finish(x, resp.StatusCode)
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		return resp, nil
+	}
+
+	resp.Body = &finishOnClose{ReadCloser: attempt.Response(resp.Body, stream), fn: func() {
+		r.finish(x, http.StatusOK)
+	}}
+	return resp, nil
+}
+
+func (r *Recorder) finish(x *capture.Exchange, status int) {
+	if err := r.sink.Finish(x, status); err != nil {
+		utils.GetLogger().Errorf("Error writing recording: %v", err)
+	}
+}
+
+// finishOnClose calls fn once, when the body is first closed.
+type finishOnClose struct {
+	io.ReadCloser
+	once sync.Once
+	fn   func()
+}
+
+func (b *finishOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.fn)
+	return err
+}
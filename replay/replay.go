@@ -0,0 +1,251 @@
+// Package replay stands in for Vertex AI with recorded responses, so the
+// proxy can run in CI and local development without network access or
+// Google credentials. Recordings are capture files: those written by
+// CAPTURE_FILE and by VERTEX_MODE=record alike. Requests are matched by
+// capture.RequestHash, and streams are played back with their recorded
+// timing.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"vertexai-anthropic-proxy/capture"
+)
+
+// recording is one response Vertex AI gave to a request.
+type recording struct {
+	status int
+	body   []byte
+	// events are the events of a stream, delayed from the response
+	// headers by their offsets
+	events  []capture.Event
+	latency time.Duration
+	stream  bool
+}
+
+// Player is an http.RoundTripper that answers requests to Vertex AI with
+// the recordings in a capture file. A request recorded several times is
+// answered with each recording in turn, so a recorded 503 followed by the
+// retry's 200 is played back the same way.
+type Player struct {
+	path string
+	// speed divides the recorded delays; 0 plays without delays
+	speed float64
+	sleep func(*http.Request, time.Duration) error
+
+	mu         sync.Mutex
+	recordings map[string][]recording
+	next       map[string]int
+}
+
+// Open loads the recordings in the capture file at path, to be played at
+// speed times the recorded pace.
+func Open(path string, speed float64) (*Player, error) {
+	if speed < 0 {
+		return nil, fmt.Errorf("replay speed %v is negative", speed)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &Player{
+		path:       path,
+		speed:      speed,
+		sleep:      sleep,
+		recordings: make(map[string][]recording),
+		next:       make(map[string]int),
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var rec capture.Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		p.add(rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// add indexes the answered attempts of rec. Attempts without a response,
+// such as network errors, cannot be played back and are skipped.
+func (p *Player) add(rec capture.Record) {
+	if rec.Vertex == nil || rec.Vertex.Hash == "" {
+		return
+	}
+	for _, attempt := range rec.Attempts {
+		if attempt.Status == 0 {
+			continue
+		}
+		r := recording{
+			status:  attempt.Status,
+			latency: time.Duration(attempt.HeadersMS-attempt.OffsetMS) * time.Millisecond,
+			stream:  rec.Vertex.Stream && attempt.Status == http.StatusOK,
+		}
+		if r.stream {
+			r.events = attempt.Events
+			for i := range r.events {
+				r.events[i].OffsetMS -= attempt.HeadersMS
+			}
+		} else {
+			r.body = attempt.Body
+		}
+		p.recordings[rec.Vertex.Hash] = append(p.recordings[rec.Vertex.Hash], r)
+	}
+}
+
+// Len returns the number of distinct requests recorded.
+func (p *Player) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.recordings)
+}
+
+// RoundTrip answers req with its next recording. A request that was never
+// recorded gets a 404 naming its hash, which Vertex AI clients do not
+// retry.
+func (p *Player) RoundTrip(req *http.Request) (*http.Response, error) {
+	vertexModel, stream, err := parseURL(req)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	hash := capture.RequestHash(vertexModel, stream, body)
+
+	r, ok := p.recording(hash)
+	if !ok {
+		message := fmt.Sprintf("replay: no recording of this request to %s in %s (hash %s)", vertexModel, p.path, hash)
+		data, _ := json.Marshal(map[string]interface{}{
+			"error": map[string]interface{}{"code": http.StatusNotFound, "message": message, "status": "NOT_FOUND"},
+		})
+		return response(req, http.StatusNotFound, "application/json", io.NopCloser(bytes.NewReader(data))), nil
+	}
+
+	if err := p.sleep(req, p.delay(r.latency)); err != nil {
+		return nil, err
+	}
+	if !r.stream {
+		return response(req, r.status, "application/json", io.NopCloser(bytes.NewReader(r.body))), nil
+	}
+
+	pr, pw := io.Pipe()
+	go p.play(req, r.events, pw)
+	return response(req, r.status, "text/event-stream", pr), nil
+}
+
+// recording returns the next recording of the request with hash.
+func (p *Player) recording(hash string) (recording, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	recordings := p.recordings[hash]
+	if len(recordings) == 0 {
+		return recording{}, false
+	}
+	i := p.next[hash]
+	p.next[hash] = (i + 1) % len(recordings)
+	return recordings[i], true
+}
+
+// play writes events to w as a server-sent event stream, each at its
+// offset from the start. It stops early if the request is cancelled.
+func (p *Player) play(req *http.Request, events []capture.Event, w *io.PipeWriter) {
+	start := time.Now()
+	for _, ev := range events {
+		due := p.delay(time.Duration(ev.OffsetMS) * time.Millisecond)
+		if err := p.sleep(req, due-time.Since(start)); err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		if _, err := io.WriteString(w, frame(ev)); err != nil {
+			return
+		}
+	}
+	w.Close()
+}
+
+func (p *Player) delay(d time.Duration) time.Duration {
+	if p.speed == 0 {
+		return 0
+	}
+	return time.Duration(float64(d) / p.speed)
+}
+
+// frame formats ev as it was sent. Data recorded as a JSON string, because
+// it was not JSON, is sent as the string.
+func frame(ev capture.Event) string {
+	data := string(ev.Data)
+	var s string
+	if strings.HasPrefix(data, `"`) && json.Unmarshal(ev.Data, &s) == nil {
+		data = s
+	}
+	var b strings.Builder
+	if ev.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", ev.Event)
+	}
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// sleep waits for d or until req is cancelled.
+func sleep(req *http.Request, d time.Duration) error {
+	if d <= 0 {
+		return req.Context().Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// parseURL returns the model ID of a rawPredict or streamRawPredict URL,
+// and whether it streams.
+func parseURL(req *http.Request) (vertexModel string, stream bool, err error) {
+	path := req.URL.Path
+	last := path[strings.LastIndex(path, "/")+1:]
+	vertexModel, method, ok := strings.Cut(last, ":")
+	if !ok || (method != "rawPredict" && method != "streamRawPredict") {
+		return "", false, fmt.Errorf("replay: not a Vertex AI prediction URL: %s", req.URL)
+	}
+	return vertexModel, method == "streamRawPredict", nil
+}
+
+func response(req *http.Request, status int, contentType string, body io.ReadCloser) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       body,
+		Request:    req,
+	}
+}
@@ -0,0 +1,150 @@
+package replay
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"vertexai-anthropic-proxy/capture"
+)
+
+const (
+	streamPath = "/v1/projects/p/locations/us-east5/publishers/anthropic/models/claude-3-5-sonnet@20240620:streamRawPredict"
+	rawPath    = "/v1/projects/p/locations/us-east5/publishers/anthropic/models/claude-3-5-sonnet@20240620:rawPredict"
+	stream     = "event: message_start\ndata: {\"type\":\"message_start\"}\n\n" +
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"text\":\"Hi\"}}\n\n" +
+		"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"
+	message = `{"id":"msg_01","content":[{"type":"text","text":"Hello"}]}`
+)
+
+func post(t *testing.T, transport http.RoundTripper, url, body string) (int, string) {
+	t.Helper()
+	resp, err := (&http.Client{Transport: transport}).Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch {
+		case r.URL.Path == streamPath && calls == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `{"error":{"code":503,"message":"overloaded"}}`)
+		case r.URL.Path == streamPath:
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, stream)
+		default:
+			io.WriteString(w, message)
+		}
+	}))
+	path := filepath.Join(t.TempDir(), "fixtures.jsonl")
+	recorder, err := NewRecorder(path, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streamBody := `{"anthropic_version":"vertex-2023-10-16","stream":true,"max_tokens":10}`
+	if status, _ := post(t, recorder, server.URL+streamPath, streamBody); status != http.StatusServiceUnavailable {
+		t.Fatalf("first recorded status = %d", status)
+	}
+	if status, body := post(t, recorder, server.URL+streamPath, streamBody); status != http.StatusOK || body != stream {
+		t.Fatalf("recorded stream = %d %q", status, body)
+	}
+	if status, body := post(t, recorder, server.URL+rawPath, `{"max_tokens":10}`); status != http.StatusOK || body != message {
+		t.Fatalf("recorded message = %d %q", status, body)
+	}
+	recorder.Close()
+	server.Close()
+
+	player, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if player.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", player.Len())
+	}
+
+	// The backend and the layout of the JSON do not matter
+	elsewhere := "https://europe-west1-aiplatform.googleapis.com"
+	reordered := `{"max_tokens": 10, "stream": true, "anthropic_version": "vertex-2023-10-16"}`
+	for i, want := range []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusServiceUnavailable} {
+		status, body := post(t, player, elsewhere+streamPath, reordered)
+		if status != want {
+			t.Errorf("replay %d: status = %d, want %d", i, status, want)
+		}
+		if status == http.StatusOK && body != stream {
+			t.Errorf("replayed stream = %q, want %q", body, stream)
+		}
+	}
+	if status, body := post(t, player, elsewhere+rawPath, `{"max_tokens":10}`); status != http.StatusOK || body != message {
+		t.Errorf("replayed message = %d %q", status, body)
+	}
+
+	status, body := post(t, player, elsewhere+rawPath, `{"max_tokens":20}`)
+	if status != http.StatusNotFound || !strings.Contains(body, "no recording of this request") {
+		t.Errorf("unrecorded request = %d %s", status, body)
+	}
+}
+
+func TestReplayTiming(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixtures.jsonl")
+	record := `{"id":"1","time":"2024-07-01T12:00:00Z","request":{"method":"POST","path":"/v1/messages"},` +
+		`"vertex_request":{"model":"claude-3-5-sonnet@20240620","stream":true,"hash":"HASH","offset_ms":5,"body":{"stream":true}},` +
+		`"attempts":[{"backend":"p/us-east5","url":"x","offset_ms":5,"headers_ms":405,"status":200,"events":[` +
+		`{"offset_ms":605,"event":"message_start","data":{"type":"message_start"}},` +
+		`{"offset_ms":1405,"event":"message_stop","data":{"type":"message_stop"}}],"done_ms":1405}],"status":200,"duration_ms":1410}`
+	record = strings.Replace(record, "HASH", capture.RequestHash("claude-3-5-sonnet@20240620", true, []byte(`{"stream":true}`)), 1)
+	if err := os.WriteFile(path, []byte(record+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	player, err := Open(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delays []time.Duration
+	player.sleep = func(req *http.Request, d time.Duration) error {
+		delays = append(delays, d.Round(10*time.Millisecond))
+		return nil
+	}
+	if _, body := post(t, player, "http://replay"+streamPath, `{"stream":true}`); !strings.HasSuffix(body, "data: {\"type\":\"message_stop\"}\n\n") {
+		t.Errorf("body = %q", body)
+	}
+	// Half the recorded latency of 400ms, then the events 200ms and 1s
+	// after the headers
+	want := []time.Duration{200 * time.Millisecond, 100 * time.Millisecond, 500 * time.Millisecond}
+	if len(delays) != len(want) {
+		t.Fatalf("delays = %v, want %v", delays, want)
+	}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Errorf("delays = %v, want %v", delays, want)
+			break
+		}
+	}
+
+	// A cancelled request gets no response
+	player.sleep = sleep
+	player.speed = 0.001
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, "POST", "http://replay"+streamPath, strings.NewReader(`{"stream":true}`))
+	if _, err := player.RoundTrip(req); err == nil {
+		t.Error("RoundTrip() of a cancelled request should fail")
+	}
+}
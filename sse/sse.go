@@ -0,0 +1,188 @@
+package sse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Large tool inputs can arrive as a single data line
+const maxLineSize = 1024 * 1024
+
+// Event is a single server-sent event. A comment line (": ping") is
+// reported as an Event with only Comment set.
+type Event struct {
+	Event   string
+	Data    string
+	ID      string
+	Retry   int
+	Comment string
+
+	// comment is set by Reader for comment lines, which may be empty
+	comment bool
+}
+
+// IsComment reports whether e is a comment: one read from a comment line,
+// or one with only Comment set.
+func (e Event) IsComment() bool {
+	return e.comment || e.Comment != "" && e.Event == "" && e.Data == "" && e.ID == ""
+}
+
+// Reader parses a text/event-stream as described in the HTML Living
+// Standard, preserving event names, ids, comments and multi-line data.
+type Reader struct {
+	scanner *bufio.Scanner
+}
+
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	scanner.Split(scanLines)
+	return &Reader{scanner: scanner}
+}
+
+// Next returns the next event or comment. It returns io.EOF once the stream
+// ends; an event that is not terminated by a blank line is still returned.
+func (r *Reader) Next() (Event, error) {
+	var ev Event
+	var data []string
+	pending := false
+
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+
+		if line == "" {
+			if !pending {
+				continue
+			}
+			ev.Data = strings.Join(data, "\n")
+			return ev, nil
+		}
+
+		if strings.HasPrefix(line, ":") {
+			comment := strings.TrimPrefix(strings.TrimPrefix(line, ":"), " ")
+			if !pending {
+				return Event{Comment: comment, comment: true}, nil
+			}
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		pending = true
+
+		switch field {
+		case "event":
+			ev.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			ev.ID = value
+		case "retry":
+			if retry, err := strconv.Atoi(value); err == nil {
+				ev.Retry = retry
+			}
+		}
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return Event{}, err
+	}
+	if pending {
+		ev.Data = strings.Join(data, "\n")
+		return ev, nil
+	}
+	return Event{}, io.EOF
+}
+
+// scanLines splits on \n, \r\n or a lone \r.
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	for i, b := range data {
+		switch b {
+		case '\n':
+			return i + 1, data[:i], nil
+		case '\r':
+			if i+1 < len(data) {
+				if data[i+1] == '\n' {
+					return i + 2, data[:i], nil
+				}
+				return i + 1, data[:i], nil
+			}
+			if atEOF {
+				return i + 1, data[:i], nil
+			}
+			// Need more data to tell \r from \r\n
+			return 0, nil, nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Writer writes events to an HTTP response, flushing after each one so
+// clients see them immediately.
+type Writer struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+// NewWriter sets the event-stream headers on w and returns a Writer for it.
+// It must be called before anything is written to w.
+func NewWriter(w http.ResponseWriter) *Writer {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	flusher, _ := w.(http.Flusher)
+	return &Writer{w: w, flusher: flusher}
+}
+
+func (sw *Writer) WriteEvent(ev Event) error {
+	if ev.IsComment() {
+		return sw.WriteComment(ev.Comment)
+	}
+
+	var b strings.Builder
+	if ev.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", ev.Event)
+	}
+	if ev.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", ev.ID)
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", ev.Retry)
+	}
+	for _, line := range strings.Split(ev.Data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+
+	return sw.write(b.String())
+}
+
+// WriteData writes an unnamed event, as used by the OpenAI streaming format.
+func (sw *Writer) WriteData(data string) error {
+	return sw.WriteEvent(Event{Data: data})
+}
+
+func (sw *Writer) WriteComment(comment string) error {
+	if comment == "" {
+		return sw.write(":\n\n")
+	}
+	return sw.write(fmt.Sprintf(": %s\n\n", comment))
+}
+
+func (sw *Writer) write(s string) error {
+	if _, err := io.WriteString(sw.w, s); err != nil {
+		return err
+	}
+	if sw.flusher != nil {
+		sw.flusher.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package sse
+
+import (
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	stream := "event: message_start\n" +
+		"data: {\"type\":\"message_start\"}\n" +
+		"\n" +
+		": keep-alive\n" +
+		"\n" +
+		"event:ping\r\n" +
+		"data:{\"type\": \"ping\"}\r\n" +
+		"\r\n" +
+		"id: 7\n" +
+		"retry: 3000\n" +
+		"data: line one\n" +
+		"data: line two\n" +
+		"\n" +
+		"event: error\n" +
+		"data: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n"
+
+	want := []Event{
+		{Event: "message_start", Data: `{"type":"message_start"}`},
+		{Comment: "keep-alive", comment: true},
+		{Event: "ping", Data: `{"type": "ping"}`},
+		{ID: "7", Retry: 3000, Data: "line one\nline two"},
+		{Event: "error", Data: `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`},
+	}
+
+	r := NewReader(strings.NewReader(stream))
+	var got []Event
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, ev)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %#v\nwant %#v", got, want)
+	}
+}
+
+func TestReaderLongLine(t *testing.T) {
+	data := strings.Repeat("x", 200*1024)
+	r := NewReader(strings.NewReader("data: " + data + "\n\n"))
+	ev, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if ev.Data != data {
+		t.Errorf("got %d bytes of data, want %d", len(ev.Data), len(data))
+	}
+}
+
+func TestWriter(t *testing.T) {
+	rr := httptest.NewRecorder()
+	w := NewWriter(rr)
+
+	w.WriteEvent(Event{Event: "content_block_delta", Data: `{"type":"content_block_delta"}`})
+	w.WriteEvent(Event{Comment: "ping"})
+	w.WriteEvent(Event{Data: "a\nb"})
+	w.WriteData("[DONE]")
+
+	want := "event: content_block_delta\ndata: {\"type\":\"content_block_delta\"}\n\n" +
+		": ping\n\n" +
+		"data: a\ndata: b\n\n" +
+		"data: [DONE]\n\n"
+	if rr.Body.String() != want {
+		t.Errorf("body = %q, want %q", rr.Body.String(), want)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !rr.Flushed {
+		t.Error("expected writer to flush")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	events := []Event{
+		{Event: "message_start", Data: `{"type":"message_start"}`},
+		{Comment: "ping", comment: true},
+		{Event: "message_stop", Data: "multi\nline"},
+	}
+
+	rr := httptest.NewRecorder()
+	w := NewWriter(rr)
+	for _, ev := range events {
+		w.WriteEvent(ev)
+	}
+
+	r := NewReader(rr.Body)
+	for i, want := range events {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("event %d = %#v, want %#v", i, got, want)
+		}
+	}
+}
+
+func TestRoundTripEmptyComment(t *testing.T) {
+	ev, err := NewReader(strings.NewReader(":\n\n")).Next()
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if !ev.IsComment() {
+		t.Fatalf("event = %#v, want a comment", ev)
+	}
+
+	rr := httptest.NewRecorder()
+	NewWriter(rr).WriteEvent(ev)
+	if rr.Body.String() != ":\n\n" {
+		t.Errorf("body = %q, want a bare comment", rr.Body.String())
+	}
+}
@@ -0,0 +1,22 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	for _, exporter := range []string{"", ExporterNone, ExporterConsole} {
+		shutdown, err := Setup(context.Background(), exporter)
+		if err != nil {
+			t.Errorf("Setup(%q): %v", exporter, err)
+			continue
+		}
+		if err := shutdown(context.Background()); err != nil {
+			t.Errorf("shutdown of %q: %v", exporter, err)
+		}
+	}
+	if _, err := Setup(context.Background(), "jaeger"); err == nil {
+		t.Error("Setup accepted an unknown exporter")
+	}
+}
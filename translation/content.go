@@ -0,0 +1,143 @@
+package translation
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Limits enforced by the Anthropic API; checking them here gives clients a
+// clear error instead of an opaque rejection from Vertex AI.
+const (
+	maxImageBytes       = 5 * 1024 * 1024
+	maxDocumentBytes    = 32 * 1024 * 1024
+	maxImagesPerRequest = 100
+)
+
+var supportedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+func validateMessages(messages []Message) error {
+	images := 0
+	for i, msg := range messages {
+		if err := validateContent(msg.Content, fmt.Sprintf("messages.%d.content", i), &images); err != nil {
+			return err
+		}
+	}
+	if images > maxImagesPerRequest {
+		return fmt.Errorf("messages: at most %d images are allowed per request, got %d", maxImagesPerRequest, images)
+	}
+	return nil
+}
+
+func validateContent(content MessageContent, path string, images *int) error {
+	for i, block := range content {
+		blockPath := fmt.Sprintf("%s.%d", path, i)
+		switch block.Type {
+		case "image":
+			*images++
+			if err := validateImageSource(block.Source, blockPath+".source"); err != nil {
+				return err
+			}
+		case "document":
+			if err := validateDocumentSource(block.Source, blockPath+".source"); err != nil {
+				return err
+			}
+		case "tool_result":
+			if err := validateContent(block.Content, blockPath+".content", images); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateImageSource(src *ContentSource, path string) error {
+	if src == nil {
+		return fmt.Errorf("%s: field required", path)
+	}
+	switch src.Type {
+	case "base64":
+		if !supportedImageTypes[src.MediaType] {
+			return fmt.Errorf("%s.media_type: unsupported image type %q", path, src.MediaType)
+		}
+		return validateBase64Size(src.Data, maxImageBytes, path)
+	case "url":
+		return validateSourceURL(src.URL, path)
+	}
+	return fmt.Errorf("%s.type: unsupported image source %q", path, src.Type)
+}
+
+func validateDocumentSource(src *ContentSource, path string) error {
+	if src == nil {
+		return fmt.Errorf("%s: field required", path)
+	}
+	switch src.Type {
+	case "base64":
+		if src.MediaType != "application/pdf" {
+			return fmt.Errorf("%s.media_type: unsupported document type %q", path, src.MediaType)
+		}
+		return validateBase64Size(src.Data, maxDocumentBytes, path)
+	case "text":
+		if src.MediaType != "text/plain" {
+			return fmt.Errorf("%s.media_type: text documents must be text/plain", path)
+		}
+		if len(src.Data) > maxDocumentBytes {
+			return fmt.Errorf("%s.data: document exceeds %d bytes", path, maxDocumentBytes)
+		}
+		return nil
+	case "url":
+		return validateSourceURL(src.URL, path)
+	}
+	return fmt.Errorf("%s.type: unsupported document source %q", path, src.Type)
+}
+
+func validateBase64Size(data string, limit int, path string) error {
+	if data == "" {
+		return fmt.Errorf("%s.data: field required", path)
+	}
+	// Check the encoded length first so oversized payloads are not decoded
+	if base64.StdEncoding.DecodedLen(len(data)) > limit+2 {
+		return fmt.Errorf("%s.data: exceeds %d bytes", path, limit)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return fmt.Errorf("%s.data: invalid base64 data", path)
+	}
+	if len(decoded) > limit {
+		return fmt.Errorf("%s.data: exceeds %d bytes", path, limit)
+	}
+	return nil
+}
+
+func validateSourceURL(raw, path string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%s.url: must be an absolute http(s) URL", path)
+	}
+	return nil
+}
+
+// sourceFromURL builds a content source from an OpenAI image or file URL,
+// which is either a data URI or a plain http(s) URL.
+func sourceFromURL(raw string) (*ContentSource, error) {
+	if !strings.HasPrefix(raw, "data:") {
+		return &ContentSource{Type: "url", URL: raw}, nil
+	}
+
+	// data:[<media type>][;base64],<data>
+	header, data, ok := strings.Cut(strings.TrimPrefix(raw, "data:"), ",")
+	if !ok || !strings.HasSuffix(header, ";base64") {
+		return nil, fmt.Errorf("data URI must be base64 encoded")
+	}
+	return &ContentSource{
+		Type:      "base64",
+		MediaType: strings.TrimSuffix(header, ";base64"),
+		Data:      data,
+	}, nil
+}
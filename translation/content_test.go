@@ -0,0 +1,172 @@
+package translation
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessageContentUnmarshal(t *testing.T) {
+	var msgs []Message
+	body := `[
+		{"role": "user", "content": "Hello"},
+		{"role": "user", "content": [{"type": "text", "text": "Hi"}, {"type": "image", "source": {"type": "url", "url": "https://example.com/cat.png"}}]}
+	]`
+	if err := json.Unmarshal([]byte(body), &msgs); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if !reflect.DeepEqual(msgs[0].Content, TextContent("Hello")) {
+		t.Errorf("string content = %+v", msgs[0].Content)
+	}
+	if len(msgs[1].Content) != 2 || msgs[1].Content[1].Source.URL != "https://example.com/cat.png" {
+		t.Errorf("block content = %+v", msgs[1].Content)
+	}
+
+	var bad Message
+	if err := json.Unmarshal([]byte(`{"role": "user", "content": 42}`), &bad); err == nil {
+		t.Error("Unmarshal() expected error for numeric content")
+	}
+}
+
+func TestValidateMessages(t *testing.T) {
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n"))
+	oversized := base64.StdEncoding.EncodeToString(make([]byte, maxImageBytes+1))
+
+	image := func(src ContentSource) []Message {
+		return []Message{{Role: "user", Content: MessageContent{{Type: "image", Source: &src}}}}
+	}
+
+	tests := []struct {
+		name     string
+		messages []Message
+		wantErr  string
+	}{
+		{
+			name:     "Base64 image",
+			messages: image(ContentSource{Type: "base64", MediaType: "image/png", Data: png}),
+		},
+		{
+			name:     "URL image",
+			messages: image(ContentSource{Type: "url", URL: "https://example.com/cat.png"}),
+		},
+		{
+			name:     "Unsupported media type",
+			messages: image(ContentSource{Type: "base64", MediaType: "image/tiff", Data: png}),
+			wantErr:  "media_type",
+		},
+		{
+			name:     "Oversized image",
+			messages: image(ContentSource{Type: "base64", MediaType: "image/png", Data: oversized}),
+			wantErr:  "exceeds",
+		},
+		{
+			name:     "Invalid base64",
+			messages: image(ContentSource{Type: "base64", MediaType: "image/png", Data: "not base64!"}),
+			wantErr:  "invalid base64",
+		},
+		{
+			name:     "Non-http URL",
+			messages: image(ContentSource{Type: "url", URL: "file:///etc/passwd"}),
+			wantErr:  "url",
+		},
+		{
+			name: "PDF document",
+			messages: []Message{{Role: "user", Content: MessageContent{
+				{Type: "document", Source: &ContentSource{Type: "base64", MediaType: "application/pdf", Data: png}},
+			}}},
+		},
+		{
+			name: "Document with image media type",
+			messages: []Message{{Role: "user", Content: MessageContent{
+				{Type: "document", Source: &ContentSource{Type: "base64", MediaType: "image/png", Data: png}},
+			}}},
+			wantErr: "unsupported document type",
+		},
+		{
+			name: "Image inside tool result",
+			messages: []Message{{Role: "user", Content: MessageContent{
+				{Type: "tool_result", ToolUseID: "toolu_01", Content: MessageContent{
+					{Type: "image", Source: &ContentSource{Type: "base64", MediaType: "image/bmp", Data: png}},
+				}},
+			}}},
+			wantErr: "messages.0.content.0.content.0.source.media_type",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMessages(tt.messages)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateMessages() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateMessages() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpenAIToAnthropicMultimodal(t *testing.T) {
+	body := []byte(`{
+		"messages": [
+			{"role": "system", "content": [{"type": "text", "text": "Describe images."}]},
+			{"role": "user", "content": [
+				{"type": "text", "text": "What is this?"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo="}},
+				{"type": "image_url", "image_url": {"url": "https://example.com/cat.jpg", "detail": "high"}},
+				{"type": "file", "file": {"filename": "report.pdf", "file_data": "data:application/pdf;base64,JVBERi0="}}
+			]}
+		]
+	}`)
+
+	var req OpenAIRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	got, err := OpenAIToAnthropic(req)
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error = %v", err)
+	}
+
+	if got.System != "Describe images." {
+		t.Errorf("System = %q", got.System)
+	}
+	want := MessageContent{
+		{Type: "text", Text: "What is this?"},
+		{Type: "image", Source: &ContentSource{Type: "base64", MediaType: "image/png", Data: "iVBORw0KGgo="}},
+		{Type: "image", Source: &ContentSource{Type: "url", URL: "https://example.com/cat.jpg"}},
+		{Type: "document", Title: "report.pdf", Source: &ContentSource{Type: "base64", MediaType: "application/pdf", Data: "JVBERi0="}},
+	}
+	if !reflect.DeepEqual(got.Messages[0].Content, want) {
+		t.Errorf("content = %+v, want %+v", got.Messages[0].Content, want)
+	}
+
+	if _, err := AnthropicToVertexAI(got); err != nil {
+		t.Errorf("AnthropicToVertexAI() error = %v", err)
+	}
+}
+
+func TestOpenAIToAnthropicRejectsUnsupportedParts(t *testing.T) {
+	req := OpenAIRequest{Messages: []OpenAIMessage{
+		{Role: "user", Content: []interface{}{
+			map[string]interface{}{"type": "input_audio", "input_audio": map[string]interface{}{"data": "", "format": "wav"}},
+		}},
+	}}
+	if _, err := OpenAIToAnthropic(req); err == nil {
+		t.Error("OpenAIToAnthropic() expected error for audio input")
+	}
+
+	req = OpenAIRequest{Messages: []OpenAIMessage{
+		{Role: "user", Content: []interface{}{
+			map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "data:image/png,rawbytes"}},
+		}},
+	}}
+	if _, err := OpenAIToAnthropic(req); err == nil {
+		t.Error("OpenAIToAnthropic() expected error for non-base64 data URI")
+	}
+}
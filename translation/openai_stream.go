@@ -0,0 +1,140 @@
+package translation
+
+import (
+	"time"
+)
+
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func NewOpenAIUsage(u Usage) OpenAIUsage {
+	prompt := u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+	return OpenAIUsage{
+		PromptTokens:     prompt,
+		CompletionTokens: u.OutputTokens,
+		TotalTokens:      prompt + u.OutputTokens,
+	}
+}
+
+type OpenAIStreamChunk struct {
+	ID      string               `json:"id"`
+	Object  string               `json:"object"`
+	Created int64                `json:"created"`
+	Model   string               `json:"model"`
+	Choices []OpenAIStreamChoice `json:"choices"`
+	Usage   *OpenAIUsage         `json:"usage,omitempty"`
+}
+
+type OpenAIStreamChoice struct {
+	Index        int         `json:"index"`
+	Delta        OpenAIDelta `json:"delta"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+type OpenAIDelta struct {
+	Role      string           `json:"role,omitempty"`
+	Content   *string          `json:"content,omitempty"`
+	ToolCalls []OpenAIToolCall `json:"tool_calls,omitempty"`
+}
+
+// OpenAIStreamConverter turns the Anthropic events of one streamed response
+// into OpenAI chat.completion.chunk objects. All chunks share the same id,
+// model and created timestamp, as OpenAI clients expect.
+type OpenAIStreamConverter struct {
+	id           string
+	model        string
+	created      int64
+	includeUsage bool
+
+	usage Usage
+
+	// Maps Anthropic content block indexes to OpenAI tool call indexes
+	toolCallIndex map[int]int
+}
+
+func NewOpenAIStreamConverter(id, model string, includeUsage bool) *OpenAIStreamConverter {
+	return &OpenAIStreamConverter{
+		id:            id,
+		model:         model,
+		created:       time.Now().Unix(),
+		includeUsage:  includeUsage,
+		toolCallIndex: make(map[int]int),
+	}
+}
+
+func (c *OpenAIStreamConverter) Convert(ev StreamEvent) []OpenAIStreamChunk {
+	c.usage.Observe(ev)
+	switch ev.Type {
+	case "message_start":
+		empty := ""
+		return []OpenAIStreamChunk{c.chunk(OpenAIDelta{Role: "assistant", Content: &empty}, nil)}
+	case "content_block_start":
+		if ev.ContentBlock == nil || ev.ContentBlock.Type != "tool_use" {
+			return nil
+		}
+		// Open a new tool call; arguments follow as input_json_delta
+		index := len(c.toolCallIndex)
+		c.toolCallIndex[ev.Index] = index
+		return []OpenAIStreamChunk{c.chunk(OpenAIDelta{ToolCalls: []OpenAIToolCall{{
+			Index:    &index,
+			ID:       ev.ContentBlock.ID,
+			Type:     "function",
+			Function: OpenAIFunctionCall{Name: ev.ContentBlock.Name},
+		}}}, nil)}
+	case "content_block_delta":
+		if ev.Delta == nil {
+			return nil
+		}
+		switch ev.Delta.Type {
+		case "text_delta":
+			text := ev.Delta.Text
+			return []OpenAIStreamChunk{c.chunk(OpenAIDelta{Content: &text}, nil)}
+		case "input_json_delta":
+			index, ok := c.toolCallIndex[ev.Index]
+			if !ok {
+				return nil
+			}
+			return []OpenAIStreamChunk{c.chunk(OpenAIDelta{ToolCalls: []OpenAIToolCall{{
+				Index:    &index,
+				Function: OpenAIFunctionCall{Arguments: ev.Delta.PartialJSON},
+			}}}, nil)}
+		}
+	case "message_delta":
+		if ev.Delta == nil || ev.Delta.StopReason == "" {
+			return nil
+		}
+		reason := OpenAIFinishReason(ev.Delta.StopReason)
+		return []OpenAIStreamChunk{c.chunk(OpenAIDelta{}, &reason)}
+	case "message_stop":
+		if !c.includeUsage {
+			return nil
+		}
+		usage := NewOpenAIUsage(c.usage)
+		chunk := c.chunk(OpenAIDelta{}, nil)
+		chunk.Choices = []OpenAIStreamChoice{}
+		chunk.Usage = &usage
+		return []OpenAIStreamChunk{chunk}
+	}
+	return nil
+}
+
+func (c *OpenAIStreamConverter) chunk(delta OpenAIDelta, finishReason *string) OpenAIStreamChunk {
+	return OpenAIStreamChunk{
+		ID:      c.id,
+		Object:  "chat.completion.chunk",
+		Created: c.created,
+		Model:   c.model,
+		Choices: []OpenAIStreamChoice{{
+			Index:        0,
+			Delta:        delta,
+			FinishReason: finishReason,
+		}},
+	}
+}
@@ -0,0 +1,172 @@
+package translation
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func decodeStreamEvents(t *testing.T, lines []string) []StreamEvent {
+	t.Helper()
+	events := make([]StreamEvent, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &events[i]); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", line, err)
+		}
+	}
+	return events
+}
+
+func TestOpenAIStreamConverterText(t *testing.T) {
+	events := decodeStreamEvents(t, []string{
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-3-5-sonnet@20240620","usage":{"input_tokens":12,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" there"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":5}}`,
+		`{"type":"message_stop"}`,
+	})
+
+	c := NewOpenAIStreamConverter("chatcmpl-1", "gpt-4o", true)
+	var chunks []OpenAIStreamChunk
+	for _, ev := range events {
+		chunks = append(chunks, c.Convert(ev)...)
+	}
+
+	if len(chunks) != 5 {
+		t.Fatalf("got %d chunks, want 5", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if chunk.ID != "chatcmpl-1" || chunk.Model != "gpt-4o" || chunk.Object != "chat.completion.chunk" {
+			t.Errorf("chunk %d = id %q model %q object %q", i, chunk.ID, chunk.Model, chunk.Object)
+		}
+		if chunk.Created != chunks[0].Created {
+			t.Errorf("chunk %d created = %d, want %d", i, chunk.Created, chunks[0].Created)
+		}
+	}
+
+	if d := chunks[0].Choices[0].Delta; d.Role != "assistant" || d.Content == nil || *d.Content != "" {
+		t.Errorf("first delta = %+v, want role-opening chunk", d)
+	}
+	if d := chunks[1].Choices[0].Delta; d.Content == nil || *d.Content != "Hello" {
+		t.Errorf("second delta = %+v", d)
+	}
+	if fr := chunks[3].Choices[0].FinishReason; fr == nil || *fr != "stop" {
+		t.Errorf("finish_reason = %v, want stop", fr)
+	}
+
+	last := chunks[4]
+	if len(last.Choices) != 0 {
+		t.Errorf("usage chunk choices = %+v, want none", last.Choices)
+	}
+	want := OpenAIUsage{PromptTokens: 12, CompletionTokens: 5, TotalTokens: 17}
+	if last.Usage == nil || *last.Usage != want {
+		t.Errorf("usage = %+v, want %+v", last.Usage, want)
+	}
+
+	// Content chunks must serialize finish_reason as an explicit null
+	data, err := json.Marshal(chunks[1])
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	var raw map[string]interface{}
+	json.Unmarshal(data, &raw)
+	choice := raw["choices"].([]interface{})[0].(map[string]interface{})
+	if v, ok := choice["finish_reason"]; !ok || v != nil {
+		t.Errorf("finish_reason = %v (present %v), want null", v, ok)
+	}
+	if _, ok := raw["usage"]; ok {
+		t.Error("content chunk should not carry usage")
+	}
+}
+
+func TestOpenAIStreamConverterToolCalls(t *testing.T) {
+	events := decodeStreamEvents(t, []string{
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":3,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Checking."}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"location\":"}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":20}}`,
+		`{"type":"message_stop"}`,
+	})
+
+	c := NewOpenAIStreamConverter("chatcmpl-2", "gpt-4o", false)
+	var chunks []OpenAIStreamChunk
+	for _, ev := range events {
+		chunks = append(chunks, c.Convert(ev)...)
+	}
+
+	if len(chunks) != 6 {
+		t.Fatalf("got %d chunks, want 6", len(chunks))
+	}
+
+	start := chunks[2].Choices[0].Delta.ToolCalls
+	if len(start) != 1 || start[0].Index == nil || *start[0].Index != 0 ||
+		start[0].ID != "toolu_1" || start[0].Type != "function" || start[0].Function.Name != "get_weather" {
+		t.Errorf("tool call start = %+v", start)
+	}
+
+	var args string
+	for _, chunk := range chunks[3:5] {
+		call := chunk.Choices[0].Delta.ToolCalls[0]
+		if call.Index == nil || *call.Index != 0 {
+			t.Errorf("tool call delta index = %v, want 0", call.Index)
+		}
+		args += call.Function.Arguments
+	}
+	if args != `{"location":"Paris"}` {
+		t.Errorf("arguments = %s", args)
+	}
+
+	if fr := chunks[5].Choices[0].FinishReason; fr == nil || *fr != "tool_calls" {
+		t.Errorf("finish_reason = %v, want tool_calls", fr)
+	}
+	for _, chunk := range chunks {
+		if chunk.Usage != nil {
+			t.Error("usage chunk sent without stream_options.include_usage")
+		}
+	}
+}
+
+func TestOpenAIStreamConverterDeltaInputTokens(t *testing.T) {
+	events := decodeStreamEvents(t, []string{
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":0,"output_tokens":1}}}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"input_tokens":30,"output_tokens":4}}`,
+		`{"type":"message_stop"}`,
+	})
+
+	c := NewOpenAIStreamConverter("chatcmpl-1", "gpt-4o", true)
+	var chunks []OpenAIStreamChunk
+	for _, ev := range events {
+		chunks = append(chunks, c.Convert(ev)...)
+	}
+
+	last := chunks[len(chunks)-1]
+	want := OpenAIUsage{PromptTokens: 30, CompletionTokens: 4, TotalTokens: 34}
+	if last.Usage == nil || *last.Usage != want {
+		t.Errorf("usage = %+v, want %+v", last.Usage, want)
+	}
+}
+
+func TestOpenAIStreamConverterFinishReasons(t *testing.T) {
+	tests := map[string]string{
+		"end_turn":      "stop",
+		"stop_sequence": "stop",
+		"max_tokens":    "length",
+		"tool_use":      "tool_calls",
+	}
+	for stopReason, want := range tests {
+		c := NewOpenAIStreamConverter("chatcmpl-3", "gpt-4o", false)
+		chunks := c.Convert(StreamEvent{Type: "message_delta", Delta: &StreamDelta{StopReason: stopReason}})
+		if len(chunks) != 1 {
+			t.Fatalf("%s: got %d chunks, want 1", stopReason, len(chunks))
+		}
+		if fr := chunks[0].Choices[0].FinishReason; fr == nil || *fr != want {
+			t.Errorf("%s: finish_reason = %v, want %s", stopReason, fr, want)
+		}
+	}
+}
@@ -1,73 +1,495 @@
 package translation
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 )
 
 type OpenAIRequest struct {
-	Model     string    `json:"model"`
-	Messages  []Message `json:"messages"`
-	MaxTokens int       `json:"max_tokens"`
-	Stream    bool      `json:"stream"`
+	Model             string               `json:"model"`
+	Messages          []OpenAIMessage      `json:"messages"`
+	MaxTokens         int                  `json:"max_tokens"`
+	Stream            bool                 `json:"stream"`
+	StreamOptions     *OpenAIStreamOptions `json:"stream_options,omitempty"`
+	Tools             []OpenAITool         `json:"tools,omitempty"`
+	ToolChoice        interface{}          `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool                `json:"parallel_tool_calls,omitempty"`
+
+	Temperature      *float64    `json:"temperature,omitempty"`
+	TopP             *float64    `json:"top_p,omitempty"`
+	Stop             interface{} `json:"stop,omitempty"`
+	PresencePenalty  *float64    `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64    `json:"frequency_penalty,omitempty"`
+	N                *int        `json:"n,omitempty"`
+
+	// Deprecated function calling fields, still sent by older clients
+	Functions    []OpenAIFunction `json:"functions,omitempty"`
+	FunctionCall interface{}      `json:"function_call,omitempty"`
+}
+
+type OpenAIMessage struct {
+	Role         string              `json:"role"`
+	Content      interface{}         `json:"content"`
+	Name         string              `json:"name,omitempty"`
+	ToolCalls    []OpenAIToolCall    `json:"tool_calls,omitempty"`
+	ToolCallID   string              `json:"tool_call_id,omitempty"`
+	FunctionCall *OpenAIFunctionCall `json:"function_call,omitempty"`
+}
+
+type OpenAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *OpenAIImageURL `json:"image_url,omitempty"`
+	File     *OpenAIFile     `json:"file,omitempty"`
+}
+
+type OpenAIImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type OpenAIFile struct {
+	FileData string `json:"file_data,omitempty"`
+	FileID   string `json:"file_id,omitempty"`
+	Filename string `json:"filename,omitempty"`
+}
+
+type OpenAITool struct {
+	Type     string         `json:"type"`
+	Function OpenAIFunction `json:"function"`
+}
+
+type OpenAIFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type OpenAIToolCall struct {
+	Index    *int               `json:"index,omitempty"`
+	ID       string             `json:"id,omitempty"`
+	Type     string             `json:"type,omitempty"`
+	Function OpenAIFunctionCall `json:"function"`
+}
+
+type OpenAIFunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
 }
 
 type OpenAIResponse struct {
-	ID      string   `json:"id"`
-	Object  string   `json:"object"`
-	Created int64    `json:"created"`
-	Model   string   `json:"model"`
-	Usage   Usage    `json:"usage"`
-	Choices []Choice `json:"choices"`
+	ID      string      `json:"id"`
+	Object  string      `json:"object"`
+	Created int64       `json:"created"`
+	Model   string      `json:"model"`
+	Usage   OpenAIUsage `json:"usage"`
+	Choices []Choice    `json:"choices"`
 }
 
 type Choice struct {
-	Message      Message `json:"message"`
-	FinishReason string  `json:"finish_reason"`
-	Index        int     `json:"index"`
+	Message      OpenAIMessage `json:"message"`
+	FinishReason string        `json:"finish_reason"`
+	Index        int           `json:"index"`
 }
 
-func OpenAIToAnthropic(openAIReq OpenAIRequest) AnthropicRequest {
+// emptyToolSchema is used for OpenAI functions declared without parameters,
+// since Anthropic requires an input_schema on every tool.
+var emptyToolSchema = json.RawMessage(`{"type":"object","properties":{}}`)
+
+func OpenAIToAnthropic(openAIReq OpenAIRequest) (AnthropicRequest, error) {
 	maxTokens := openAIReq.MaxTokens
 	if maxTokens == 0 {
 		maxTokens = 1000 // Default value if not provided
 	}
 
+	if err := checkUnsupportedSampling(openAIReq); err != nil {
+		return AnthropicRequest{}, err
+	}
+	stopSequences, err := openAIStopToAnthropic(openAIReq.Stop)
+	if err != nil {
+		return AnthropicRequest{}, err
+	}
+
+	tools, err := openAIToolsToAnthropic(openAIReq.Tools, openAIReq.Functions)
+	if err != nil {
+		return AnthropicRequest{}, err
+	}
+
+	toolChoice, err := openAIToolChoiceToAnthropic(openAIReq.ToolChoice, openAIReq.FunctionCall)
+	if err != nil {
+		return AnthropicRequest{}, err
+	}
+	if openAIReq.ParallelToolCalls != nil && !*openAIReq.ParallelToolCalls && len(tools) > 0 {
+		if toolChoice == nil {
+			toolChoice = &ToolChoice{Type: "auto"}
+		}
+		toolChoice.DisableParallelToolUse = true
+	}
+
 	var systemMessage string
-	var userMessages []Message
+	var messages []Message
+
+	// Legacy function messages carry no call id, so each is paired with
+	// the most recent unanswered function_call of the same function.
+	type functionCall struct{ name, id string }
+	var unanswered []functionCall
 
-	for _, msg := range openAIReq.Messages {
-		if msg.Role == "system" {
-			systemMessage = msg.Content.(string)
-		} else {
-			userMessages = append(userMessages, msg)
+	for i, msg := range openAIReq.Messages {
+		switch msg.Role {
+		case "system", "developer":
+			text, err := openAIContentText(msg.Content)
+			if err != nil {
+				return AnthropicRequest{}, fmt.Errorf("messages.%d.content: %v", i, err)
+			}
+			if text == "" {
+				continue
+			}
+			if systemMessage != "" {
+				systemMessage += "\n"
+			}
+			systemMessage += text
+		case "assistant":
+			text, err := openAIContentText(msg.Content)
+			if err != nil {
+				return AnthropicRequest{}, fmt.Errorf("messages.%d.content: %v", i, err)
+			}
+			if len(msg.ToolCalls) == 0 && msg.FunctionCall == nil {
+				if text != "" {
+					messages = append(messages, Message{Role: msg.Role, Content: TextContent(text)})
+				}
+				continue
+			}
+
+			var blocks MessageContent
+			if text != "" {
+				blocks = append(blocks, ContentBlock{Type: "text", Text: text})
+			}
+
+			calls := msg.ToolCalls
+			if msg.FunctionCall != nil {
+				id := fmt.Sprintf("call_%d_%s", i, msg.FunctionCall.Name)
+				unanswered = append(unanswered, functionCall{msg.FunctionCall.Name, id})
+				calls = append(calls, OpenAIToolCall{ID: id, Type: "function", Function: *msg.FunctionCall})
+			}
+			for j, call := range calls {
+				input, err := toolArgumentsToInput(call.Function.Arguments)
+				if err != nil {
+					return AnthropicRequest{}, fmt.Errorf("messages.%d.tool_calls.%d.function.arguments: %v", i, j, err)
+				}
+				blocks = append(blocks, ContentBlock{
+					Type:  "tool_use",
+					ID:    call.ID,
+					Name:  call.Function.Name,
+					Input: input,
+				})
+			}
+			messages = append(messages, Message{Role: "assistant", Content: blocks})
+		case "tool", "function":
+			toolUseID := msg.ToolCallID
+			if msg.Role == "function" {
+				for j := len(unanswered) - 1; j >= 0; j-- {
+					if unanswered[j].name == msg.Name {
+						toolUseID = unanswered[j].id
+						unanswered = append(unanswered[:j], unanswered[j+1:]...)
+						break
+					}
+				}
+			}
+			if toolUseID == "" {
+				return AnthropicRequest{}, fmt.Errorf("messages.%d: %s message does not reference a preceding tool call", i, msg.Role)
+			}
+			text, err := openAIContentText(msg.Content)
+			if err != nil {
+				return AnthropicRequest{}, fmt.Errorf("messages.%d.content: %v", i, err)
+			}
+			result := ContentBlock{Type: "tool_result", ToolUseID: toolUseID, Content: TextContent(text)}
+
+			// Anthropic expects all results for one assistant turn in a single user message
+			if n := len(messages); n > 0 && isToolResultMessage(messages[n-1]) {
+				messages[n-1].Content = append(messages[n-1].Content, result)
+			} else {
+				messages = append(messages, Message{Role: "user", Content: MessageContent{result}})
+			}
+		default:
+			content, err := openAIContentToAnthropic(msg.Content)
+			if err != nil {
+				return AnthropicRequest{}, fmt.Errorf("messages.%d.content: %v", i, err)
+			}
+			messages = append(messages, Message{Role: msg.Role, Content: content})
 		}
 	}
 
 	return AnthropicRequest{
-		Model:     "claude-3-5-sonnet@20240620",
-		Messages:  userMessages,
-		System:    systemMessage,
-		MaxTokens: maxTokens,
-		Stream:    openAIReq.Stream,
+		Model:      openAIReq.Model,
+		Messages:   messages,
+		System:     systemMessage,
+		MaxTokens:  maxTokens,
+		Stream:     openAIReq.Stream,
+		Tools:      tools,
+		ToolChoice: toolChoice,
+
+		Temperature:   openAIReq.Temperature,
+		TopP:          openAIReq.TopP,
+		StopSequences: stopSequences,
+	}, nil
+}
+
+// checkUnsupportedSampling rejects OpenAI sampling options that Claude has no
+// equivalent for, rather than silently ignoring them. Zero values are the
+// OpenAI defaults and are accepted.
+func checkUnsupportedSampling(req OpenAIRequest) error {
+	if req.PresencePenalty != nil && *req.PresencePenalty != 0 {
+		return fmt.Errorf("presence_penalty: not supported by this model")
+	}
+	if req.FrequencyPenalty != nil && *req.FrequencyPenalty != 0 {
+		return fmt.Errorf("frequency_penalty: not supported by this model")
+	}
+	if req.N != nil && *req.N != 1 {
+		return fmt.Errorf("n: only a single choice is supported")
+	}
+	return nil
+}
+
+// openAIStopToAnthropic accepts stop as either a single string or an array
+// of strings.
+func openAIStopToAnthropic(stop interface{}) ([]string, error) {
+	switch s := stop.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{s}, nil
+	case []interface{}:
+		sequences := make([]string, 0, len(s))
+		for i, v := range s {
+			seq, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("stop.%d: must be a string", i)
+			}
+			sequences = append(sequences, seq)
+		}
+		return sequences, nil
+	}
+	return nil, fmt.Errorf("stop: must be a string or an array of strings")
+}
+
+func openAIToolsToAnthropic(tools []OpenAITool, functions []OpenAIFunction) ([]Tool, error) {
+	for i, tool := range tools {
+		if tool.Type != "function" {
+			return nil, fmt.Errorf("tools.%d.type: unsupported tool type %q", i, tool.Type)
+		}
+		functions = append(functions, tool.Function)
+	}
+
+	var result []Tool
+	for _, fn := range functions {
+		schema := fn.Parameters
+		if len(schema) == 0 || string(schema) == "null" {
+			schema = emptyToolSchema
+		}
+		result = append(result, Tool{
+			Name:        fn.Name,
+			Description: fn.Description,
+			InputSchema: schema,
+		})
+	}
+	return result, nil
+}
+
+// openAIToolChoiceToAnthropic accepts both tool_choice ("none", "auto",
+// "required" or {"type":"function","function":{"name":...}}) and the legacy
+// function_call ("none", "auto" or {"name":...}).
+func openAIToolChoiceToAnthropic(toolChoice, functionCall interface{}) (*ToolChoice, error) {
+	choice := toolChoice
+	if choice == nil {
+		choice = functionCall
+	}
+
+	switch c := choice.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		switch c {
+		case "none":
+			return &ToolChoice{Type: "none"}, nil
+		case "auto":
+			return &ToolChoice{Type: "auto"}, nil
+		case "required":
+			return &ToolChoice{Type: "any"}, nil
+		}
+		return nil, fmt.Errorf("tool_choice: unsupported value %q", c)
+	case map[string]interface{}:
+		name, _ := c["name"].(string)
+		if fn, ok := c["function"].(map[string]interface{}); ok {
+			name, _ = fn["name"].(string)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("tool_choice: function name required")
+		}
+		return &ToolChoice{Type: "tool", Name: name}, nil
+	}
+	return nil, fmt.Errorf("tool_choice: unsupported value %v", choice)
+}
+
+func toolArgumentsToInput(arguments string) (json.RawMessage, error) {
+	if strings.TrimSpace(arguments) == "" {
+		return json.RawMessage(`{}`), nil
+	}
+	if !json.Valid([]byte(arguments)) {
+		return nil, fmt.Errorf("not valid JSON")
+	}
+	return json.RawMessage(arguments), nil
+}
+
+// openAIContentParts normalizes OpenAI message content, which is either a
+// string or an array of parts, into parts.
+func openAIContentParts(content interface{}) ([]OpenAIContentPart, error) {
+	switch c := content.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []OpenAIContentPart{{Type: "text", Text: c}}, nil
+	case []interface{}:
+		// Round-trip through JSON to decode the generic parts into their typed form
+		data, err := json.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		var parts []OpenAIContentPart
+		if err := json.Unmarshal(data, &parts); err != nil {
+			return nil, fmt.Errorf("invalid content parts: %v", err)
+		}
+		return parts, nil
+	}
+	return nil, fmt.Errorf("unsupported content type %T", content)
+}
+
+// openAIContentText flattens OpenAI message content into plain text, for
+// roles that only accept text.
+func openAIContentText(content interface{}) (string, error) {
+	parts, err := openAIContentParts(content)
+	if err != nil {
+		return "", err
+	}
+	var text string
+	for _, part := range parts {
+		if part.Type != "text" {
+			return "", fmt.Errorf("only text content parts are supported here")
+		}
+		text += part.Text
+	}
+	return text, nil
+}
+
+func openAIContentToAnthropic(content interface{}) (MessageContent, error) {
+	parts, err := openAIContentParts(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks MessageContent
+	for i, part := range parts {
+		switch part.Type {
+		case "text":
+			// Vertex AI rejects text blocks without text, as in TextContent
+			if part.Text == "" {
+				continue
+			}
+			blocks = append(blocks, ContentBlock{Type: "text", Text: part.Text})
+		case "image_url":
+			if part.ImageURL == nil {
+				return nil, fmt.Errorf("%d.image_url: field required", i)
+			}
+			source, err := sourceFromURL(part.ImageURL.URL)
+			if err != nil {
+				return nil, fmt.Errorf("%d.image_url.url: %v", i, err)
+			}
+			blocks = append(blocks, ContentBlock{Type: "image", Source: source})
+		case "file":
+			if part.File == nil || part.File.FileData == "" {
+				return nil, fmt.Errorf("%d.file: only inline file_data is supported", i)
+			}
+			source, err := sourceFromURL(part.File.FileData)
+			if err != nil {
+				return nil, fmt.Errorf("%d.file.file_data: %v", i, err)
+			}
+			blocks = append(blocks, ContentBlock{Type: "document", Source: source, Title: part.File.Filename})
+		default:
+			return nil, fmt.Errorf("%d.type: unsupported content part %q", i, part.Type)
+		}
+	}
+	return blocks, nil
+}
+
+func isToolResultMessage(msg Message) bool {
+	if msg.Role != "user" || len(msg.Content) == 0 {
+		return false
+	}
+	for _, b := range msg.Content {
+		if b.Type != "tool_result" {
+			return false
+		}
 	}
+	return true
+}
+
+// OpenAIFinishReason maps an Anthropic stop_reason to the OpenAI
+// finish_reason vocabulary.
+func OpenAIFinishReason(stopReason string) string {
+	switch stopReason {
+	case "end_turn", "stop_sequence":
+		return "stop"
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	}
+	return stopReason
 }
 
 func VertexAIToOpenAI(vertexAIResp VertexAIResponse, model string) OpenAIResponse {
+	message := OpenAIMessage{Role: "assistant"}
+
+	var text string
+	var hasText bool
+	for _, block := range vertexAIResp.Content {
+		switch block.Type {
+		case "text":
+			text += block.Text
+			hasText = true
+		case "tool_use":
+			arguments := string(block.Input)
+			if arguments == "" {
+				arguments = "{}"
+			}
+			message.ToolCalls = append(message.ToolCalls, OpenAIToolCall{
+				ID:   block.ID,
+				Type: "function",
+				Function: OpenAIFunctionCall{
+					Name:      block.Name,
+					Arguments: arguments,
+				},
+			})
+		}
+	}
+	// OpenAI sends null content for pure tool call responses
+	if hasText || len(message.ToolCalls) == 0 {
+		message.Content = text
+	}
+
 	return OpenAIResponse{
 		ID:      vertexAIResp.ID,
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
 		Model:   model,
-		Usage:   vertexAIResp.Usage,
+		Usage:   NewOpenAIUsage(vertexAIResp.Usage),
 		Choices: []Choice{
 			{
-				Message: Message{
-					Role:    "assistant",
-					Content: vertexAIResp.Content[0].Text,
-				},
-				FinishReason: vertexAIResp.StopReason,
+				Message:      message,
+				FinishReason: OpenAIFinishReason(vertexAIResp.StopReason),
 				Index:        0,
 			},
 		},
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,226 @@
+package translation
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestOpenAIToAnthropicTools(t *testing.T) {
+	body := []byte(`{
+		"model": "gpt-4o",
+		"messages": [
+			{"role": "system", "content": "You are a weather bot."},
+			{"role": "user", "content": "Weather in Paris and Rome?"},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"location\":\"Paris\"}"}},
+				{"id": "call_2", "type": "function", "function": {"name": "get_weather", "arguments": "{\"location\":\"Rome\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "18C"},
+			{"role": "tool", "tool_call_id": "call_2", "content": "24C"}
+		],
+		"tools": [{"type": "function", "function": {"name": "get_weather", "description": "Get weather", "parameters": {"type": "object"}}}],
+		"tool_choice": "required",
+		"parallel_tool_calls": false
+	}`)
+
+	var req OpenAIRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	got, err := OpenAIToAnthropic(req)
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error = %v", err)
+	}
+
+	if got.System != "You are a weather bot." {
+		t.Errorf("System = %q", got.System)
+	}
+	wantTools := []Tool{{Name: "get_weather", Description: "Get weather", InputSchema: json.RawMessage(`{"type": "object"}`)}}
+	if !reflect.DeepEqual(got.Tools, wantTools) {
+		t.Errorf("Tools = %+v, want %+v", got.Tools, wantTools)
+	}
+	wantChoice := &ToolChoice{Type: "any", DisableParallelToolUse: true}
+	if !reflect.DeepEqual(got.ToolChoice, wantChoice) {
+		t.Errorf("ToolChoice = %+v, want %+v", got.ToolChoice, wantChoice)
+	}
+
+	if len(got.Messages) != 3 {
+		t.Fatalf("got %d messages, want 3: %+v", len(got.Messages), got.Messages)
+	}
+	wantAssistant := MessageContent{
+		{Type: "tool_use", ID: "call_1", Name: "get_weather", Input: json.RawMessage(`{"location":"Paris"}`)},
+		{Type: "tool_use", ID: "call_2", Name: "get_weather", Input: json.RawMessage(`{"location":"Rome"}`)},
+	}
+	if !reflect.DeepEqual(got.Messages[1].Content, wantAssistant) {
+		t.Errorf("assistant content = %+v, want %+v", got.Messages[1].Content, wantAssistant)
+	}
+	wantResults := MessageContent{
+		{Type: "tool_result", ToolUseID: "call_1", Content: TextContent("18C")},
+		{Type: "tool_result", ToolUseID: "call_2", Content: TextContent("24C")},
+	}
+	if got.Messages[2].Role != "user" || !reflect.DeepEqual(got.Messages[2].Content, wantResults) {
+		t.Errorf("tool results = %+v, want %+v", got.Messages[2], wantResults)
+	}
+}
+
+func TestOpenAIToAnthropicLegacyFunctions(t *testing.T) {
+	req := OpenAIRequest{
+		Messages: []OpenAIMessage{
+			{Role: "user", Content: "What time is it?"},
+			{Role: "assistant", FunctionCall: &OpenAIFunctionCall{Name: "get_time", Arguments: ""}},
+			{Role: "function", Name: "get_time", Content: "12:00"},
+		},
+		Functions:    []OpenAIFunction{{Name: "get_time"}},
+		FunctionCall: map[string]interface{}{"name": "get_time"},
+	}
+
+	got, err := OpenAIToAnthropic(req)
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error = %v", err)
+	}
+	if string(got.Tools[0].InputSchema) != string(emptyToolSchema) {
+		t.Errorf("InputSchema = %s, want empty object schema", got.Tools[0].InputSchema)
+	}
+	if !reflect.DeepEqual(got.ToolChoice, &ToolChoice{Type: "tool", Name: "get_time"}) {
+		t.Errorf("ToolChoice = %+v", got.ToolChoice)
+	}
+	call := got.Messages[1].Content[0]
+	result := got.Messages[2].Content[0]
+	if call.ID == "" || call.ID != result.ToolUseID {
+		t.Errorf("function result %q does not reference call %q", result.ToolUseID, call.ID)
+	}
+	if string(call.Input) != "{}" {
+		t.Errorf("Input = %s, want {}", call.Input)
+	}
+
+	// A second call to the same function gets its own result
+	req.Messages = append(req.Messages,
+		OpenAIMessage{Role: "assistant", FunctionCall: &OpenAIFunctionCall{Name: "get_time", Arguments: ""}},
+		OpenAIMessage{Role: "function", Name: "get_time", Content: "12:01"},
+	)
+	got, err = OpenAIToAnthropic(req)
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error = %v", err)
+	}
+	first, second := got.Messages[1].Content[0].ID, got.Messages[3].Content[0].ID
+	if first == second {
+		t.Errorf("both calls have id %q", first)
+	}
+	if got.Messages[2].Content[0].ToolUseID != first || got.Messages[4].Content[0].ToolUseID != second {
+		t.Errorf("results reference %q and %q, want %q and %q",
+			got.Messages[2].Content[0].ToolUseID, got.Messages[4].Content[0].ToolUseID, first, second)
+	}
+
+	// A result without an unanswered call is rejected
+	req.Messages = append(req.Messages, OpenAIMessage{Role: "function", Name: "get_time", Content: "12:02"})
+	if _, err := OpenAIToAnthropic(req); err == nil {
+		t.Error("OpenAIToAnthropic() accepted a function result without a call")
+	}
+}
+
+func TestOpenAIToAnthropicInvalidArguments(t *testing.T) {
+	req := OpenAIRequest{
+		Messages: []OpenAIMessage{
+			{Role: "assistant", ToolCalls: []OpenAIToolCall{
+				{ID: "call_1", Type: "function", Function: OpenAIFunctionCall{Name: "f", Arguments: "{not json"}},
+			}},
+		},
+	}
+	if _, err := OpenAIToAnthropic(req); err == nil {
+		t.Error("OpenAIToAnthropic() expected error for invalid arguments")
+	}
+}
+
+func TestVertexAIToOpenAIToolCalls(t *testing.T) {
+	resp := VertexAIToOpenAI(VertexAIResponse{
+		ID: "msg_01",
+		Content: []ContentBlock{
+			{Type: "tool_use", ID: "toolu_01", Name: "get_weather", Input: json.RawMessage(`{"location":"Paris"}`)},
+		},
+		StopReason: "tool_use",
+	}, "gpt-4o")
+
+	choice := resp.Choices[0]
+	if choice.FinishReason != "tool_calls" {
+		t.Errorf("FinishReason = %q, want tool_calls", choice.FinishReason)
+	}
+	if choice.Message.Content != nil {
+		t.Errorf("Content = %v, want nil", choice.Message.Content)
+	}
+	want := []OpenAIToolCall{{
+		ID:       "toolu_01",
+		Type:     "function",
+		Function: OpenAIFunctionCall{Name: "get_weather", Arguments: `{"location":"Paris"}`},
+	}}
+	if !reflect.DeepEqual(choice.Message.ToolCalls, want) {
+		t.Errorf("ToolCalls = %+v, want %+v", choice.Message.ToolCalls, want)
+	}
+}
+
+func TestOpenAIToAnthropicSampling(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantStop  []string
+		wantTemp  *float64
+		wantError bool
+	}{
+		{
+			name:     "Single stop string",
+			body:     `{"messages": [], "temperature": 0.3, "stop": "END"}`,
+			wantStop: []string{"END"},
+			wantTemp: float64Ptr(0.3),
+		},
+		{
+			name:     "Stop array and zero penalties",
+			body:     `{"messages": [], "stop": ["a", "b"], "presence_penalty": 0, "frequency_penalty": 0, "n": 1}`,
+			wantStop: []string{"a", "b"},
+		},
+		{
+			name:      "Presence penalty rejected",
+			body:      `{"messages": [], "presence_penalty": 0.5}`,
+			wantError: true,
+		},
+		{
+			name:      "Multiple choices rejected",
+			body:      `{"messages": [], "n": 2}`,
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req OpenAIRequest
+			if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			got, err := OpenAIToAnthropic(req)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("OpenAIToAnthropic() error = %v, wantError %v", err, tt.wantError)
+			}
+			if tt.wantError {
+				return
+			}
+			if !reflect.DeepEqual(got.StopSequences, tt.wantStop) {
+				t.Errorf("StopSequences = %v, want %v", got.StopSequences, tt.wantStop)
+			}
+			if !reflect.DeepEqual(got.Temperature, tt.wantTemp) {
+				t.Errorf("Temperature = %v, want %v", got.Temperature, tt.wantTemp)
+			}
+		})
+	}
+}
+
+func TestVertexAIToOpenAIStopSequence(t *testing.T) {
+	stop := "4"
+	resp := VertexAIToOpenAI(VertexAIResponse{
+		Content:      []ContentBlock{{Type: "text", Text: "1, 2, 3"}},
+		StopReason:   "stop_sequence",
+		StopSequence: &stop,
+	}, "gpt-4o")
+
+	if resp.Choices[0].FinishReason != "stop" {
+		t.Errorf("FinishReason = %q, want stop", resp.Choices[0].FinishReason)
+	}
+}
@@ -0,0 +1,47 @@
+package translation
+
+// StreamEvent is the payload of a single Anthropic streaming event as sent by
+// Vertex AI's streamRawPredict.
+type StreamEvent struct {
+	Type         string            `json:"type"`
+	Index        int               `json:"index"`
+	Message      *VertexAIResponse `json:"message,omitempty"`
+	ContentBlock *ContentBlock     `json:"content_block,omitempty"`
+	Delta        *StreamDelta      `json:"delta,omitempty"`
+	Usage        *Usage            `json:"usage,omitempty"`
+	Error        *StreamError      `json:"error,omitempty"`
+}
+
+// StreamError is the body of an "error" event, sent when Vertex AI fails
+// after the stream has started (for example overloaded_error).
+type StreamError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type StreamDelta struct {
+	Type         string  `json:"type,omitempty"`
+	Text         string  `json:"text,omitempty"`
+	PartialJSON  string  `json:"partial_json,omitempty"`
+	StopReason   string  `json:"stop_reason,omitempty"`
+	StopSequence *string `json:"stop_sequence,omitempty"`
+}
+
+// Observe updates u with the usage reported by a stream event: the initial
+// counts in message_start and the running totals in message_delta.
+func (u *Usage) Observe(ev StreamEvent) {
+	switch ev.Type {
+	case "message_start":
+		if ev.Message != nil {
+			*u = ev.Message.Usage
+		}
+	case "message_delta":
+		if ev.Usage == nil {
+			return
+		}
+		u.OutputTokens = ev.Usage.OutputTokens
+		if ev.Usage.InputTokens > 0 {
+			u.InputTokens = ev.Usage.InputTokens
+		}
+	}
+}
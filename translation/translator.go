@@ -1,50 +1,118 @@
 package translation
 
 import (
-	"log"
+    "fmt"
+    "strings"
 )
 
 func AnthropicToVertexAI(ar AnthropicRequest) (VertexAIRequest, error) {
-    log.Printf("Received Anthropic request: %+v", ar)
-
-    normalizedModelName := NormalizeModelName(ar.Model)
-    log.Printf("Normalized model name: %s", normalizedModelName)
-
     maxTokens := ar.MaxTokens
     if maxTokens == 0 {
         maxTokens = 1000 // Default value if not provided
     }
 
+    if err := validateTools(ar.Tools, ar.ToolChoice); err != nil {
+        return VertexAIRequest{}, err
+    }
+    if err := validateSampling(ar); err != nil {
+        return VertexAIRequest{}, err
+    }
+    if err := validateMessages(ar.Messages); err != nil {
+        return VertexAIRequest{}, err
+    }
+
     vertexAIReq := VertexAIRequest{
         AnthropicVersion: "vertex-2023-10-16",
         Messages:         ar.Messages,
         System:           ar.System,
         MaxTokens:        maxTokens,
         Stream:           ar.Stream,
+        Tools:            ar.Tools,
+        ToolChoice:       ar.ToolChoice,
+        Temperature:      ar.Temperature,
+        TopP:             ar.TopP,
+        TopK:             ar.TopK,
+        StopSequences:    ar.StopSequences,
     }
 
-    log.Printf("Translated to Vertex AI request: %+v", vertexAIReq)
-
     return vertexAIReq, nil
 }
 
-func VertexAIToAnthropic(vr VertexAIResponse) (map[string]interface{}, error) {
-    if len(vr.Content) == 0 {
-        return nil, nil
+func validateTools(tools []Tool, choice *ToolChoice) error {
+    names := make(map[string]bool, len(tools))
+    for i, tool := range tools {
+        if tool.Name == "" {
+            return fmt.Errorf("tools.%d.name: field required", i)
+        }
+        if names[tool.Name] {
+            return fmt.Errorf("tools.%d.name: duplicate tool name %q", i, tool.Name)
+        }
+        names[tool.Name] = true
+        if tool.IsCustom() && len(tool.InputSchema) == 0 {
+            return fmt.Errorf("tools.%d.input_schema: field required", i)
+        }
+    }
+
+    if choice == nil {
+        return nil
     }
+    switch choice.Type {
+    case "auto", "any", "none":
+    case "tool":
+        if !names[choice.Name] {
+            return fmt.Errorf("tool_choice.name: unknown tool %q", choice.Name)
+        }
+    default:
+        return fmt.Errorf("tool_choice.type: unsupported value %q", choice.Type)
+    }
+    return nil
+}
 
-    content := ""
-    for _, c := range vr.Content {
-        if c.Type == "text" {
-            content += c.Text
+func validateSampling(ar AnthropicRequest) error {
+    if ar.Temperature != nil && (*ar.Temperature < 0 || *ar.Temperature > 1) {
+        return fmt.Errorf("temperature: must be between 0 and 1, got %v", *ar.Temperature)
+    }
+    if ar.TopP != nil && (*ar.TopP < 0 || *ar.TopP > 1) {
+        return fmt.Errorf("top_p: must be between 0 and 1, got %v", *ar.TopP)
+    }
+    if ar.TopK != nil && *ar.TopK < 0 {
+        return fmt.Errorf("top_k: must be non-negative, got %d", *ar.TopK)
+    }
+    for i, seq := range ar.StopSequences {
+        if strings.TrimSpace(seq) == "" {
+            return fmt.Errorf("stop_sequences.%d: must contain non-whitespace", i)
         }
     }
+    return nil
+}
+
+// VertexAIToAnthropic converts a rawPredict response into an Anthropic
+// Message. Vertex AI already returns the Anthropic shape, so this mostly
+// fills in defaults and reports the model name the client asked for.
+func VertexAIToAnthropic(vr VertexAIResponse, model string) (AnthropicResponse, error) {
+    if vr.ID == "" {
+        return AnthropicResponse{}, fmt.Errorf("response has no message id")
+    }
+    if vr.Type != "" && vr.Type != "message" {
+        return AnthropicResponse{}, fmt.Errorf("unexpected response type %q", vr.Type)
+    }
 
-    anthropicResp := map[string]interface{}{
-        "content": content,
-        "model":   vr.Model,
-        "usage":   vr.Usage,
+    content := vr.Content
+    if content == nil {
+        content = []ContentBlock{}
+    }
+    if model == "" {
+        model = vr.Model
     }
 
-    return anthropicResp, nil
-}
\ No newline at end of file
+    return AnthropicResponse{
+        ID:           vr.ID,
+        Type:         "message",
+        Role:         "assistant",
+        Model:        model,
+        Content:      content,
+        StopReason:   vr.StopReason,
+        StopSequence: vr.StopSequence,
+        Usage:        vr.Usage,
+    }, nil
+}
@@ -1,11 +1,18 @@
 package translation
 
 import (
+	"encoding/json"
 	"reflect"
 	"testing"
 )
 
 func TestAnthropicToVertexAI(t *testing.T) {
+	weatherTool := Tool{
+		Name:        "get_weather",
+		Description: "Get the current weather in a given location",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"location":{"type":"string"}},"required":["location"]}`),
+	}
+
 	tests := []struct {
 		name    string
 		input   AnthropicRequest
@@ -17,28 +24,107 @@ func TestAnthropicToVertexAI(t *testing.T) {
 			input: AnthropicRequest{
 				Model: "claude-v1",
 				Messages: []Message{
-					{Role: "user", Content: "Hello, how are you?"},
+					{Role: "user", Content: TextContent("Hello, how are you?")},
 				},
 				MaxTokens: 100,
 			},
 			want: VertexAIRequest{
-				Instances: []Instance{
-					{
-						Messages: []Message{
-							{Role: "user", Content: "Hello, how are you?"},
-						},
-					},
+				AnthropicVersion: "vertex-2023-10-16",
+				Messages: []Message{
+					{Role: "user", Content: TextContent("Hello, how are you?")},
+				},
+				MaxTokens: 100,
+			},
+			wantErr: false,
+		},
+		{
+			name: "Tools and tool choice",
+			input: AnthropicRequest{
+				Model: "claude-3-5-sonnet",
+				Messages: []Message{
+					{Role: "user", Content: TextContent("What's the weather in Paris?")},
+					{Role: "assistant", Content: []ContentBlock{
+						{Type: "tool_use", ID: "toolu_01", Name: "get_weather", Input: json.RawMessage(`{"location":"Paris"}`)},
+					}},
+					{Role: "user", Content: []ContentBlock{
+						{Type: "tool_result", ToolUseID: "toolu_01", Content: TextContent("18C and sunny")},
+					}},
 				},
-				Parameters: Parameters{
-					MaxOutputTokens: 100,
-					Temperature:     0.7,
-					TopP:            0.95,
-					TopK:            40,
+				MaxTokens:  200,
+				Tools:      []Tool{weatherTool},
+				ToolChoice: &ToolChoice{Type: "tool", Name: "get_weather"},
+			},
+			want: VertexAIRequest{
+				AnthropicVersion: "vertex-2023-10-16",
+				Messages: []Message{
+					{Role: "user", Content: TextContent("What's the weather in Paris?")},
+					{Role: "assistant", Content: []ContentBlock{
+						{Type: "tool_use", ID: "toolu_01", Name: "get_weather", Input: json.RawMessage(`{"location":"Paris"}`)},
+					}},
+					{Role: "user", Content: []ContentBlock{
+						{Type: "tool_result", ToolUseID: "toolu_01", Content: TextContent("18C and sunny")},
+					}},
 				},
+				MaxTokens:  200,
+				Tools:      []Tool{weatherTool},
+				ToolChoice: &ToolChoice{Type: "tool", Name: "get_weather"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "Sampling parameters",
+			input: AnthropicRequest{
+				Messages:      []Message{{Role: "user", Content: TextContent("Count to ten")}},
+				MaxTokens:     50,
+				Temperature:   float64Ptr(0.2),
+				TopP:          float64Ptr(0.9),
+				TopK:          intPtr(20),
+				StopSequences: []string{"7"},
+			},
+			want: VertexAIRequest{
+				AnthropicVersion: "vertex-2023-10-16",
+				Messages:         []Message{{Role: "user", Content: TextContent("Count to ten")}},
+				MaxTokens:        50,
+				Temperature:      float64Ptr(0.2),
+				TopP:             float64Ptr(0.9),
+				TopK:             intPtr(20),
+				StopSequences:    []string{"7"},
 			},
 			wantErr: false,
 		},
-		// Add more test cases here
+		{
+			name: "Temperature out of range",
+			input: AnthropicRequest{
+				Messages:    []Message{{Role: "user", Content: TextContent("Hi")}},
+				Temperature: float64Ptr(1.5),
+			},
+			wantErr: true,
+		},
+		{
+			name: "Whitespace stop sequence",
+			input: AnthropicRequest{
+				Messages:      []Message{{Role: "user", Content: TextContent("Hi")}},
+				StopSequences: []string{" \n"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Tool choice names unknown tool",
+			input: AnthropicRequest{
+				Messages:   []Message{{Role: "user", Content: TextContent("Hi")}},
+				Tools:      []Tool{weatherTool},
+				ToolChoice: &ToolChoice{Type: "tool", Name: "get_time"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Tool without input schema",
+			input: AnthropicRequest{
+				Messages: []Message{{Role: "user", Content: TextContent("Hi")}},
+				Tools:    []Tool{{Name: "get_weather"}},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -48,6 +134,9 @@ func TestAnthropicToVertexAI(t *testing.T) {
 				t.Errorf("AnthropicToVertexAI() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if tt.wantErr {
+				return
+			}
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("AnthropicToVertexAI() = %v, want %v", got, tt.want)
 			}
@@ -55,46 +144,262 @@ func TestAnthropicToVertexAI(t *testing.T) {
 	}
 }
 
+func TestVertexAIRequestToolJSON(t *testing.T) {
+	body := []byte(`{
+		"model": "claude-3-5-sonnet",
+		"max_tokens": 100,
+		"tools": [{"name": "get_weather", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "any"},
+		"messages": [
+			{"role": "user", "content": "Weather?"},
+			{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_01", "name": "get_weather", "input": {"location": "Paris"}}]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "toolu_01", "content": "sunny"}]}
+		]
+	}`)
+
+	var ar AnthropicRequest
+	if err := json.Unmarshal(body, &ar); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	vr, err := AnthropicToVertexAI(ar)
+	if err != nil {
+		t.Fatalf("AnthropicToVertexAI() error = %v", err)
+	}
+	out, err := json.Marshal(vr)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	var got map[string]interface{}
+	json.Unmarshal(out, &got)
+	if _, ok := got["tools"]; !ok {
+		t.Errorf("tools missing from Vertex AI request: %s", out)
+	}
+	if choice, _ := got["tool_choice"].(map[string]interface{}); choice["type"] != "any" {
+		t.Errorf("tool_choice = %v, want type any", got["tool_choice"])
+	}
+	messages, _ := got["messages"].([]interface{})
+	if len(messages) != 3 {
+		t.Fatalf("got %d messages, want 3", len(messages))
+	}
+	block := messages[1].(map[string]interface{})["content"].([]interface{})[0].(map[string]interface{})
+	if block["type"] != "tool_use" || block["id"] != "toolu_01" {
+		t.Errorf("tool_use block not preserved: %v", block)
+	}
+}
+
+func TestServerToolRoundTrip(t *testing.T) {
+	body := []byte(`{
+		"model": "claude-3-5-sonnet",
+		"max_tokens": 100,
+		"tools": [
+			{"type": "bash_20250124", "name": "bash"},
+			{"type": "custom", "name": "get_weather", "input_schema": {"type": "object"}, "cache_control": {"type": "ephemeral"}}
+		],
+		"messages": [{"role": "user", "content": "List files"}]
+	}`)
+
+	var ar AnthropicRequest
+	if err := json.Unmarshal(body, &ar); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	vr, err := AnthropicToVertexAI(ar)
+	if err != nil {
+		t.Fatalf("AnthropicToVertexAI() error = %v", err)
+	}
+	out, err := json.Marshal(vr.Tools)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	want := `[{"type":"bash_20250124","name":"bash"},{"type":"custom","name":"get_weather","input_schema":{"type":"object"},"cache_control":{"type":"ephemeral"}}]`
+	if string(out) != want {
+		t.Errorf("tools = %s, want %s", out, want)
+	}
+
+	ar.Tools = []Tool{{Type: "custom", Name: "get_weather"}}
+	if _, err := AnthropicToVertexAI(ar); err == nil {
+		t.Error("AnthropicToVertexAI() accepted a custom tool without input_schema")
+	}
+}
+
 func TestVertexAIToAnthropic(t *testing.T) {
 	tests := []struct {
 		name    string
 		input   VertexAIResponse
-		want    map[string]interface{}
+		model   string
+		want    AnthropicResponse
 		wantErr bool
 	}{
 		{
 			name: "Basic conversion",
 			input: VertexAIResponse{
-				Predictions: []Prediction{
-					{Content: "Hello! I'm doing well, thank you for asking. How can I assist you today?"},
+				ID:    "msg_01",
+				Type:  "message",
+				Role:  "assistant",
+				Model: "claude-3-5-sonnet-20240620",
+				Content: []ContentBlock{
+					{Type: "text", Text: "Hello! I'm doing well, thank you for asking. How can I assist you today?"},
+				},
+				StopReason: "end_turn",
+				Usage:      Usage{InputTokens: 12, OutputTokens: 20},
+			},
+			model: "claude-3-5-sonnet",
+			want: AnthropicResponse{
+				ID:    "msg_01",
+				Type:  "message",
+				Role:  "assistant",
+				Model: "claude-3-5-sonnet",
+				Content: []ContentBlock{
+					{Type: "text", Text: "Hello! I'm doing well, thank you for asking. How can I assist you today?"},
 				},
+				StopReason: "end_turn",
+				Usage:      Usage{InputTokens: 12, OutputTokens: 20},
 			},
-			want: map[string]interface{}{
-				"content": "Hello! I'm doing well, thank you for asking. How can I assist you today?",
+			wantErr: false,
+		},
+		{
+			name: "Stopped on stop sequence",
+			input: VertexAIResponse{
+				ID:           "msg_02",
+				Model:        "claude-3-5-sonnet-20240620",
+				Content:      []ContentBlock{{Type: "text", Text: "1, 2, 3"}},
+				StopReason:   "stop_sequence",
+				StopSequence: stringPtr("4"),
+			},
+			want: AnthropicResponse{
+				ID:           "msg_02",
+				Type:         "message",
+				Role:         "assistant",
+				Model:        "claude-3-5-sonnet-20240620",
+				Content:      []ContentBlock{{Type: "text", Text: "1, 2, 3"}},
+				StopReason:   "stop_sequence",
+				StopSequence: stringPtr("4"),
 			},
 			wantErr: false,
 		},
 		{
-			name: "Empty predictions",
+			name: "Empty content",
 			input: VertexAIResponse{
-				Predictions: []Prediction{},
+				ID:         "msg_03",
+				StopReason: "end_turn",
+			},
+			model: "claude-3-5-sonnet",
+			want: AnthropicResponse{
+				ID:         "msg_03",
+				Type:       "message",
+				Role:       "assistant",
+				Model:      "claude-3-5-sonnet",
+				Content:    []ContentBlock{},
+				StopReason: "end_turn",
 			},
-			want:    nil,
+			wantErr: false,
+		},
+		{
+			name:    "Error object",
+			input:   VertexAIResponse{ID: "err", Type: "error"},
 			wantErr: true,
 		},
-		// Add more test cases here
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := VertexAIToAnthropic(tt.input)
+			got, err := VertexAIToAnthropic(tt.input, tt.model)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("VertexAIToAnthropic() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("VertexAIToAnthropic() = %v, want %v", got, tt.want)
+				t.Errorf("VertexAIToAnthropic() = %+v, want %+v", got, tt.want)
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func float64Ptr(v float64) *float64 { return &v }
+
+func intPtr(v int) *int { return &v }
+
+func stringPtr(v string) *string { return &v }
+
+func TestEmptyToolResultContent(t *testing.T) {
+	var ar AnthropicRequest
+	err := json.Unmarshal([]byte(`{
+		"model": "claude-3-5-sonnet",
+		"max_tokens": 100,
+		"messages": [
+			{"role": "user", "content": "Run it"},
+			{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_01", "name": "run", "input": {}}]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "toolu_01", "content": ""}]}
+		]
+	}`), &ar)
+	if err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	fromOpenAI, err := OpenAIToAnthropic(OpenAIRequest{
+		Model: "claude-3-5-sonnet",
+		Messages: []OpenAIMessage{
+			{Role: "user", Content: "Run it"},
+			{Role: "assistant", ToolCalls: []OpenAIToolCall{{ID: "call_01", Type: "function", Function: OpenAIFunctionCall{Name: "run", Arguments: "{}"}}}},
+			{Role: "tool", ToolCallID: "call_01", Content: ""},
+		},
+	})
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error = %v", err)
+	}
+
+	for name, req := range map[string]AnthropicRequest{"anthropic": ar, "openai": fromOpenAI} {
+		vr, err := AnthropicToVertexAI(req)
+		if err != nil {
+			t.Fatalf("%s: AnthropicToVertexAI() error = %v", name, err)
+		}
+		out, err := json.Marshal(vr.Messages[2].Content)
+		if err != nil {
+			t.Fatalf("%s: Marshal() error = %v", name, err)
+		}
+		var blocks []map[string]interface{}
+		json.Unmarshal(out, &blocks)
+		if len(blocks) != 1 || blocks[0]["type"] != "tool_result" {
+			t.Fatalf("%s: content = %s, want one tool_result", name, out)
+		}
+		if _, ok := blocks[0]["content"]; ok {
+			t.Errorf("%s: tool_result = %s, want no content", name, out)
+		}
+	}
+}
+
+func TestEmptyMessageContent(t *testing.T) {
+	var ar AnthropicRequest
+	err := json.Unmarshal([]byte(`{"model": "claude-3-5-sonnet", "max_tokens": 100, "messages": [{"role": "user", "content": ""}]}`), &ar)
+	if err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	fromOpenAI, err := OpenAIToAnthropic(OpenAIRequest{
+		Model: "claude-3-5-sonnet",
+		Messages: []OpenAIMessage{
+			{Role: "system", Content: ""},
+			{Role: "system", Content: "Be brief"},
+			{Role: "user", Content: ""},
+			{Role: "user", Content: []interface{}{
+				map[string]interface{}{"type": "text", "text": ""},
+				map[string]interface{}{"type": "text", "text": "Hi"},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("OpenAIToAnthropic() error = %v", err)
+	}
+
+	if len(ar.Messages[0].Content) != 0 {
+		t.Errorf("anthropic: content = %+v, want no blocks", ar.Messages[0].Content)
+	}
+	if fromOpenAI.System != "Be brief" {
+		t.Errorf("openai: system = %q, want %q", fromOpenAI.System, "Be brief")
+	}
+	if len(fromOpenAI.Messages[0].Content) != 0 {
+		t.Errorf("openai: content = %+v, want no blocks", fromOpenAI.Messages[0].Content)
+	}
+	if got := fromOpenAI.Messages[1].Content; !reflect.DeepEqual(got, TextContent("Hi")) {
+		t.Errorf("openai: content = %+v, want only the non-empty text part", got)
+	}
+}
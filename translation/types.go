@@ -1,42 +1,158 @@
 package translation
 
+import (
+    "encoding/json"
+    "fmt"
+)
+
 type AnthropicRequest struct {
-    Model     string    `json:"model"`
-    Messages  []Message `json:"messages"`
-    System    string    `json:"system,omitempty"`
-    MaxTokens int       `json:"max_tokens"`
-    Stream    bool      `json:"stream"`
+    Model      string      `json:"model"`
+    Messages   []Message   `json:"messages"`
+    System     string      `json:"system,omitempty"`
+    MaxTokens  int         `json:"max_tokens"`
+    Stream     bool        `json:"stream"`
+    Tools      []Tool      `json:"tools,omitempty"`
+    ToolChoice *ToolChoice `json:"tool_choice,omitempty"`
+
+    Temperature   *float64 `json:"temperature,omitempty"`
+    TopP          *float64 `json:"top_p,omitempty"`
+    TopK          *int     `json:"top_k,omitempty"`
+    StopSequences []string `json:"stop_sequences,omitempty"`
 }
 
 type Message struct {
-    Role    string      `json:"role"`
-    Content interface{} `json:"content"`
+    Role    string         `json:"role"`
+    Content MessageContent `json:"content"`
+}
+
+// MessageContent holds the content of a message. Anthropic accepts either a
+// plain string or an array of content blocks; strings are decoded into a
+// single text block.
+type MessageContent []ContentBlock
+
+// TextContent returns text as a single text block. Vertex AI rejects text
+// blocks without text, so an empty string is no blocks at all, which leaves
+// a tool_result without content.
+func TextContent(text string) MessageContent {
+    if text == "" {
+        return MessageContent{}
+    }
+    return MessageContent{{Type: "text", Text: text}}
+}
+
+func (mc *MessageContent) UnmarshalJSON(data []byte) error {
+    var text string
+    if err := json.Unmarshal(data, &text); err == nil {
+        *mc = TextContent(text)
+        return nil
+    }
+
+    var blocks []ContentBlock
+    if err := json.Unmarshal(data, &blocks); err != nil {
+        return fmt.Errorf("content must be a string or an array of content blocks")
+    }
+    *mc = blocks
+    return nil
+}
+
+// ContentBlock is a single entry of a message's content array. Only the
+// fields relevant to the block's Type are populated.
+type ContentBlock struct {
+    Type string `json:"type"`
+
+    // text
+    Text string `json:"text,omitempty"`
+
+    // image, document
+    Source  *ContentSource `json:"source,omitempty"`
+    Title   string         `json:"title,omitempty"`
+    Context string         `json:"context,omitempty"`
+
+    // tool_use
+    ID    string          `json:"id,omitempty"`
+    Name  string          `json:"name,omitempty"`
+    Input json.RawMessage `json:"input,omitempty"`
+
+    // tool_result
+    ToolUseID string         `json:"tool_use_id,omitempty"`
+    Content   MessageContent `json:"content,omitempty"`
+    IsError   bool           `json:"is_error,omitempty"`
+
+    CacheControl json.RawMessage `json:"cache_control,omitempty"`
+}
+
+type ContentSource struct {
+    Type      string `json:"type"`
+    MediaType string `json:"media_type,omitempty"`
+    Data      string `json:"data,omitempty"`
+    URL       string `json:"url,omitempty"`
+}
+
+// Tool is a tool definition. Custom tools leave Type empty (or set it to
+// "custom") and describe their input with InputSchema; Anthropic-defined
+// tools such as bash_20250124 are identified by Type alone.
+type Tool struct {
+    Type        string          `json:"type,omitempty"`
+    Name        string          `json:"name"`
+    Description string          `json:"description,omitempty"`
+    InputSchema json.RawMessage `json:"input_schema,omitempty"`
+
+    CacheControl json.RawMessage `json:"cache_control,omitempty"`
+}
+
+// IsCustom reports whether t is a user-defined tool rather than one of
+// Anthropic's built-in tool types.
+func (t Tool) IsCustom() bool {
+    return t.Type == "" || t.Type == "custom"
+}
+
+type ToolChoice struct {
+    Type                   string `json:"type"`
+    Name                   string `json:"name,omitempty"`
+    DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
 }
 
 type VertexAIRequest struct {
-    AnthropicVersion string    `json:"anthropic_version"`
-    Messages         []Message `json:"messages"`
-    System           string    `json:"system,omitempty"`
-    MaxTokens        int       `json:"max_tokens"`
-    Stream           bool      `json:"stream"`
+    AnthropicVersion string      `json:"anthropic_version"`
+    Messages         []Message   `json:"messages"`
+    System           string      `json:"system,omitempty"`
+    MaxTokens        int         `json:"max_tokens"`
+    Stream           bool        `json:"stream"`
+    Tools            []Tool      `json:"tools,omitempty"`
+    ToolChoice       *ToolChoice `json:"tool_choice,omitempty"`
+    Temperature      *float64    `json:"temperature,omitempty"`
+    TopP             *float64    `json:"top_p,omitempty"`
+    TopK             *int        `json:"top_k,omitempty"`
+    StopSequences    []string    `json:"stop_sequences,omitempty"`
 }
 
 type VertexAIResponse struct {
-    ID         string    `json:"id"`
-    Type       string    `json:"type"`
-    Role       string    `json:"role"`
-    Content    []Content `json:"content"`
-    Model      string    `json:"model"`
-    StopReason string    `json:"stop_reason"`
-    Usage      Usage     `json:"usage"`
+    ID           string         `json:"id"`
+    Type         string         `json:"type"`
+    Role         string         `json:"role"`
+    Content      []ContentBlock `json:"content"`
+    Model        string         `json:"model"`
+    StopReason   string         `json:"stop_reason"`
+    StopSequence *string        `json:"stop_sequence"`
+    Usage        Usage          `json:"usage"`
 }
 
-type Content struct {
-    Type string `json:"type"`
-    Text string `json:"text"`
+// AnthropicResponse is the Message object returned by /v1/messages for
+// non-streaming requests.
+type AnthropicResponse struct {
+    ID           string         `json:"id"`
+    Type         string         `json:"type"`
+    Role         string         `json:"role"`
+    Model        string         `json:"model"`
+    Content      []ContentBlock `json:"content"`
+    StopReason   string         `json:"stop_reason"`
+    StopSequence *string        `json:"stop_sequence"`
+    Usage        Usage          `json:"usage"`
 }
 
 type Usage struct {
-    InputTokens  int `json:"input_tokens"`
-    OutputTokens int `json:"output_tokens"`
-}
\ No newline at end of file
+    InputTokens              int `json:"input_tokens"`
+    OutputTokens             int `json:"output_tokens"`
+    CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+    CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+}
@@ -0,0 +1,224 @@
+// Package usage keeps a ledger of the tokens each request used and what
+// they cost, as JSON lines appended to a file, and summarises it by key,
+// model and day.
+package usage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"vertexai-anthropic-proxy/config"
+	"vertexai-anthropic-proxy/translation"
+	"vertexai-anthropic-proxy/utils"
+)
+
+// ErrNoLedger is returned when asking for usage without a ledger.
+var ErrNoLedger = errors.New("usage ledger is not enabled; set USAGE_LEDGER_FILE")
+
+// Record is one line of the ledger: a request Vertex AI reported usage
+// for.
+type Record struct {
+	Time     time.Time `json:"time"`
+	Key      string    `json:"key"`
+	Owner    string    `json:"owner,omitempty"`
+	Team     string    `json:"team,omitempty"`
+	Endpoint string    `json:"endpoint"`
+	// Model is the model the client asked for, VertexModel the model ID
+	// it was routed to
+	Model       string `json:"model"`
+	VertexModel string `json:"vertex_model"`
+	Backend     string `json:"backend,omitempty"`
+	Region      string `json:"region,omitempty"`
+	Status      int    `json:"status"`
+
+	InputTokens              int `json:"input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+
+	LatencyMS int64 `json:"latency_ms"`
+	// CostUSD is computed from the price table when the request is
+	// recorded; it is 0 for models without a price
+	CostUSD float64 `json:"cost_usd"`
+}
+
+// Ledger appends records to a JSONL file. A nil *Ledger records nothing.
+type Ledger struct {
+	path   string
+	prices Prices
+	now    func() time.Time
+
+	mu   sync.Mutex
+	file *os.File
+	// size is how much of the file holds complete records
+	size int64
+	// unpriced are the models already warned about
+	unpriced map[string]bool
+}
+
+// Open opens or creates the ledger file at path.
+func Open(path string, prices Prices) (*Ledger, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Ledger{
+		path:     path,
+		prices:   prices,
+		now:      time.Now,
+		file:     f,
+		size:     info.Size(),
+		unpriced: make(map[string]bool),
+	}, nil
+}
+
+// FromConfig opens the ledger named by USAGE_LEDGER_FILE with prices. Without
+// USAGE_LEDGER_FILE it returns nil, and usage is not recorded.
+func FromConfig(cfg *config.Config, prices Prices) (*Ledger, error) {
+	if cfg.UsageLedgerFile == "" {
+		return nil, nil
+	}
+	return Open(cfg.UsageLedgerFile, prices)
+}
+
+// Close closes the ledger file.
+func (l *Ledger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Account identifies who a request is charged to: the API key's ID, its
+// owner and its team.
+type Account struct {
+	Key, Owner, Team string
+}
+
+// Start begins the record of a request to endpoint by account.
+func (l *Ledger) Start(endpoint string, account Account) *Entry {
+	if l == nil {
+		return nil
+	}
+	return &Entry{start: l.now(), rec: Record{Key: account.Key, Owner: account.Owner, Team: account.Team, Endpoint: endpoint}}
+}
+
+// Finish completes e with the response status and appends it to the
+// ledger, if Vertex AI reported usage for the request.
+func (l *Ledger) Finish(e *Entry, status int) error {
+	if l == nil || e == nil {
+		return nil
+	}
+	rec, ok := e.record()
+	if !ok {
+		return nil
+	}
+	rec.Time = e.start.UTC()
+	rec.Status = status
+	rec.LatencyMS = l.now().Sub(e.start).Milliseconds()
+
+	cost, priced := l.prices.Cost(rec.VertexModel, translation.Usage{
+		InputTokens:              rec.InputTokens,
+		CacheCreationInputTokens: rec.CacheCreationInputTokens,
+		CacheReadInputTokens:     rec.CacheReadInputTokens,
+		OutputTokens:             rec.OutputTokens,
+	})
+	rec.CostUSD = cost
+	return l.append(rec, priced)
+}
+
+func (l *Ledger) append(rec Record, priced bool) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !priced && !l.unpriced[rec.VertexModel] {
+		l.unpriced[rec.VertexModel] = true
+		utils.GetLogger().Warnf("No price for %s; its usage is recorded at no cost", rec.VertexModel)
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Entry collects the record of one request while it is handled. With no
+// USAGE_LEDGER_FILE there is no Entry in the request context, and the
+// setters called on the resulting nil Entry are dropped.
+type Entry struct {
+	start time.Time
+
+	mu       sync.Mutex
+	rec      Record
+	hasUsage bool
+}
+
+// SetModel sets the model the client asked for and the Vertex AI model ID
+// it was routed to.
+func (e *Entry) SetModel(model, vertexModel string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rec.Model = model
+	e.rec.VertexModel = vertexModel
+}
+
+// SetBackend sets the backend that answered.
+func (e *Entry) SetBackend(backend, region string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rec.Backend = backend
+	e.rec.Region = region
+}
+
+// SetUsage sets the tokens Vertex AI reported.
+func (e *Entry) SetUsage(u translation.Usage) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rec.InputTokens = u.InputTokens
+	e.rec.CacheCreationInputTokens = u.CacheCreationInputTokens
+	e.rec.CacheReadInputTokens = u.CacheReadInputTokens
+	e.rec.OutputTokens = u.OutputTokens
+	e.hasUsage = true
+}
+
+func (e *Entry) record() (Record, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rec, e.hasUsage
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying e.
+func NewContext(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, e)
+}
+
+// FromContext returns the Entry in ctx, or nil if there is none.
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(contextKey{}).(*Entry)
+	return e
+}
@@ -0,0 +1,90 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"vertexai-anthropic-proxy/config"
+	"vertexai-anthropic-proxy/translation"
+)
+
+// Price is what a model costs in US dollars per million tokens.
+type Price struct {
+	Input float64 `json:"input"`
+	// CacheWrite and CacheRead are the prices of input tokens written to
+	// and read from the prompt cache
+	CacheWrite float64 `json:"cache_write"`
+	CacheRead  float64 `json:"cache_read"`
+	Output     float64 `json:"output"`
+}
+
+// Prices maps Vertex AI model names, with or without the version (e.g.
+// claude-3-5-sonnet or claude-3-5-sonnet@20240620), to their price.
+type Prices map[string]Price
+
+// DefaultPrices returns the list prices of the Claude models on Vertex AI.
+func DefaultPrices() Prices {
+	sonnet := Price{Input: 3, CacheWrite: 3.75, CacheRead: 0.30, Output: 15}
+	opus := Price{Input: 15, CacheWrite: 18.75, CacheRead: 1.50, Output: 75}
+	return Prices{
+		"claude-3-5-sonnet":    sonnet,
+		"claude-3-5-sonnet-v2": sonnet,
+		"claude-3-7-sonnet":    sonnet,
+		"claude-sonnet-4":      sonnet,
+		"claude-3-opus":        opus,
+		"claude-opus-4":        opus,
+		"claude-3-5-haiku":     {Input: 0.80, CacheWrite: 1, CacheRead: 0.08, Output: 4},
+		"claude-3-haiku":       {Input: 0.25, CacheWrite: 0.30, CacheRead: 0.03, Output: 1.25},
+	}
+}
+
+// LoadPrices reads a JSON file of the form
+// {"claude-3-5-sonnet": {"input": 3, "cache_write": 3.75, "cache_read": 0.3, "output": 15}}
+// and returns the default prices with the file's prices added or replaced.
+func LoadPrices(path string) (Prices, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file Prices
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	prices := DefaultPrices()
+	for model, price := range file {
+		if price.Input < 0 || price.CacheWrite < 0 || price.CacheRead < 0 || price.Output < 0 {
+			return nil, fmt.Errorf("%s: negative price for %s", path, model)
+		}
+		prices[model] = price
+	}
+	return prices, nil
+}
+
+// PricesFromConfig returns the default prices, with those in PRICES_FILE
+// if it is set.
+func PricesFromConfig(cfg *config.Config) (Prices, error) {
+	if cfg.PricesFile == "" {
+		return DefaultPrices(), nil
+	}
+	return LoadPrices(cfg.PricesFile)
+}
+
+// Cost returns the cost of u with vertexModel, and false if the model has
+// no price.
+func (p Prices) Cost(vertexModel string, u translation.Usage) (float64, bool) {
+	price, ok := p[vertexModel]
+	if !ok {
+		name, _, _ := strings.Cut(vertexModel, "@")
+		if price, ok = p[name]; !ok {
+			return 0, false
+		}
+	}
+	cost := float64(u.InputTokens)*price.Input +
+		float64(u.CacheCreationInputTokens)*price.CacheWrite +
+		float64(u.CacheReadInputTokens)*price.CacheRead +
+		float64(u.OutputTokens)*price.Output
+	return cost / 1e6, true
+}
@@ -0,0 +1,180 @@
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// Fields a summary can be grouped by
+const (
+	GroupKey   = "key"
+	GroupModel = "model"
+	GroupDay   = "day"
+)
+
+// dayFormat is how days are written, in UTC.
+const dayFormat = "2006-01-02"
+
+// Query selects the records to summarise and how to group them.
+type Query struct {
+	// From and To limit the records to those made on or after From and
+	// before To; zero values leave that end open
+	From, To time.Time
+	// Key and Model, if set, only keep records of that key or Vertex AI
+	// model ID
+	Key, Model string
+	// GroupBy lists GroupKey, GroupModel and GroupDay; records that agree
+	// on all of them are added up
+	GroupBy []string
+}
+
+// Summary adds up the records of a group. Key, Model and Day are only set
+// when grouping by them.
+type Summary struct {
+	Key   string `json:"key,omitempty"`
+	Model string `json:"model,omitempty"`
+	Day   string `json:"day,omitempty"`
+
+	Requests                 int     `json:"requests"`
+	InputTokens              int     `json:"input_tokens"`
+	CacheCreationInputTokens int     `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int     `json:"cache_read_input_tokens"`
+	OutputTokens             int     `json:"output_tokens"`
+	CostUSD                  float64 `json:"cost_usd"`
+}
+
+func (s *Summary) add(rec Record) {
+	s.Requests++
+	s.InputTokens += rec.InputTokens
+	s.CacheCreationInputTokens += rec.CacheCreationInputTokens
+	s.CacheReadInputTokens += rec.CacheReadInputTokens
+	s.OutputTokens += rec.OutputTokens
+	s.CostUSD += rec.CostUSD
+}
+
+// ValidGroup reports whether name is a field summaries can be grouped by.
+func ValidGroup(name string) bool {
+	return name == GroupKey || name == GroupModel || name == GroupDay
+}
+
+// Summarize reads the ledger and returns a summary for each group of
+// records matching q, sorted by key, model and day, and the total over
+// all of them.
+func (l *Ledger) Summarize(q Query) ([]Summary, Summary, error) {
+	if l == nil {
+		return nil, Summary{}, ErrNoLedger
+	}
+	for _, g := range q.GroupBy {
+		if !ValidGroup(g) {
+			return nil, Summary{}, fmt.Errorf("cannot group by %q", g)
+		}
+	}
+
+	groups := make(map[Summary]*Summary)
+	var total Summary
+	err := l.Records(func(rec Record) {
+		if !q.matches(rec) {
+			return
+		}
+		group := q.group(rec)
+		s, ok := groups[group]
+		if !ok {
+			s = &group
+			groups[group] = s
+		}
+		s.add(rec)
+		total.add(rec)
+	})
+	if err != nil {
+		return nil, Summary{}, err
+	}
+
+	summaries := make([]Summary, 0, len(groups))
+	for _, s := range groups {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		return a.Day < b.Day
+	})
+	return summaries, total, nil
+}
+
+// Records calls fn with every record in the ledger, oldest first.
+func (l *Ledger) Records(fn func(Record)) error {
+	if l == nil {
+		return ErrNoLedger
+	}
+
+	// Only read the records complete when reading started, so appends can
+	// carry on meanwhile
+	l.mu.Lock()
+	size := l.size
+	l.mu.Unlock()
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(f, size))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("reading %s: %v", l.path, err)
+		}
+		fn(rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %s: %v", l.path, err)
+	}
+	return nil
+}
+
+func (q Query) matches(rec Record) bool {
+	switch {
+	case !q.From.IsZero() && rec.Time.Before(q.From):
+		return false
+	case !q.To.IsZero() && !rec.Time.Before(q.To):
+		return false
+	case q.Key != "" && rec.Key != q.Key:
+		return false
+	case q.Model != "" && rec.VertexModel != q.Model:
+		return false
+	}
+	return true
+}
+
+// group returns the empty summary identifying rec's group.
+func (q Query) group(rec Record) Summary {
+	var s Summary
+	for _, g := range q.GroupBy {
+		switch g {
+		case GroupKey:
+			s.Key = rec.Key
+		case GroupModel:
+			s.Model = rec.VertexModel
+		case GroupDay:
+			s.Day = rec.Time.UTC().Format(dayFormat)
+		}
+	}
+	return s
+}
+
+// ParseDay parses a day such as 2024-07-01 as midnight UTC.
+func ParseDay(s string) (time.Time, error) {
+	return time.Parse(dayFormat, s)
+}
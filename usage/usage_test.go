@@ -0,0 +1,155 @@
+package usage
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vertexai-anthropic-proxy/translation"
+)
+
+func TestCost(t *testing.T) {
+	prices := DefaultPrices()
+	u := translation.Usage{InputTokens: 1000000, CacheCreationInputTokens: 100000, CacheReadInputTokens: 1000000, OutputTokens: 200000}
+
+	// 3 + 0.375 + 0.3 + 3
+	cost, ok := prices.Cost("claude-3-5-sonnet@20240620", u)
+	if !ok || math.Abs(cost-6.675) > 1e-9 {
+		t.Errorf("Cost() = %v, %v, want 6.675", cost, ok)
+	}
+
+	// A versioned entry takes precedence over the model name
+	prices["claude-3-5-sonnet@20240620"] = Price{Input: 1}
+	if cost, _ := prices.Cost("claude-3-5-sonnet@20240620", u); cost != 1 {
+		t.Errorf("Cost() = %v, want 1", cost)
+	}
+
+	if _, ok := prices.Cost("gemini-1.5-pro", u); ok {
+		t.Error("Cost() priced an unknown model")
+	}
+}
+
+func TestLoadPrices(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prices.json")
+	os.WriteFile(path, []byte(`{"claude-3-haiku": {"input": 0.2, "output": 1}, "custom": {"input": 1, "output": 2}}`), 0o600)
+
+	prices, err := LoadPrices(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prices["claude-3-haiku"].Input != 0.2 || prices["custom"].Output != 2 || prices["claude-3-opus"].Input != 15 {
+		t.Errorf("prices = %+v", prices)
+	}
+
+	os.WriteFile(path, []byte(`{"custom": {"input": -1}}`), 0o600)
+	if _, err := LoadPrices(path); err == nil {
+		t.Error("LoadPrices accepted a negative price")
+	}
+}
+
+func newTestLedger(t *testing.T) (*Ledger, *time.Time) {
+	t.Helper()
+	l, err := Open(filepath.Join(t.TempDir(), "usage.jsonl"), DefaultPrices())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	now := time.Date(2024, 7, 1, 23, 59, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func record(t *testing.T, l *Ledger, key, vertexModel string, u translation.Usage) {
+	t.Helper()
+	e := l.Start("/v1/messages", Account{Key: key, Team: "team"})
+	e.SetModel("alias", vertexModel)
+	e.SetBackend("p/us-east5", "us-east5")
+	e.SetUsage(u)
+	if err := l.Finish(e, 200); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLedger(t *testing.T) {
+	l, now := newTestLedger(t)
+
+	// Requests without usage are not recorded
+	if err := l.Finish(l.Start("/v1/messages", Account{Key: "ci"}), 401); err != nil {
+		t.Fatal(err)
+	}
+
+	record(t, l, "ci", "claude-3-5-sonnet@20240620", translation.Usage{InputTokens: 1000, OutputTokens: 100})
+	record(t, l, "ci", "claude-3-haiku@20240307", translation.Usage{InputTokens: 1000, OutputTokens: 100})
+	*now = now.Add(2 * time.Minute) // the next day
+	record(t, l, "ci", "claude-3-5-sonnet@20240620", translation.Usage{InputTokens: 2000, OutputTokens: 200})
+	record(t, l, "web", "claude-3-5-sonnet@20240620", translation.Usage{InputTokens: 1000, OutputTokens: 100})
+
+	summaries, total, err := l.Summarize(Query{GroupBy: []string{GroupKey, GroupDay}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Summary{
+		{Key: "ci", Day: "2024-07-01", Requests: 2, InputTokens: 2000, OutputTokens: 200},
+		{Key: "ci", Day: "2024-07-02", Requests: 1, InputTokens: 2000, OutputTokens: 200},
+		{Key: "web", Day: "2024-07-02", Requests: 1, InputTokens: 1000, OutputTokens: 100},
+	}
+	if len(summaries) != len(want) {
+		t.Fatalf("summaries = %+v", summaries)
+	}
+	for i, s := range summaries {
+		s.CostUSD = 0
+		if s != want[i] {
+			t.Errorf("summary %d = %+v, want %+v", i, s, want[i])
+		}
+	}
+	// 0.0045, 0.009 and 0.0045 for the Sonnet requests and 0.000375 for Haiku
+	if total.Requests != 4 || math.Abs(total.CostUSD-0.018375) > 1e-9 {
+		t.Errorf("total = %+v", total)
+	}
+
+	from, _ := ParseDay("2024-07-02")
+	summaries, _, err = l.Summarize(Query{From: from, Model: "claude-3-5-sonnet@20240620", GroupBy: []string{GroupModel}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].Model != "claude-3-5-sonnet@20240620" || summaries[0].Requests != 2 {
+		t.Errorf("summaries = %+v", summaries)
+	}
+
+	if _, _, err := l.Summarize(Query{GroupBy: []string{"team"}}); err == nil {
+		t.Error("Summarize accepted an unknown group")
+	}
+}
+
+func TestLedgerReopen(t *testing.T) {
+	l, _ := newTestLedger(t)
+	record(t, l, "ci", "claude-3-5-sonnet@20240620", translation.Usage{InputTokens: 10})
+	l.Close()
+
+	reopened, err := Open(l.path, DefaultPrices())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	record(t, reopened, "ci", "claude-3-5-sonnet@20240620", translation.Usage{InputTokens: 10})
+
+	_, total, err := reopened.Summarize(Query{})
+	if err != nil || total.Requests != 2 {
+		t.Errorf("total = %+v, %v, want 2 requests", total, err)
+	}
+}
+
+func TestNilLedger(t *testing.T) {
+	var l *Ledger
+	e := l.Start("/v1/messages", Account{Key: "ci"})
+	e.SetModel("m", "m")
+	e.SetUsage(translation.Usage{InputTokens: 1})
+	if err := l.Finish(e, 200); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := l.Summarize(Query{}); err != ErrNoLedger {
+		t.Errorf("Summarize() error = %v, want ErrNoLedger", err)
+	}
+}